@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/reusing-code/dochan/users"
+)
+
+// documents below this directory of the storage path are private to the user
+// named by the next path element, e.g. private/alice/letter.pdf
+const privateDir = "private"
+
+type access int
+
+const (
+	readAccess access = iota
+	writeAccess
+)
+
+// ownerOf returns the user a file is private to, empty if it isn't in a private folder
+func (s *server) ownerOf(path string) string {
+	rel, err := filepath.Rel(s.dir, path)
+	if err != nil {
+		return ""
+	}
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	if len(parts) > 2 && parts[0] == privateDir && users.ValidName(parts[1]) {
+		return parts[1]
+	}
+	return ""
+}
+
+// documentAccess only passes requests of users allowed to read or change the
+// document of the request. Documents the user can't read are reported missing.
+func (s *server) documentAccess(level access, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key, err := documentKey(r)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		f, err := s.db.GetFile(key)
+		user := requestUser(r)
+		if err != nil || user == nil || !user.CanRead(f.Owner, f.SharedWith) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if level == writeAccess && !user.CanWrite(f.Owner) {
+			http.Error(w, "Not allowed to change the document", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// canRead reports whether the user of the request may see a document
+func (s *server) canRead(r *http.Request, key uint64) bool {
+	f, err := s.db.GetFile(key)
+	if err != nil {
+		return false
+	}
+	user := requestUser(r)
+	return user != nil && user.CanRead(f.Owner, f.SharedWith)
+}
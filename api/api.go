@@ -2,26 +2,35 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
 	"encoding/json"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"runtime"
 	"sort"
 	"strconv"
+	"sync"
 	"time"
 
+	"github.com/reusing-code/dochan/classifier"
+	"github.com/reusing-code/dochan/crypt"
+	"github.com/reusing-code/dochan/jobs"
 	"github.com/reusing-code/dochan/refuel"
+	"github.com/reusing-code/dochan/scancache"
 
 	"github.com/gorilla/handlers"
 
 	"github.com/namsral/flag"
 
 	"github.com/reusing-code/dochan/db"
-	"github.com/reusing-code/dochan/parser"
 
 	"github.com/reusing-code/dochan/searchTree"
+	"github.com/reusing-code/dochan/similarity"
+	"github.com/reusing-code/dochan/users"
+	"github.com/reusing-code/dochan/watcher"
 
 	"github.com/gorilla/mux"
 
@@ -29,13 +38,55 @@ import (
 )
 
 type server struct {
-	port      int
-	dir       string
-	search    *searchTree.SearchTree
-	db        *db.DB
-	dbPath    string
-	assetPath string
-	secret    string
+	port       int
+	dir        string
+	search     *searchTree.SearchTree
+	searchKeys map[uint64]string
+	similar    *similarity.Index
+	db         *db.DB
+	fuel       *refuel.DB
+	users      *users.Store
+	sessions   *SessionDB
+	watcher    watcher.Watcher
+	jobs       *jobs.Queue
+	scanCache  *scancache.Cache
+	// closed when the ingestion workers stopped
+	jobsStopped chan struct{}
+	// canceled on SIGTERM and SIGINT
+	ctx        context.Context
+	classifier *classifier.Classifier
+	dbPath     string
+	assetPath  string
+	secret     string
+	// guards searchKeys, the search tree is synchronized itself
+	indexMtx sync.RWMutex
+	// serializes adding, changing and removing documents
+	ingestMtx sync.Mutex
+	// last DB journal entry applied to the search index
+	journalSeq   uint64
+	journalMtx   sync.Mutex
+	watch        bool
+	pollInterval time.Duration
+	// files parsed concurrently and the time pdftohtml may take per file
+	parseWorkers int
+	parseTimeout time.Duration
+	maxUpload    int64
+	maxRestore   int64
+	sessionIdle  time.Duration
+	sessionTTL   time.Duration
+	auditLog     string
+	tlsCert      string
+	tlsKey       string
+	redirectPort int
+	hstsMaxAge   time.Duration
+	cors         struct {
+		origins     string
+		methods     string
+		headers     string
+		credentials bool
+	}
+	// time to finish requests and ingestion when shutting down
+	shutdownTimeout time.Duration
 }
 
 type SearchResult struct {
@@ -47,13 +98,26 @@ type SearchResult struct {
 type Document struct {
 	ID       uint64 `json:"id"`
 	Filename string `json:"filename"`
+	Title    string `json:"title,omitempty"`
 	Content  string `json:"content"`
+	// for filtering results by the user
+	Owner      string   `json:"-"`
+	SharedWith []string `json:"-"`
 }
 
 type ResponseDocument struct {
-	ID         uint64 `json:"id"`
-	Filename   string `json:"filename"`
-	RawContent []byte `json:"content"`
+	ID            uint64     `json:"id"`
+	Filename      string     `json:"filename"`
+	RawContent    []byte     `json:"content"`
+	Type          string     `json:"type"`
+	Tags          []string   `json:"tags"`
+	DuplicateOf   uint64     `json:"duplicateOf,omitempty"`
+	Title         string     `json:"title"`
+	DocumentDate  *time.Time `json:"documentDate,omitempty"`
+	Correspondent string     `json:"correspondent"`
+	Notes         string     `json:"notes"`
+	Owner         string     `json:"owner,omitempty"`
+	SharedWith    []string   `json:"sharedWith,omitempty"`
 }
 
 func main() {
@@ -64,79 +128,197 @@ func main() {
 	fs.StringVar(&serv.dbPath, "dbFile", "dochan", "DB File storage base name")
 	fs.StringVar(&serv.assetPath, "assetPath", "assets/", "Static assets to serve")
 	fs.StringVar(&serv.secret, "secret", "", "Secret used for authentication")
+	fs.Int64Var(&serv.maxUpload, "maxUpload", 100<<20, "Maximum size of uploaded documents in bytes")
+	fs.Int64Var(&serv.maxRestore, "maxRestore", 16<<30, "Maximum size of restored backup archives in bytes")
+	fs.BoolVar(&serv.watch, "watch", true, "Watch the document storage path for changes")
+	fs.IntVar(&serv.parseWorkers, "parseWorkers", runtime.NumCPU(), "Number of files parsed concurrently")
+	fs.DurationVar(&serv.parseTimeout, "parseTimeout", 5*time.Minute, "Parsing a file fails if pdftohtml takes longer (0: no limit)")
+	fs.DurationVar(&serv.pollInterval, "pollInterval", 0, "Poll the document storage path in this interval instead of using inotify, e.g. for network shares (0: poll only if inotify is unavailable)")
+	fs.DurationVar(&serv.sessionIdle, "sessionIdle", 24*time.Hour, "Sessions expire if unused for this long (0: never)")
+	fs.DurationVar(&serv.sessionTTL, "sessionTTL", 30*24*time.Hour, "Sessions expire this long after logging in (0: never)")
+	fs.StringVar(&serv.auditLog, "auditLog", "", "File logins and user changes are logged to (default: DB file base name + .audit.log)")
+	fs.StringVar(&serv.tlsCert, "tlsCert", "", "Serve HTTPS with this certificate file, created self-signed if it doesn't exist")
+	fs.StringVar(&serv.tlsKey, "tlsKey", "", "Key file of --tlsCert")
+	fs.IntVar(&serv.redirectPort, "redirectPort", 0, "With TLS, redirect plain HTTP requests on this port to HTTPS (0: off)")
+	fs.DurationVar(&serv.hstsMaxAge, "hstsMaxAge", 365*24*time.Hour, "With TLS, browsers only use HTTPS for this long after a visit, not sent for self-signed certificates (0: off)")
+	fs.DurationVar(&serv.shutdownTimeout, "shutdownTimeout", 30*time.Second, "Time to finish running requests on shutdown")
+	fs.StringVar(&serv.cors.origins, "corsOrigins", "", "Comma separated origins allowed to use the API from a browser, * for all (default: same origin only)")
+	fs.StringVar(&serv.cors.methods, "corsMethods", "GET, HEAD, POST, PATCH, DELETE", "Comma separated methods allowed for other origins")
+	fs.StringVar(&serv.cors.headers, "corsHeaders", "X-Session-Token, Authorization, Content-Type", "Comma separated request headers allowed for other origins")
+	fs.BoolVar(&serv.cors.credentials, "corsCredentials", false, "Allow other origins to send credentials like cookies")
+	passphrase := fs.String("passphrase", "", "Encrypt stored documents with a key derived from this passphrase, better set DOCHAN_PASSPHRASE than the flag")
+	keyFile := fs.String("keyFile", "", "Encrypt stored documents with a key derived from this file")
 	fs.Parse(os.Args[1:])
 
+	var secret crypt.Secret
 	var err error
-	serv.db, err = db.New(serv.dbPath + ".documents.db")
+	if *keyFile != "" {
+		secret, err = crypt.KeyFile(*keyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else if *passphrase != "" {
+		secret = crypt.Passphrase(*passphrase)
+	}
+	serv.db, err = db.NewWithSecret(serv.dbPath+".documents.db", secret)
 
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	err = serv.init()
+	// samples and model are derived from the text, they use the keys of the documents
+	serv.classifier, err = classifier.NewEncrypted(serv.dbPath+".classifier.db", serv.db.Cipher())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	serv.jobs, err = jobs.New(serv.dbPath + ".jobs.db")
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	err = serv.start()
+	serv.scanCache, err = scancache.New(serv.dbPath + ".scan.db")
 	if err != nil {
 		log.Fatal(err)
 	}
+
+	serv.ctx = handleSignals()
+	err = serv.init()
+	if err == nil {
+		err = serv.start()
+	}
+	serv.close()
+	if err != nil && err != context.Canceled {
+		log.Fatal(err)
+	}
 }
 
 func (s *server) init() error {
 	s.search = searchTree.MakeSearchTree()
-	fileCount := 0
-	err := parser.ParseDir(s.dir, func(f parser.File, strings []string, rawData []byte) {
-		s.db.AddFile(f.Filename, f.Hash, rawData, strings)
-		fileCount++
-
-	}, parser.ExtensionFilter([]string{"pdf"}, func(f parser.File) bool {
-		return s.db.Contains(f.Hash)
-	}))
+	s.searchKeys = make(map[uint64]string)
+	s.similar = similarity.NewIndex()
+	err := s.db.GetAllSignatures(func(key uint64, sig []uint64) {
+		s.similar.Add(key, sig)
+	})
 	if err != nil {
 		return err
 	}
-	log.Printf("Added %v new files", fileCount)
 
+	// the search index is built from all documents, older changes are included
+	s.journalSeq, err = s.db.JournalSeq()
+	if err != nil {
+		return err
+	}
+	unsigned := make(map[uint64][]string)
 	err = s.db.GetAllFiles(func(key uint64, file db.DBFile) {
-		cont := ""
-		if len(file.Content) > 0 {
-			cont = file.Content[0]
-		}
-		doc := Document{ID: key, Filename: file.Name, Content: cont}
-		var buf bytes.Buffer
-		enc := gob.NewEncoder(&buf)
-		err := enc.Encode(doc)
-		if err != nil {
-			log.Printf("Error encoding file %v", file.Path)
+		if !file.Deleted.IsZero() {
+			// documents in the trash are kept out of all indexes
+			s.similar.Remove(key)
 			return
 		}
-		s.search.AddContent(file.Content, buf.String())
+		if _, ok := s.similar.Get(key); !ok {
+			unsigned[key] = file.Content
+		}
+		if (file.Type != "" || len(file.Tags) > 0) && !s.classifier.IsTrained(key) {
+			err := s.classifier.Train(key, file.Type, file.Tags, file.Content)
+			if err != nil {
+				log.Printf("Error training classifier with %v: %v", file.Path, err)
+			}
+		}
+		s.addToSearch(key, &file)
 	})
 	if err != nil {
 		return err
 	}
-	return err
+	err = s.db.TrimJournal(s.journalSeq)
+	if err != nil {
+		return err
+	}
+
+	// documents imported before duplicate detection existed
+	for key, content := range unsigned {
+		err = s.indexSignature(key, content, false)
+		if err != nil {
+			log.Printf("Error indexing signature of document %v: %v", key, err)
+		}
+	}
+
+	// search works on the documents indexed so far while new ones are ingested
+	s.jobsStopped = make(chan struct{})
+	go func() {
+		s.jobs.Run(s.ctx, s.parseWorkers, s.ingestItem)
+		close(s.jobsStopped)
+	}()
+	s.queueScan()
+
+	if s.watch {
+		return s.watchDir()
+	}
+	return nil
 }
 
 func (s *server) start() error {
 	router := mux.NewRouter()
 
-	session, err := NewSessionHandler(s.dbPath+".session.db", s.secret)
+	if s.auditLog == "" {
+		s.auditLog = s.dbPath + ".audit.log"
+	}
+	auditFile, err := os.OpenFile(s.auditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	session, err := NewSessionHandler(s.dbPath+".session.db", s.secret, s.sessionIdle, s.sessionTTL, log.New(auditFile, "", log.LstdFlags))
 	if err != nil {
 		return err
 	}
+	s.sessions = session
+	s.users = session.users
 
 	clientSideRoutes := []string{"/about", "/login", "/document", "/search", "/fuel"}
 
 	apiRouter := router.PathPrefix("/api").Subrouter()
+	apiRouter.HandleFunc("/documents", s.uploadHandler).Methods("POST")
 	apiRouter.HandleFunc("/documents", s.searchHandler)
-	apiRouter.HandleFunc("/documents/{key:[0-9]+}", s.documentHandler)
-	apiRouter.HandleFunc("/documents/{key:[0-9]+}/download", s.downloadHandler)
+	apiRouter.HandleFunc("/documents/{key:[0-9]+}", s.documentAccess(writeAccess, s.patchHandler)).Methods("PATCH")
+	apiRouter.HandleFunc("/documents/{key:[0-9]+}", s.documentAccess(writeAccess, s.deleteHandler)).Methods("DELETE")
+	apiRouter.HandleFunc("/documents/{key:[0-9]+}", s.documentAccess(readAccess, s.documentHandler))
+	apiRouter.HandleFunc("/documents/{key:[0-9]+}/restore", s.documentAccess(writeAccess, s.restoreHandler)).Methods("POST")
+	apiRouter.HandleFunc("/documents/{key:[0-9]+}/download", s.documentAccess(readAccess, s.downloadHandler))
+	apiRouter.HandleFunc("/documents/{key:[0-9]+}/similar", s.documentAccess(readAccess, s.similarHandler))
+	apiRouter.HandleFunc("/documents/{key:[0-9]+}/related", s.documentAccess(readAccess, s.relatedHandler))
+	apiRouter.HandleFunc("/documents/{key:[0-9]+}/suggestions", s.documentAccess(readAccess, s.suggestionHandler))
+	apiRouter.HandleFunc("/documents/{key:[0-9]+}/suggestions/confirm", s.documentAccess(writeAccess, s.suggestionConfirmHandler)).Methods("POST")
+	apiRouter.HandleFunc("/documents/{key:[0-9]+}/suggestions/reject", s.documentAccess(writeAccess, s.suggestionRejectHandler)).Methods("POST")
+	apiRouter.HandleFunc("/jobs", s.jobsHandler).Methods("GET")
+	apiRouter.HandleFunc("/jobs/{id:[0-9]+}", s.jobHandler).Methods("GET")
+	apiRouter.HandleFunc("/failures", s.failuresHandler).Methods("GET")
+	apiRouter.HandleFunc("/failures/retry", s.retryFailuresHandler).Methods("POST")
+	apiRouter.HandleFunc("/trash", s.emptyTrashHandler).Methods("DELETE")
+	apiRouter.HandleFunc("/trash", s.trashHandler)
+	apiRouter.HandleFunc("/reconcile", adminOnly(s.reconcileHandler)).Methods("GET", "POST")
+	apiRouter.HandleFunc("/backup", adminOnly(s.backupHandler)).Methods("GET")
+	apiRouter.HandleFunc("/backup/restore", adminOnly(s.restoreBackupHandler)).Methods("POST")
 	apiRouter.HandleFunc("/session/create", session.sessionCreateHandler)
+	apiRouter.HandleFunc("/session/logout", session.logoutHandler).Methods("POST")
+	apiRouter.HandleFunc("/sessions", session.sessionsHandler).Methods("GET")
+	apiRouter.HandleFunc("/sessions/{id:[0-9a-f]+}", session.revokeSessionHandler).Methods("DELETE")
+	apiRouter.HandleFunc("/tokens", session.tokensHandler).Methods("GET")
+	apiRouter.HandleFunc("/tokens", session.createTokenHandler).Methods("POST")
+	apiRouter.HandleFunc("/tokens/{id:[0-9a-f]+}", session.revokeTokenHandler).Methods("DELETE")
+	apiRouter.HandleFunc("/user", session.currentUserHandler).Methods("GET")
+	apiRouter.HandleFunc("/user", session.changePasswordHandler).Methods("PATCH")
+	apiRouter.HandleFunc("/user/totp", session.beginTOTPHandler).Methods("POST")
+	apiRouter.HandleFunc("/user/totp", session.disableTOTPHandler).Methods("DELETE")
+	apiRouter.HandleFunc("/user/totp/confirm", session.confirmTOTPHandler).Methods("POST")
+	apiRouter.HandleFunc("/users", adminOnly(session.usersHandler)).Methods("GET")
+	apiRouter.HandleFunc("/users", adminOnly(session.addUserHandler)).Methods("POST")
+	apiRouter.HandleFunc("/users/{name}", adminOnly(session.updateUserHandler)).Methods("PATCH")
+	apiRouter.HandleFunc("/users/{name}", adminOnly(session.deleteUserHandler)).Methods("DELETE")
 	fuelRouter := apiRouter.PathPrefix("/fuel").Subrouter()
-	err = refuel.Register(s.dbPath+".fuel.db", fuelRouter)
+	s.fuel, err = refuel.Register(s.dbPath+".fuel.db", fuelRouter, func(r *http.Request) (string, bool) {
+		user := requestUser(r)
+		return user.Name, user.Role == users.Admin
+	})
 	if err != nil {
 		return err
 	}
@@ -147,14 +329,26 @@ func (s *server) start() error {
 	}
 	router.PathPrefix("/").Handler(http.FileServer(http.Dir(s.assetPath)))
 
-	router.Use(crossOriginMiddleware)
-
-	loggedRouter := handlers.LoggingHandler(os.Stdout, router)
-
-	http.Handle("/", loggedRouter)
-
-	log.Print((http.ListenAndServe(":"+strconv.Itoa(s.port), nil)))
-	return nil
+	cors, err := newCORSConfig(s.cors.origins, s.cors.methods, s.cors.headers, s.cors.credentials, apiRouter)
+	if err != nil {
+		return err
+	}
+	// outside of the router, preflight requests aren't authenticated and
+	// routes restricted to other methods don't match them
+	loggedRouter := handlers.LoggingHandler(os.Stdout, cors.middleware(router))
+
+	srv := &http.Server{Addr: ":" + strconv.Itoa(s.port), Handler: loggedRouter}
+	servers := []*http.Server{srv}
+	if s.tlsCert != "" || s.tlsKey != "" {
+		redirect, err := s.configureTLS(srv)
+		if err != nil {
+			return err
+		}
+		if redirect != nil {
+			servers = append(servers, redirect)
+		}
+	}
+	return s.serve(servers...)
 }
 
 func (s *server) indexHandler(w http.ResponseWriter, r *http.Request) {
@@ -177,6 +371,7 @@ func (s *server) searchHandler(w http.ResponseWriter, r *http.Request) {
 	res := s.search.Search(searchKey, true)
 	elapsed := time.Since(start)
 
+	user := requestUser(r)
 	var docs []Document
 	for _, str := range res.GetResSlice() {
 		buf := bytes.NewBufferString(str)
@@ -187,12 +382,15 @@ func (s *server) searchHandler(w http.ResponseWriter, r *http.Request) {
 			log.Printf("Error decoding value")
 			continue
 		}
+		if !user.CanRead(doc.Owner, doc.SharedWith) {
+			continue
+		}
 		docs = append(docs, doc)
 	}
 
 	sort.Slice(docs, func(i, j int) bool { return docs[i].Filename < docs[j].Filename })
 
-	result := SearchResult{Count: len(res.GetRes()), Time: elapsed.String(), Res: docs}
+	result := SearchResult{Count: len(docs), Time: elapsed.String(), Res: docs}
 	js, err := json.Marshal(result)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -204,19 +402,22 @@ func (s *server) searchHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *server) documentHandler(w http.ResponseWriter, r *http.Request) {
-	keyStr := mux.Vars(r)["key"]
-	i, err := strconv.ParseInt(keyStr, 10, 64)
+	key, err := documentKey(r)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	key := uint64(i)
-	f, err := s.db.GetFile(key)
+	f, err := s.getDocument(key)
 	if err != nil {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
-	doc := &ResponseDocument{ID: key, Filename: f.Name, RawContent: f.RawData}
+	doc := responseDocument(key, f)
+	doc.RawContent, err = s.db.ReadRaw(f)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 	js, err := json.Marshal(doc)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -227,33 +428,30 @@ func (s *server) documentHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *server) downloadHandler(w http.ResponseWriter, r *http.Request) {
-	keyStr := mux.Vars(r)["key"]
-	i, err := strconv.ParseInt(keyStr, 10, 64)
+	key, err := documentKey(r)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	key := uint64(i)
-	f, err := s.db.GetFile(key)
+	f, err := s.getDocument(key)
 	if err != nil {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
 
+	raw, err := s.db.OpenRaw(f)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer raw.Close()
+
+	// ServeContent handles Range and conditional requests
 	w.Header().Set("Content-Type", "application/pdf")
-	w.Write(f.RawData)
+	w.Header().Set("ETag", `"`+f.Blob+`"`)
+	http.ServeContent(w, r, f.Name, f.ImportDate, raw)
 }
 
-func crossOriginMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", r.Header.Get("Origin"))
-		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-		w.Header().Set("Access-Control-Expose-Headers", "X-Total-Count, X-Session-Token")
-		w.Header().Set("Access-Control-Allow-Headers", "X-Session-Token")
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
-			return
-		}
-		next.ServeHTTP(w, r)
-	})
+func documentKey(r *http.Request) (uint64, error) {
+	return strconv.ParseUint(mux.Vars(r)["key"], 10, 64)
 }
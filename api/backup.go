@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/reusing-code/dochan/backup"
+)
+
+func (s *server) backupSources() backup.Sources {
+	return backup.Sources{Documents: s.db, Fuel: s.fuel, Users: s.users, Classifier: s.classifier}
+}
+
+// backupHandler streams an archive of all documents, fuel records and users.
+// The archive isn't encrypted, with an encrypted DB query parameter
+// plaintext=true confirms that.
+func (s *server) backupHandler(w http.ResponseWriter, r *http.Request) {
+	if s.db.Encrypted() && r.URL.Query().Get("plaintext") != "true" {
+		http.Error(w, "Documents are encrypted but the archive would not be, confirm with plaintext=true", http.StatusBadRequest)
+		return
+	}
+	// the snapshot is consistent with ingestion, streaming it to a slow client
+	// doesn't block it
+	s.ingestMtx.Lock()
+	snap, err := backup.NewSnapshot(s.backupSources())
+	s.ingestMtx.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer snap.Close()
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"dochan-%s.tar.gz\"", time.Now().Format("2006-01-02")))
+	err = snap.Write(w)
+	if err != nil {
+		// the response is already started, the client gets a truncated archive
+		log.Printf("Error exporting backup: %v", err)
+		return
+	}
+	log.Printf("Exported backup with %v documents", len(snap.Manifest.Documents))
+}
+
+// restoreBackupHandler restores an archive sent as request body. With query
+// parameter merge=true it is added to the existing documents and users.
+func (s *server) restoreBackupHandler(w http.ResponseWriter, r *http.Request) {
+	// the archive is received before taking the ingest lock, so a slow client
+	// doesn't block ingestion
+	body := limitBody(w, r, s.maxRestore)
+	tmp, err := ioutil.TempFile(filepath.Dir(s.dbPath), ".restore-")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	_, err = io.Copy(tmp, r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), body.errorStatus())
+		return
+	}
+	_, err = tmp.Seek(0, io.SeekStart)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.ingestMtx.Lock()
+	defer s.ingestMtx.Unlock()
+	report, err := backup.Restore(tmp, s.backupSources(), backup.Options{Merge: r.URL.Query().Get("merge") == "true"})
+	if report != nil {
+		// documents restored before an error are kept
+		s.indexRestored(report.Documents)
+	}
+	if err == backup.ErrNotEmpty {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Restored %v documents and %v users, skipped %v", len(report.Documents), report.Users, report.Skipped)
+	writeJSON(w, http.StatusOK, report)
+}
+
+func (s *server) indexRestored(keys []uint64) {
+	err := s.applyJournal()
+	if err != nil {
+		log.Printf("Error updating search index: %v", err)
+	}
+	for _, key := range keys {
+		file, err := s.db.GetFile(key)
+		if err != nil {
+			log.Printf("Error indexing restored document %v: %v", key, err)
+			continue
+		}
+		if file.Deleted.IsZero() {
+			err = s.indexSignature(key, file.Content, false)
+			if err != nil {
+				log.Printf("Error indexing signature of document %v: %v", key, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/reusing-code/dochan/crypt"
+	"github.com/reusing-code/dochan/db"
+)
+
+func TestBackupOfEncryptedDB(t *testing.T) {
+	dir := "backup-test"
+	defer os.RemoveAll(dir)
+	os.MkdirAll(dir, 0777)
+	s := &server{}
+	var err error
+	s.db, err = db.NewWithSecret(filepath.Join(dir, "test.documents.db"), crypt.Passphrase("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.db.Close()
+
+	for query, want := range map[string]int{"": http.StatusBadRequest, "?plaintext=true": http.StatusOK} {
+		w := httptest.NewRecorder()
+		s.backupHandler(w, httptest.NewRequest("GET", "/api/backup"+query, nil))
+		if w.Code != want {
+			t.Errorf("Backup%v of encrypted DB: want %v, got %v", query, want, w.Code)
+		}
+	}
+}
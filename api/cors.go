@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// how long browsers may cache the result of a preflight request
+const corsMaxAge = 10 * time.Minute
+
+// headers of responses scripts of other origins may read
+var corsExposedHeaders = []string{"X-Total-Count", "X-Session-Token", "X-Second-Factor", "Retry-After"}
+
+// corsConfig decides which other origins may use the API from a browser.
+// Without allowed origins only pages served by the server itself can.
+type corsConfig struct {
+	origins     map[string]bool
+	anyOrigin   bool
+	methods     []string
+	headers     map[string]bool
+	credentials bool
+	// routes of the API, for the methods a path accepts
+	routes *mux.Router
+}
+
+// newCORSConfig parses comma separated lists of origins, methods and request headers,
+// origin * allows every origin
+func newCORSConfig(origins, methods, headers string, credentials bool, routes *mux.Router) (*corsConfig, error) {
+	c := &corsConfig{
+		origins:     make(map[string]bool),
+		headers:     make(map[string]bool),
+		credentials: credentials,
+		routes:      routes,
+	}
+	for _, origin := range splitList(origins) {
+		if origin == "*" {
+			c.anyOrigin = true
+			continue
+		}
+		if !strings.HasPrefix(origin, "http://") && !strings.HasPrefix(origin, "https://") {
+			return nil, fmt.Errorf("invalid CORS origin %q, want scheme://host[:port]", origin)
+		}
+		c.origins[strings.TrimSuffix(origin, "/")] = true
+	}
+	if c.anyOrigin && credentials {
+		return nil, fmt.Errorf("CORS credentials can't be allowed for every origin")
+	}
+	for _, method := range splitList(methods) {
+		c.methods = append(c.methods, strings.ToUpper(method))
+	}
+	for _, header := range splitList(headers) {
+		c.headers[http.CanonicalHeaderKey(header)] = true
+	}
+	return c, nil
+}
+
+func splitList(list string) []string {
+	var result []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+func (c *corsConfig) allowedOrigin(origin string) bool {
+	return c.anyOrigin || c.origins[origin]
+}
+
+// routeMethods returns the configured methods the route of the request accepts
+func (c *corsConfig) routeMethods(r *http.Request) []string {
+	var methods []string
+	for _, method := range c.methods {
+		req := *r
+		req.Method = method
+		var match mux.RouteMatch
+		if c.routes.Match(&req, &match) && match.MatchErr == nil {
+			methods = append(methods, method)
+		}
+	}
+	return methods
+}
+
+// middleware answers preflight requests and adds the CORS headers for allowed
+// origins. Requests of other origins are passed on without them, so browsers
+// don't let the calling page read the response.
+func (c *corsConfig) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		preflight := r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != ""
+		if !c.allowedOrigin(origin) {
+			if preflight {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		if preflight {
+			c.preflight(w, r, origin)
+			return
+		}
+		c.allowOrigin(w, origin)
+		w.Header().Set("Access-Control-Expose-Headers", strings.Join(corsExposedHeaders, ", "))
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (c *corsConfig) allowOrigin(w http.ResponseWriter, origin string) {
+	if c.anyOrigin {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	} else {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+	}
+	if c.credentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// preflight allows the method and headers of a request the browser is about to
+// make if the route accepts the method
+func (c *corsConfig) preflight(w http.ResponseWriter, r *http.Request, origin string) {
+	w.Header().Add("Vary", "Access-Control-Request-Method")
+	w.Header().Add("Vary", "Access-Control-Request-Headers")
+	methods := c.routeMethods(r)
+	method := strings.ToUpper(r.Header.Get("Access-Control-Request-Method"))
+	allowed := false
+	for _, m := range methods {
+		allowed = allowed || m == method
+	}
+	if !allowed {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var headers []string
+	for _, header := range splitList(r.Header.Get("Access-Control-Request-Headers")) {
+		header = http.CanonicalHeaderKey(header)
+		if !c.headers[header] {
+			http.Error(w, fmt.Sprintf("Header %v not allowed", header), http.StatusForbidden)
+			return
+		}
+		headers = append(headers, header)
+	}
+	c.allowOrigin(w, origin)
+	w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+	if len(headers) > 0 {
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+	}
+	w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(corsMaxAge.Seconds())))
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// corsHandler serves a few API routes like the server does, behind the CORS
+// middleware of the given origins
+func corsHandler(t *testing.T, origins string) http.Handler {
+	router := mux.NewRouter()
+	apiRouter := router.PathPrefix("/api").Subrouter()
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	apiRouter.HandleFunc("/documents", ok).Methods("POST")
+	apiRouter.HandleFunc("/documents", ok)
+	apiRouter.HandleFunc("/documents/{key:[0-9]+}", ok).Methods("PATCH")
+	apiRouter.HandleFunc("/backup", ok).Methods("GET")
+	c, err := newCORSConfig(origins, "GET, POST, PATCH, DELETE", "X-Session-Token, Content-Type", false, apiRouter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c.middleware(router)
+}
+
+func preflight(h http.Handler, origin, path, method, headers string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("OPTIONS", path, nil)
+	r.Header.Set("Origin", origin)
+	r.Header.Set("Access-Control-Request-Method", method)
+	if headers != "" {
+		r.Header.Set("Access-Control-Request-Headers", headers)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestCORSPreflight(t *testing.T) {
+	h := corsHandler(t, "https://app.example")
+
+	w := preflight(h, "https://app.example", "/api/backup", "GET", "X-Session-Token")
+	if w.Code != http.StatusNoContent || w.Header().Get("Access-Control-Allow-Origin") != "https://app.example" {
+		t.Errorf("Allowed preflight answered %v %v", w.Code, w.Header())
+	}
+	if methods := w.Header().Get("Access-Control-Allow-Methods"); methods != "GET" {
+		t.Errorf("Want only the methods of the route, got %q", methods)
+	}
+	if headers := w.Header().Get("Access-Control-Allow-Headers"); headers != "X-Session-Token" {
+		t.Errorf("Want the requested header allowed, got %q", headers)
+	}
+	w = preflight(h, "https://app.example", "/api/documents", "POST", "content-type")
+	if w.Code != http.StatusNoContent || w.Header().Get("Access-Control-Allow-Methods") != "GET, POST, PATCH, DELETE" {
+		t.Errorf("Want all methods for a route accepting any, got %v %q", w.Code, w.Header().Get("Access-Control-Allow-Methods"))
+	}
+
+	if w = preflight(h, "https://evil.example", "/api/backup", "GET", ""); w.Code != http.StatusForbidden {
+		t.Errorf("Want 403 for a disallowed origin, got %v", w.Code)
+	}
+	if w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Error("Disallowed origin got CORS headers")
+	}
+	for _, path := range []string{"/api/backup", "/api/documents/1", "/api/unknown"} {
+		if w = preflight(h, "https://app.example", path, "DELETE", ""); w.Code != http.StatusMethodNotAllowed {
+			t.Errorf("Want 405 for a method %v doesn't accept, got %v", path, w.Code)
+		}
+	}
+	if w = preflight(h, "https://app.example", "/api/backup", "GET", "X-Session-Token, X-Custom"); w.Code != http.StatusForbidden {
+		t.Errorf("Want 403 for a disallowed header, got %v", w.Code)
+	}
+	if w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Error("Preflight with a disallowed header got CORS headers")
+	}
+}
+
+func TestCORSSameOriginDefault(t *testing.T) {
+	h := corsHandler(t, "")
+
+	if w := preflight(h, "https://app.example", "/api/backup", "GET", ""); w.Code != http.StatusForbidden {
+		t.Errorf("Want 403 for preflights by default, got %v", w.Code)
+	}
+	r := httptest.NewRequest("GET", "/api/backup", nil)
+	r.Header.Set("Origin", "https://app.example")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("Cross-origin request answered %v with %v", w.Code, w.Header())
+	}
+	r = httptest.NewRequest("GET", "/api/backup", nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Header().Get("Vary") != "" {
+		t.Errorf("Same-origin request answered %v with %v", w.Code, w.Header())
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/reusing-code/dochan/db"
+	"github.com/reusing-code/dochan/users"
+)
+
+// date layout of document dates, RFC 3339 timestamps are accepted as well
+const documentDateLayout = "2006-01-02"
+
+var (
+	errDeleted   = errors.New("document is in the trash")
+	errNotShared = errors.New("only private documents can be shared")
+)
+
+// Metadata changed by a PATCH request, missing fields are left unchanged.
+// An empty document date clears it. Only admins change the owner, an empty
+// owner makes the document visible to all users. Private documents are shared
+// by their owner.
+type PatchRequest struct {
+	Title         *string   `json:"title"`
+	Tags          *[]string `json:"tags"`
+	DocumentDate  *string   `json:"documentDate"`
+	Correspondent *string   `json:"correspondent"`
+	Notes         *string   `json:"notes"`
+	Owner         *string   `json:"owner"`
+	SharedWith    *[]string `json:"sharedWith"`
+}
+
+type TrashDocument struct {
+	ID       uint64    `json:"id"`
+	Filename string    `json:"filename"`
+	Title    string    `json:"title"`
+	Deleted  time.Time `json:"deleted"`
+}
+
+// getDocument returns a stored document unless it is in the trash
+func (s *server) getDocument(key uint64) (*db.DBFile, error) {
+	f, err := s.db.GetFile(key)
+	if err != nil {
+		return nil, err
+	}
+	if !f.Deleted.IsZero() {
+		return nil, errDeleted
+	}
+	return f, nil
+}
+
+func responseDocument(key uint64, f *db.DBFile) *ResponseDocument {
+	doc := &ResponseDocument{ID: key, Filename: f.Name, Type: f.Type, Tags: f.Tags, DuplicateOf: f.DuplicateOf,
+		Title: f.Title, Correspondent: f.Correspondent, Notes: f.Notes, Owner: f.Owner, SharedWith: f.SharedWith}
+	if !f.DocumentDate.IsZero() {
+		doc.DocumentDate = &f.DocumentDate
+	}
+	return doc
+}
+
+func parseDocumentDate(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	date, err := time.Parse(documentDateLayout, value)
+	if err == nil {
+		return date, nil
+	}
+	date, err = time.Parse(time.RFC3339, value)
+	if err != nil {
+		return date, fmt.Errorf("Invalid document date %q", value)
+	}
+	return date, nil
+}
+
+func (s *server) patchHandler(w http.ResponseWriter, r *http.Request) {
+	key, err := documentKey(r)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	buf, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var req PatchRequest
+	err = json.Unmarshal(buf, &req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var date time.Time
+	if req.DocumentDate != nil {
+		date, err = parseDocumentDate(*req.DocumentDate)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	user := requestUser(r)
+	if req.Owner != nil && user.Role != users.Admin {
+		http.Error(w, "Only admins change the owner", http.StatusForbidden)
+		return
+	}
+	var names []string
+	if req.Owner != nil && *req.Owner != "" {
+		names = append(names, *req.Owner)
+	}
+	if req.SharedWith != nil {
+		names = append(names, *req.SharedWith...)
+	}
+	for _, name := range names {
+		if _, err := s.users.Get(name); err != nil {
+			http.Error(w, fmt.Sprintf("Unknown user %q", name), http.StatusBadRequest)
+			return
+		}
+	}
+
+	s.ingestMtx.Lock()
+	defer s.ingestMtx.Unlock()
+	err = s.db.UpdateFile(key, func(f *db.DBFile) error {
+		if !f.Deleted.IsZero() {
+			return errDeleted
+		}
+		if req.Title != nil {
+			f.Title = *req.Title
+		}
+		if req.Tags != nil {
+			f.Tags = *req.Tags
+		}
+		if req.DocumentDate != nil {
+			f.DocumentDate = date
+		}
+		if req.Correspondent != nil {
+			f.Correspondent = *req.Correspondent
+		}
+		if req.Notes != nil {
+			f.Notes = *req.Notes
+		}
+		if req.Owner != nil {
+			f.Owner = *req.Owner
+		}
+		if req.SharedWith != nil {
+			if f.Owner == "" && len(*req.SharedWith) > 0 {
+				return errNotShared
+			}
+			f.SharedWith = *req.SharedWith
+		}
+		return nil
+	})
+	if err == errNotShared {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err == db.ErrNotFound || err == errDeleted {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = s.applyJournal()
+	if err != nil {
+		log.Printf("Error updating search index: %v", err)
+	}
+	f, err := s.db.GetFile(key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if req.Tags != nil {
+		// tags set by the user are confirmed labels
+		err = s.classifier.Train(key, f.Type, f.Tags, f.Content)
+		if err != nil {
+			log.Printf("Error training classifier with document %v: %v", key, err)
+		}
+	}
+	writeJSON(w, http.StatusOK, responseDocument(key, f))
+}
+
+// deleteHandler moves a document to the trash, or purges it for good if the
+// query parameter purge is set. Purged documents are not imported again from
+// the document storage path, their source files are left untouched.
+func (s *server) deleteHandler(w http.ResponseWriter, r *http.Request) {
+	key, err := documentKey(r)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	s.ingestMtx.Lock()
+	defer s.ingestMtx.Unlock()
+	if _, err = s.db.GetFile(key); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if r.URL.Query().Get("purge") == "true" {
+		err = s.purgeDocument(key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Purged document %v", key)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	err = s.db.UpdateFile(key, func(f *db.DBFile) error {
+		if f.Deleted.IsZero() {
+			f.Deleted = time.Now()
+		}
+		return nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// the hash stays known, so the source is not imported again
+	s.similar.Remove(key)
+	err = s.applyJournal()
+	if err != nil {
+		log.Printf("Error updating search index: %v", err)
+	}
+	log.Printf("Moved document %v to the trash", key)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *server) restoreHandler(w http.ResponseWriter, r *http.Request) {
+	key, err := documentKey(r)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	s.ingestMtx.Lock()
+	defer s.ingestMtx.Unlock()
+	err = s.db.UpdateFile(key, func(f *db.DBFile) error {
+		f.Deleted = time.Time{}
+		return nil
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	err = s.reindex(key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	f, err := s.db.GetFile(key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, responseDocument(key, f))
+}
+
+// trashedDocuments returns the documents in the trash accepted by filter
+func (s *server) trashedDocuments(filter func(f *db.DBFile) bool) ([]TrashDocument, error) {
+	docs := []TrashDocument{}
+	err := s.db.GetAllFiles(func(key uint64, file db.DBFile) {
+		if !file.Deleted.IsZero() && filter(&file) {
+			docs = append(docs, TrashDocument{ID: key, Filename: file.Name, Title: file.Title, Deleted: file.Deleted})
+		}
+	})
+	sort.Slice(docs, func(i, j int) bool { return docs[i].Deleted.After(docs[j].Deleted) })
+	return docs, err
+}
+
+func (s *server) trashHandler(w http.ResponseWriter, r *http.Request) {
+	user := requestUser(r)
+	docs, err := s.trashedDocuments(func(f *db.DBFile) bool {
+		return user.CanRead(f.Owner, f.SharedWith)
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, docs)
+}
+
+// emptyTrashHandler purges all documents in the trash the user may change
+func (s *server) emptyTrashHandler(w http.ResponseWriter, r *http.Request) {
+	s.ingestMtx.Lock()
+	defer s.ingestMtx.Unlock()
+	user := requestUser(r)
+	docs, err := s.trashedDocuments(func(f *db.DBFile) bool {
+		return user.CanWrite(f.Owner)
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, doc := range docs {
+		err = s.purgeDocument(doc.ID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	log.Printf("Purged %v documents from the trash", len(docs))
+	writeJSON(w, http.StatusOK, map[string]int{"purged": len(docs)})
+}
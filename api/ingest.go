@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/reusing-code/dochan/db"
+	"github.com/reusing-code/dochan/jobs"
+	"github.com/reusing-code/dochan/parser"
+)
+
+var documentExtensions = []string{"pdf"}
+
+// isDocument reports whether a file is handled by the parser at all
+func isDocument(path string) bool {
+	return !parser.ExtensionFilter(documentExtensions, parser.NoSkip)(parser.File{Filename: path})
+}
+
+// kinds of jobs and failures
+const (
+	scanJob  = "scan"
+	retryJob = "retry"
+	// files changed while the server runs
+	watchKind = "watch"
+)
+
+// stage of failures adding a parsed file to the DB and indexes
+const stageStore = "store"
+
+// scanDir queues all new documents of the document storage path for
+// ingestion, unless they are queued already. Files which aren't in the scan
+// cache are queued without reading them, ingestItem hashes them.
+func (s *server) scanDir() (*jobs.Job, error) {
+	pending, err := s.jobs.Pending()
+	if err != nil {
+		return nil, err
+	}
+	files, err := parser.ListFiles(s.dir, parser.Options{
+		Extensions: documentExtensions,
+		Skip: func(f parser.File) bool {
+			return pending[f.Filename] || (f.Hash != "" && s.db.Contains(s.ownerOf(f.Filename), f.Hash))
+		},
+		Cache:     s.scanCache,
+		HashLater: true,
+	}, func(perr *parser.Error) {
+		s.recordFailure(scanJob, perr.Path, perr)
+	})
+	// only a complete scan shows which cached files were deleted
+	flushErr := s.scanCache.Flush(err == nil)
+	if err == nil {
+		err = flushErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]string, len(files))
+	for i, f := range files {
+		paths[i] = f.Filename
+	}
+	return s.jobs.Add(scanJob, paths)
+}
+
+// queueScan scans the document storage path in the background
+func (s *server) queueScan() {
+	go func() {
+		job, err := s.scanDir()
+		if err != nil {
+			log.Printf("Error scanning %v: %v", s.dir, err)
+			return
+		}
+		log.Printf("Queued %v new files", job.Total)
+	}()
+}
+
+// ingestItem parses and stores a file queued by scanDir
+func (s *server) ingestItem(ctx context.Context, job *jobs.Job, path string) error {
+	return s.ingestPath(ctx, path)
+}
+
+// ingestPath parses and stores a file, files removed in the meantime are
+// skipped. The file is read once, its hash is cached for the next scan and
+// known content isn't parsed again. The ingest lock isn't held while parsing.
+func (s *server) ingestPath(ctx context.Context, path string) error {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	f, rawData, err := parser.ReadFile(path)
+	if err != nil {
+		return itemError(err)
+	}
+	if info != nil {
+		s.scanCache.Put(path, info.Size(), info.ModTime(), f.Hash)
+	}
+	known, err := s.storeKnown(path, f, rawData)
+	if known || err != nil {
+		return err
+	}
+	content, err := parser.ParseText(ctx, f, s.parseTimeout)
+	if err != nil {
+		return itemError(err)
+	}
+	s.ingestMtx.Lock()
+	defer s.ingestMtx.Unlock()
+	err = s.storeFile(path, f, content, rawData)
+	if err != nil {
+		return &jobs.ItemError{Stage: stageStore, Hash: f.Hash, Err: err}
+	}
+	return nil
+}
+
+// storeKnown passes a file with known content to storeFile, which only
+// updates the path of a moved document. It reports whether the content was known.
+func (s *server) storeKnown(path string, f parser.File, rawData []byte) (bool, error) {
+	s.ingestMtx.Lock()
+	defer s.ingestMtx.Unlock()
+	if !s.db.Contains(s.ownerOf(path), f.Hash) {
+		return false, nil
+	}
+	err := s.storeFile(path, f, nil, rawData)
+	if err != nil {
+		return true, &jobs.ItemError{Stage: stageStore, Hash: f.Hash, Err: err}
+	}
+	return true, nil
+}
+
+// itemError keeps the stage and hash of parser errors in the failures of jobs
+func itemError(err error) error {
+	if perr, ok := err.(*parser.Error); ok {
+		return &jobs.ItemError{Stage: perr.Stage, Hash: perr.Hash, Err: perr.Err}
+	}
+	return err
+}
+
+// recordFailure keeps a failure to ingest a file outside of a job
+func (s *server) recordFailure(kind, path string, err error) {
+	f := &jobs.Failure{Path: path, Error: err.Error(), Attempts: 1, Kind: kind}
+	if ierr, ok := itemError(err).(*jobs.ItemError); ok {
+		f.Stage, f.Hash, f.Error = ierr.Stage, ierr.Hash, ierr.Err.Error()
+	}
+	err = s.jobs.RecordFailure(f)
+	if err != nil {
+		log.Printf("Error recording failure of %v: %v", path, err)
+	}
+}
+
+// addDocument stores a parsed file and adds it to all indexes. Files in a
+// private folder belong to its user.
+func (s *server) addDocument(f parser.File, content []string, rawData []byte) (uint64, error) {
+	key, err := s.db.ImportFile(db.DBFile{Name: filepath.Base(f.Filename), Path: f.Filename, Hash: f.Hash,
+		Content: content, ImportDate: time.Now(), Owner: s.ownerOf(f.Filename)}, rawData)
+	if err != nil {
+		return 0, err
+	}
+	err = s.classifier.StoreSuggestion(key, s.classifier.Suggest(content))
+	if err != nil {
+		log.Printf("Error storing suggestion for %v: %v", f.Filename, err)
+	}
+	err = s.indexSignature(key, content, true)
+	if err != nil {
+		log.Printf("Error checking %v for duplicates: %v", f.Filename, err)
+	}
+	return key, s.applyJournal()
+}
+
+// reindex updates all indexes after a document was changed
+func (s *server) reindex(key uint64) error {
+	err := s.applyJournal()
+	if err != nil {
+		return err
+	}
+	file, err := s.db.GetFile(key)
+	if err != nil {
+		return err
+	}
+	if file.Deleted.IsZero() {
+		err = s.indexSignature(key, file.Content, false)
+		if err != nil {
+			return err
+		}
+	}
+	if s.classifier.IsTrained(key) {
+		return s.classifier.Train(key, file.Type, file.Tags, file.Content)
+	}
+	return s.classifier.StoreSuggestion(key, s.classifier.Suggest(file.Content))
+}
+
+// removeDocument deletes a document and removes it from all indexes
+func (s *server) removeDocument(key uint64) error {
+	err := s.db.DeleteFile(key)
+	if err != nil {
+		return err
+	}
+	s.similar.Remove(key)
+	err = s.classifier.Forget(key)
+	if err != nil {
+		return err
+	}
+	return s.applyJournal()
+}
+
+// purgeDocument deletes a document for good, its source is not imported again
+func (s *server) purgeDocument(key uint64) error {
+	err := s.db.PurgeFile(key)
+	if err != nil {
+		return err
+	}
+	s.similar.Remove(key)
+	err = s.classifier.Forget(key)
+	if err != nil {
+		return err
+	}
+	return s.applyJournal()
+}
+
+// applyJournal updates the search index with the changes committed to the DB
+// since it was last called
+func (s *server) applyJournal() error {
+	s.journalMtx.Lock()
+	defer s.journalMtx.Unlock()
+	entries, err := s.db.Journal(s.journalSeq)
+	if err != nil || len(entries) == 0 {
+		return err
+	}
+	// only the latest change of each document matters
+	latest := make(map[uint64]db.JournalOp)
+	var keys []uint64
+	for _, e := range entries {
+		if _, ok := latest[e.Key]; !ok {
+			keys = append(keys, e.Key)
+		}
+		latest[e.Key] = e.Op
+	}
+	for _, key := range keys {
+		s.removeFromSearch(key)
+		if latest[key] != db.JournalUpdate {
+			continue
+		}
+		file, err := s.db.GetFile(key)
+		if err != nil {
+			return err
+		}
+		s.addToSearch(key, file)
+	}
+	s.journalSeq = entries[len(entries)-1].Seq
+	return s.db.TrimJournal(s.journalSeq)
+}
+
+// addToSearch indexes the content and metadata of a document, documents in
+// the trash are skipped
+func (s *server) addToSearch(key uint64, file *db.DBFile) {
+	if !file.Deleted.IsZero() {
+		return
+	}
+	cont := ""
+	if len(file.Content) > 0 {
+		cont = file.Content[0]
+	}
+	doc := Document{ID: key, Filename: file.Name, Title: file.Title, Content: cont, Owner: file.Owner, SharedWith: file.SharedWith}
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	err := enc.Encode(doc)
+	if err != nil {
+		log.Printf("Error encoding file %v", file.Path)
+		return
+	}
+	content := file.Content
+	for _, meta := range []string{file.Title, file.Correspondent, file.Notes} {
+		if meta != "" {
+			content = append(content[:len(content):len(content)], meta)
+		}
+	}
+	s.search.AddContent(content, buf.String())
+	s.indexMtx.Lock()
+	s.searchKeys[key] = buf.String()
+	s.indexMtx.Unlock()
+}
+
+func (s *server) removeFromSearch(key uint64) {
+	s.indexMtx.Lock()
+	result, ok := s.searchKeys[key]
+	delete(s.searchKeys, key)
+	s.indexMtx.Unlock()
+	if ok {
+		s.search.Remove(result)
+	}
+}
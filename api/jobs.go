@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/reusing-code/dochan/jobs"
+)
+
+// jobsHandler lists the background jobs with their progress, the latest first
+func (s *server) jobsHandler(w http.ResponseWriter, r *http.Request) {
+	list, err := s.jobs.Jobs()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (s *server) jobHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	job, err := s.jobs.Get(id)
+	if err == jobs.ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+type RetryRequest struct {
+	// all failures the user may change if empty
+	Paths []string `json:"paths"`
+}
+
+// visibleFailures returns the failed files of documents the user may see,
+// or change if write is set
+func (s *server) visibleFailures(r *http.Request, write bool) ([]jobs.Failure, error) {
+	list, err := s.jobs.Failures()
+	if err != nil {
+		return nil, err
+	}
+	user := requestUser(r)
+	visible := []jobs.Failure{}
+	for _, f := range list {
+		owner := s.ownerOf(f.Path)
+		if (write && user.CanWrite(owner)) || (!write && user.CanRead(owner, nil)) {
+			visible = append(visible, f)
+		}
+	}
+	return visible, nil
+}
+
+// failuresHandler lists the files which failed to be ingested
+func (s *server) failuresHandler(w http.ResponseWriter, r *http.Request) {
+	list, err := s.visibleFailures(r, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// retryFailuresHandler queues failed files again, e.g. after fixing them or
+// the parser. Failures are kept until the files are ingested successfully.
+func (s *server) retryFailuresHandler(w http.ResponseWriter, r *http.Request) {
+	var req RetryRequest
+	if r.ContentLength != 0 && !readJSON(w, r, &req) {
+		return
+	}
+	list, err := s.visibleFailures(r, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	wanted := make(map[string]bool)
+	for _, path := range req.Paths {
+		wanted[path] = true
+	}
+	var paths []string
+	for _, f := range list {
+		if len(wanted) == 0 || wanted[f.Path] {
+			paths = append(paths, f.Path)
+		}
+	}
+	job, err := s.jobs.Retry(retryJob, paths)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, job)
+}
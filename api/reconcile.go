@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/reusing-code/dochan/reconcile"
+)
+
+// reconcileHandler updates moved documents and reports missing ones on POST,
+// GET only reports what would change
+func (s *server) reconcileHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	opts := reconcile.Options{
+		Dir:        s.dir,
+		Extensions: documentExtensions,
+		Cache:      s.scanCache,
+		Tombstone:  query.Get("tombstone") == "true",
+		DryRun:     r.Method != "POST" || query.Get("dryRun") == "true",
+	}
+
+	s.ingestMtx.Lock()
+	report, err := reconcile.Run(s.db, opts)
+	if err == nil {
+		// the filename of moved documents is part of the search result
+		err = s.applyJournal()
+	}
+	s.ingestMtx.Unlock()
+	if cacheErr := s.scanCache.Flush(false); cacheErr != nil {
+		log.Printf("Error saving scan cache: %v", cacheErr)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Reconciled %v documents: %v moved, %v orphans", report.Checked, len(report.Moved), len(report.Orphans))
+
+	js, err := json.Marshal(report)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
@@ -1,65 +1,266 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"log"
+	"math"
+	"net"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	bolt "github.com/coreos/bbolt"
+	"github.com/gorilla/mux"
+	"github.com/reusing-code/dochan/throttle"
+	"github.com/reusing-code/dochan/users"
 )
 
 type SessionDB struct {
 	secret string
 	Handle *bolt.DB
+	users  *users.Store
+	// sessions expire if unused for idleTTL or after maxAge, 0 disables either
+	idleTTL time.Duration
+	maxAge  time.Duration
+	done    chan struct{}
+	// failed logins are delayed per client address, accounts are locked
+	// after too many and all login attempts are rate limited
+	clients *throttle.Backoff
+	lockout *throttle.Backoff
+	logins  *throttle.Limiter
+	audit   *log.Logger
+}
+
+// Session is stored under the SHA-256 hash of its token, the hex encoded hash
+// identifies it in the API
+type Session struct {
+	ID         string    `json:"id"`
+	User       string    `json:"user"`
+	Created    time.Time `json:"created"`
+	LastUsed   time.Time `json:"lastUsed"`
+	UserAgent  string    `json:"userAgent"`
+	RemoteAddr string    `json:"remoteAddr"`
+	// set in responses for the session of the request
+	Current bool `json:"current"`
 }
 
 const (
 	sessionBucket = "session"
 	sessionBytes  = 64
+	// user created from --secret if there are no users, clients sending only
+	// a password log in as this user
+	defaultUser = "admin"
+	// the last use is written at most this often, not on every request
+	sessionRenewInterval = time.Minute
+	sessionSweepInterval = 10 * time.Minute
+
+	// failed logins of a client address before further attempts are delayed
+	loginFreeAttempts = 5
+	loginBaseDelay    = time.Second
+	loginMaxDelay     = 5 * time.Minute
+	// failed logins of a user before the account is locked
+	lockoutFailures = 10
+	lockoutDuration = 15 * time.Minute
+	// login attempts per second of all clients together
+	loginRate  = 5
+	loginBurst = 20
+	// size limit of login requests
+	maxLoginSize = 4 << 10
+)
+
+type LoginRequest struct {
+	User     string `json:"user"`
+	Password string `json:"password"`
+	// TOTP or recovery code, for users with a second factor
+	Code string `json:"code"`
+}
+
+type contextKey int
+
+const (
+	userContextKey contextKey = iota
+	sessionContextKey
 )
 
-func NewSessionHandler(path string, secret string) (*SessionDB, error) {
-	result := &SessionDB{secret: secret}
+// NewSessionHandler opens the session DB at path, authentication events are
+// written to audit
+func NewSessionHandler(path string, secret string, idleTTL, maxAge time.Duration, audit *log.Logger) (*SessionDB, error) {
+	result := &SessionDB{
+		secret:  secret,
+		idleTTL: idleTTL,
+		maxAge:  maxAge,
+		done:    make(chan struct{}),
+		clients: throttle.NewBackoff(loginFreeAttempts, loginBaseDelay, loginMaxDelay),
+		lockout: throttle.NewBackoff(lockoutFailures-1, lockoutDuration, lockoutDuration),
+		logins:  throttle.NewLimiter(loginRate, loginBurst),
+		audit:   audit,
+	}
 	var err error
 	result.Handle, err = bolt.Open(path, 0644, nil)
 	if err != nil {
 		return nil, err
 	}
 	err = result.Handle.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte(sessionBucket))
-		if err != nil {
-			return fmt.Errorf("create bucket %q: %q", sessionBucket, err)
+		for _, name := range []string{sessionBucket, tokenBucket} {
+			_, err := tx.CreateBucketIfNotExists([]byte(name))
+			if err != nil {
+				return fmt.Errorf("create bucket %q: %q", name, err)
+			}
 		}
 		return nil
 	})
 	if err != nil {
 		return nil, err
 	}
+	result.users, err = users.New(result.Handle)
+	if err != nil {
+		return nil, err
+	}
+	err = result.createDefaultUser()
+	if err != nil {
+		return nil, err
+	}
+	go result.sweep()
 	return result, nil
 }
 
+// createDefaultUser adds an admin with the shared secret as password to a DB
+// without users, so existing setups keep working
+func (db *SessionDB) createDefaultUser() error {
+	count, err := db.users.Count()
+	if err != nil || count > 0 {
+		return err
+	}
+	if db.secret == "" {
+		log.Printf("No users, add one with the console command adduser or set --secret")
+		return nil
+	}
+	_, err = db.users.Add(defaultUser, db.secret, users.Admin)
+	if err != nil {
+		return err
+	}
+	log.Printf("Created user %q with the secret as password", defaultUser)
+	return nil
+}
+
 func (db *SessionDB) Close() error {
 	if db != nil && db.Handle != nil {
+		close(db.done)
 		return db.Handle.Close()
 	}
 	return errors.New("No DB")
 }
 
+// sessionCreateHandler logs in with a LoginRequest, a body that isn't JSON is
+// taken as the password of the default user
 func (db *SessionDB) sessionCreateHandler(w http.ResponseWriter, r *http.Request) {
-	buf, err := ioutil.ReadAll(r.Body)
-	secret := string(buf)
-	if err == nil && secret == db.secret {
-		session, err := db.CreateSession()
-		if err != nil {
-			http.Error(w, "Error creating session", http.StatusInternalServerError)
-		}
-		w.Header().Add("X-Session-Token", session)
-		w.Write([]byte("{}"))
-	} else {
+	buf, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxLoginSize))
+	if err != nil {
 		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		return
+	}
+	var req LoginRequest
+	if json.Unmarshal(buf, &req) != nil {
+		req = LoginRequest{User: defaultUser, Password: string(buf)}
+	}
+	user, err := db.authenticate(w, r, req.User, req.Password, true, req.Code)
+	if err != nil {
+		return
+	}
+	session, err := db.CreateSession(user.Name, r)
+	if err != nil {
+		http.Error(w, "Error creating session", http.StatusInternalServerError)
+		return
+	}
+	db.auditf(r, "user %q logged in", user.Name)
+	w.Header().Add("X-Session-Token", session)
+	writeJSON(w, http.StatusOK, user)
+}
+
+// authenticate checks the password of a user unless the client or user made
+// too many failed attempts, and with secondFactor the code of users with TOTP
+// enabled. On failure the response is written.
+func (db *SessionDB) authenticate(w http.ResponseWriter, r *http.Request, name, password string, secondFactor bool, code string) (*users.User, error) {
+	ip := clientIP(r)
+	wait := db.clients.Wait(ip)
+	if locked := db.lockout.Wait(name); locked > wait {
+		wait = locked
+	}
+	if wait > 0 {
+		db.auditf(r, "login of %q rejected, retry in %v", name, wait.Round(time.Second))
+		tooManyAttempts(w, wait)
+		return nil, errInvalidSession
+	}
+	if !db.logins.Allow() {
+		db.auditf(r, "login of %q rejected, too many attempts of all clients", name)
+		tooManyAttempts(w, time.Second)
+		return nil, errInvalidSession
+	}
+	user, err := db.users.Authenticate(name, password)
+	if secondFactor && err == nil {
+		err = db.verifySecondFactor(user, code)
+	} else if secondFactor && code == "" && err == users.ErrInvalidCredentials {
+		// a missing code is answered the same whether or not the password
+		// matched, so the answer doesn't tell that the password is correct
+		if u, getErr := db.users.Get(name); getErr == nil && u.TOTPEnabled {
+			err = errSecondFactorRequired
+		}
+	}
+	if err == users.ErrInvalidCredentials || err == users.ErrInvalidCode || err == errSecondFactorRequired {
+		db.clients.Fail(ip)
+		failures := db.lockout.Fail(name)
+		db.auditf(r, "login of %q failed, %v (%d consecutive failures)", name, err, failures)
+		if failures == lockoutFailures {
+			db.auditf(r, "user %q locked for %v", name, lockoutDuration)
+		}
+		if err == errSecondFactorRequired {
+			w.Header().Set("X-Second-Factor", "totp")
+			http.Error(w, "Second factor required", http.StatusUnauthorized)
+		} else {
+			http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		}
+		return nil, err
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, err
+	}
+	db.clients.Reset(ip)
+	db.lockout.Reset(name)
+	return user, nil
+}
+
+func tooManyAttempts(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, "Too many failed attempts", http.StatusTooManyRequests)
+}
+
+// clientIP returns the address of the client without port. Headers set by
+// proxies are ignored, they can be forged by clients connecting directly.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// auditf writes an authentication event with the client address to the audit log
+func (db *SessionDB) auditf(r *http.Request, format string, v ...interface{}) {
+	if db.audit != nil {
+		db.audit.Printf("%s: %s", clientIP(r), fmt.Sprintf(format, v...))
 	}
 }
 
@@ -70,71 +271,340 @@ func (db *SessionDB) authenticationMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
-		session := r.Header.Get("X-Session-Token")
-		if session == "" || !db.GetSession(session) {
+		ctx := r.Context()
+		var name string
+		if secret := bearerToken(r); secret != "" {
+			token, err := db.GetToken(secret)
+			if err != nil {
+				http.Error(w, "Invalid token", http.StatusUnauthorized)
+				return
+			}
+			if !token.allows(r) {
+				http.Error(w, "Not in scope of the token", http.StatusForbidden)
+				return
+			}
+			name = token.User
+		} else {
+			session, err := db.GetSession(r.Header.Get("X-Session-Token"))
+			if err != nil {
+				http.Error(w, "Invalid session", http.StatusUnauthorized)
+				return
+			}
+			name = session.User
+			ctx = context.WithValue(ctx, sessionContextKey, session)
+		}
+		// the user may have been deleted since logging in
+		user, err := db.users.Get(name)
+		if err != nil {
 			http.Error(w, "Invalid session", http.StatusUnauthorized)
 			return
-		} else {
-			next.ServeHTTP(w, r)
+		}
+		if user.Role == users.ReadOnly && !readOnlyAllowed(r) {
+			http.Error(w, "Read-only user", http.StatusForbidden)
 			return
 		}
-
+		if user.NeedsEnrollment() && !accountRequest(r) {
+			http.Error(w, "Second factor enrollment required", http.StatusForbidden)
+			return
+		}
+		ctx = context.WithValue(ctx, userContextKey, user)
+		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
-func (db *SessionDB) CreateSession() (string, error) {
-	key := make([]byte, sessionBytes)
-	_, err := rand.Read(key)
+// readOnlyAllowed reports whether read-only users may make the request, they
+// can still manage their own account, sessions and tokens
+func readOnlyAllowed(r *http.Request) bool {
+	return r.Method == "GET" || r.Method == "HEAD" || accountRequest(r) ||
+		strings.HasPrefix(r.URL.Path, "/api/tokens")
+}
+
+// accountRequest reports whether the request manages the account or sessions
+// of the user
+func accountRequest(r *http.Request) bool {
+	return r.URL.Path == "/api/user" || strings.HasPrefix(r.URL.Path, "/api/user/") ||
+		strings.HasPrefix(r.URL.Path, "/api/session")
+}
+
+// requestUser returns the user attached to the request by authenticationMiddleware
+func requestUser(r *http.Request) *users.User {
+	user, _ := r.Context().Value(userContextKey).(*users.User)
+	return user
+}
+
+// requestSession returns the session attached to the request by
+// authenticationMiddleware, nil for requests authenticated with an API token
+func requestSession(r *http.Request) *Session {
+	session, _ := r.Context().Value(sessionContextKey).(*Session)
+	return session
+}
+
+// adminOnly restricts a handler to admins
+func adminOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if user := requestUser(r); user == nil || user.Role != users.Admin {
+			http.Error(w, "Admin required", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// CreateSession returns the token of a new session of the named user, the
+// client of the request is recorded to tell sessions apart
+func (db *SessionDB) CreateSession(user string, r *http.Request) (string, error) {
+	token := make([]byte, sessionBytes)
+	_, err := rand.Read(token)
 	if err != nil {
 		return "", err
 	}
-
+	now := time.Now()
+	session := &Session{User: user, Created: now, LastUsed: now, UserAgent: r.UserAgent(), RemoteAddr: r.RemoteAddr}
+	key := sha256.Sum256(token)
 	err = db.Handle.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte(sessionBucket))
-		err := bucket.Put(key, []byte(""))
-		return err
+		return putSession(tx.Bucket([]byte(sessionBucket)), key[:], session)
 	})
 	if err != nil {
 		return "", err
 	}
+	return base64.URLEncoding.EncodeToString(token), nil
+}
+
+func sessionKey(baseKey string) ([]byte, error) {
+	token, err := base64.URLEncoding.DecodeString(baseKey)
+	if err != nil {
+		return nil, err
+	}
+	key := sha256.Sum256(token)
+	return key[:], nil
+}
+
+func putSession(bucket *bolt.Bucket, key []byte, session *Session) error {
+	buf := &bytes.Buffer{}
+	err := gob.NewEncoder(buf).Encode(session)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(key, buf.Bytes())
+}
+
+// decodeSession fails for sessions stored before they had timestamps
+func decodeSession(key, value []byte) (*Session, error) {
+	session := &Session{}
+	err := gob.NewDecoder(bytes.NewBuffer(value)).Decode(session)
+	if err != nil {
+		return nil, err
+	}
+	session.ID = hex.EncodeToString(key)
+	return session, nil
+}
 
-	baseEncoded := base64.URLEncoding.EncodeToString(key)
+func (db *SessionDB) expired(session *Session, now time.Time) bool {
+	return (db.idleTTL > 0 && now.Sub(session.LastUsed) > db.idleTTL) ||
+		(db.maxAge > 0 && now.Sub(session.Created) > db.maxAge)
+}
 
-	return baseEncoded, nil
+// renewAfter returns how old the last use has to be to be written again
+func (db *SessionDB) renewAfter() time.Duration {
+	if db.idleTTL > 0 && db.idleTTL/2 < sessionRenewInterval {
+		return db.idleTTL / 2
+	}
+	return sessionRenewInterval
 }
 
+var errInvalidSession = errors.New("invalid session")
+
 func (db *SessionDB) DestroySession(baseKey string) error {
-	key, err := base64.URLEncoding.DecodeString(baseKey)
+	key, err := sessionKey(baseKey)
 	if err != nil {
 		return err
 	}
-	err = db.Handle.Update(func(tx *bolt.Tx) error {
+	return db.revoke(hex.EncodeToString(key))
+}
+
+// revoke deletes the session with the given ID
+func (db *SessionDB) revoke(id string) error {
+	key, err := hex.DecodeString(id)
+	if err != nil {
+		return errInvalidSession
+	}
+	return db.Handle.Update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(sessionBucket))
+		if bucket.Get(key) == nil {
+			return errInvalidSession
+		}
 		return bucket.Delete(key)
 	})
+}
 
-	if err != nil {
+// GetSession returns a valid session. Its last use is updated, so it doesn't
+// expire while it is used.
+func (db *SessionDB) GetSession(baseKey string) (*Session, error) {
+	key, err := sessionKey(baseKey)
+	if err != nil || baseKey == "" {
+		return nil, errInvalidSession
+	}
+	var session *Session
+	err = db.Handle.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(sessionBucket)).Get(key)
+		if b == nil {
+			return errInvalidSession
+		}
+		session, err = decodeSession(key, b)
 		return err
+	})
+	now := time.Now()
+	if err != nil || db.expired(session, now) {
+		return nil, errInvalidSession
 	}
-	return nil
+	if now.Sub(session.LastUsed) > db.renewAfter() {
+		session.LastUsed = now
+		err = db.Handle.Update(func(tx *bolt.Tx) error {
+			bucket := tx.Bucket([]byte(sessionBucket))
+			// revoked in the meantime
+			if bucket.Get(key) == nil {
+				return errInvalidSession
+			}
+			return putSession(bucket, key, session)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return session, nil
 }
 
-func (db *SessionDB) GetSession(baseKey string) bool {
-	key, err := base64.URLEncoding.DecodeString(baseKey)
-	if err != nil {
-		return false
-	}
-	sessionFound := false
-	db.Handle.View(func(tx *bolt.Tx) error {
+// deleteSessions removes all sessions matching the filter, including ones
+// that can't be decoded, and returns their number
+func (db *SessionDB) deleteSessions(filter func(s *Session) bool) (int, error) {
+	count := 0
+	err := db.Handle.Update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(sessionBucket))
-		b := bucket.Get(key)
-		if b == nil {
+		var keys [][]byte
+		bucket.ForEach(func(k, v []byte) error {
+			session, err := decodeSession(k, v)
+			if err != nil || filter(session) {
+				keys = append(keys, append([]byte{}, k...))
+			}
 			return nil
+		})
+		for _, k := range keys {
+			err := bucket.Delete(k)
+			if err != nil {
+				return err
+			}
 		}
-		sessionFound = true
+		count = len(keys)
 		return nil
+	})
+	return count, err
+}
+
+// deleteExpired removes expired sessions and returns their number
+func (db *SessionDB) deleteExpired(now time.Time) (int, error) {
+	return db.deleteSessions(func(s *Session) bool {
+		return db.expired(s, now)
+	})
+}
+
+// sweep regularly deletes expired sessions until the DB is closed
+func (db *SessionDB) sweep() {
+	ticker := time.NewTicker(sessionSweepInterval)
+	defer ticker.Stop()
+	for {
+		count, err := db.deleteExpired(time.Now())
+		if err != nil {
+			log.Printf("Error deleting expired sessions: %v", err)
+		} else if count > 0 {
+			log.Printf("Deleted %v expired sessions", count)
+		}
+		select {
+		case <-db.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
 
+// sessions returns all valid sessions, of one user if user is set
+func (db *SessionDB) sessions(user string) ([]Session, error) {
+	list := []Session{}
+	now := time.Now()
+	err := db.Handle.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(sessionBucket)).ForEach(func(k, v []byte) error {
+			session, err := decodeSession(k, v)
+			if err != nil || db.expired(session, now) || (user != "" && session.User != user) {
+				return nil
+			}
+			list = append(list, *session)
+			return nil
+		})
 	})
+	sort.Slice(list, func(i, j int) bool { return list[i].LastUsed.After(list[j].LastUsed) })
+	return list, err
+}
 
-	return sessionFound
+// logoutHandler ends the session of the request
+func (db *SessionDB) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	err := db.revoke(requestSession(r).ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// sessionsHandler lists the active sessions of the user, admins get the
+// sessions of all users with query parameter all=true
+func (db *SessionDB) sessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := requestUser(r)
+	name := user.Name
+	if r.URL.Query().Get("all") == "true" {
+		if user.Role != users.Admin {
+			http.Error(w, "Admin required", http.StatusForbidden)
+			return
+		}
+		name = ""
+	}
+	list, err := db.sessions(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	current := requestSession(r).ID
+	for i := range list {
+		list[i].Current = list[i].ID == current
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// revokeSessionHandler ends a session of the user, admins may end any session
+func (db *SessionDB) revokeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	user := requestUser(r)
+	if user.Role != users.Admin {
+		list, err := db.sessions(user.Name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		found := false
+		for _, session := range list {
+			found = found || session.ID == id
+		}
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+	}
+	err := db.revoke(id)
+	if err == errInvalidSession {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
 }
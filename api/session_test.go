@@ -0,0 +1,183 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/gorilla/mux"
+	"github.com/reusing-code/dochan/users"
+)
+
+func openSessions(t *testing.T, idleTTL, maxAge time.Duration) *SessionDB {
+	db, err := NewSessionHandler("test.session.db", "", idleTTL, maxAge, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func login(t *testing.T, db *SessionDB, user string) string {
+	token, err := db.CreateSession(user, httptest.NewRequest("POST", "/api/session/create", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// stored returns the stored session of token, without renewing it
+func stored(t *testing.T, db *SessionDB, token string) *Session {
+	key, err := sessionKey(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var session *Session
+	err = db.Handle.View(func(tx *bolt.Tx) error {
+		session, err = decodeSession(key, tx.Bucket([]byte(sessionBucket)).Get(key))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return session
+}
+
+// backdate moves the creation and last use of a session into the past
+func backdate(t *testing.T, db *SessionDB, token string, created, lastUsed time.Duration) {
+	session := stored(t, db, token)
+	key, _ := sessionKey(token)
+	session.Created = session.Created.Add(-created)
+	session.LastUsed = session.LastUsed.Add(-lastUsed)
+	err := db.Handle.Update(func(tx *bolt.Tx) error {
+		return putSession(tx.Bucket([]byte(sessionBucket)), key, session)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	defer os.Remove("test.session.db")
+	db := openSessions(t, time.Hour, 24*time.Hour)
+	defer db.Close()
+
+	token := login(t, db, "alice")
+	if _, err := db.GetSession(token); err != nil {
+		t.Fatalf("New session invalid: %v", err)
+	}
+	if _, err := db.GetSession(""); err == nil {
+		t.Error("Empty token accepted")
+	}
+	backdate(t, db, token, 2*time.Hour, 2*time.Hour)
+	if _, err := db.GetSession(token); err == nil {
+		t.Error("Session unused for longer than the idle TTL accepted")
+	}
+
+	token = login(t, db, "alice")
+	backdate(t, db, token, 25*time.Hour, 0)
+	if _, err := db.GetSession(token); err == nil {
+		t.Error("Session older than the maximum age accepted")
+	}
+	if list, _ := db.sessions("alice"); len(list) != 0 {
+		t.Errorf("Expired sessions listed: %+v", list)
+	}
+}
+
+func TestSessionRenewal(t *testing.T) {
+	defer os.Remove("test.session.db")
+	db := openSessions(t, time.Hour, 0)
+	defer db.Close()
+
+	token := login(t, db, "alice")
+	backdate(t, db, token, 50*time.Minute, 50*time.Minute)
+	before := stored(t, db, token).LastUsed
+	if _, err := db.GetSession(token); err != nil {
+		t.Fatal(err)
+	}
+	renewed := stored(t, db, token).LastUsed
+	if time.Since(renewed) > time.Minute {
+		t.Errorf("Last use not renewed, was %v, is %v", before, renewed)
+	}
+
+	// recent uses aren't written on every request
+	backdate(t, db, token, 0, 10*time.Second)
+	before = stored(t, db, token).LastUsed
+	db.GetSession(token)
+	if !stored(t, db, token).LastUsed.Equal(before) {
+		t.Error("Last use written again within the renew interval")
+	}
+
+	// renewed sessions outlive the idle TTL since logging in
+	backdate(t, db, token, 2*time.Hour, 40*time.Minute)
+	if _, err := db.GetSession(token); err != nil {
+		t.Errorf("Used session expired: %v", err)
+	}
+}
+
+func TestSweepSessions(t *testing.T) {
+	defer os.Remove("test.session.db")
+	db := openSessions(t, time.Hour, 0)
+	defer db.Close()
+
+	login(t, db, "alice")
+	expired := login(t, db, "alice")
+	backdate(t, db, expired, 2*time.Hour, 2*time.Hour)
+	// the sweep started with the DB may have deleted it already
+	_, err := db.deleteExpired(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list, _ := db.sessions(""); len(list) != 1 {
+		t.Errorf("Want only the valid session left, got %+v", list)
+	}
+	count, _ := db.deleteSessions(func(s *Session) bool { return true })
+	if count != 1 {
+		t.Errorf("Want the expired session deleted, %v sessions left", count)
+	}
+}
+
+func TestRevokeSession(t *testing.T) {
+	defer os.Remove("test.session.db")
+	db := openSessions(t, time.Hour, 0)
+	defer db.Close()
+	db.users.Add("root", "rootpassword", users.Admin)
+	db.users.Add("alice", "alicepassword", users.Member)
+	db.users.Add("bob", "bobpassword", users.Member)
+
+	router := mux.NewRouter()
+	apiRouter := router.PathPrefix("/api").Subrouter()
+	apiRouter.HandleFunc("/sessions/{id:[0-9a-f]+}", db.revokeSessionHandler).Methods("DELETE")
+	apiRouter.Use(db.authenticationMiddleware)
+	revoke := func(token, id string) int {
+		r := httptest.NewRequest("DELETE", "/api/sessions/"+id, nil)
+		r.Header.Set("X-Session-Token", token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	alice := login(t, db, "alice")
+	bob := login(t, db, "bob")
+	if code := revoke(alice, stored(t, db, bob).ID); code != http.StatusNotFound {
+		t.Errorf("Want 404 revoking a session of another user, got %v", code)
+	}
+	if _, err := db.GetSession(bob); err != nil {
+		t.Errorf("Session revoked by another user: %v", err)
+	}
+	other := login(t, db, "alice")
+	if code := revoke(alice, stored(t, db, other).ID); code != http.StatusNoContent {
+		t.Errorf("Want 204 revoking an own session, got %v", code)
+	}
+	if code := revoke(login(t, db, "root"), stored(t, db, bob).ID); code != http.StatusNoContent {
+		t.Errorf("Want 204 for an admin revoking any session, got %v", code)
+	}
+	if _, err := db.GetSession(bob); err == nil {
+		t.Error("Revoked session still valid")
+	}
+	if code := revoke(alice, stored(t, db, alice).ID); code != http.StatusNoContent {
+		t.Errorf("Want 204 revoking the current session, got %v", code)
+	}
+}
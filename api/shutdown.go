@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// handleSignals returns a context which is canceled on SIGTERM or SIGINT. A
+// second signal exits immediately.
+func handleSignals() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		log.Printf("Received %v, shutting down", <-sig)
+		cancel()
+		log.Fatalf("Received %v, exiting without shutting down", <-sig)
+	}()
+	return ctx
+}
+
+// serve runs the servers until one fails or the server context is canceled.
+// Requests in flight then get --shutdownTimeout to finish.
+func (s *server) serve(servers ...*http.Server) error {
+	errs := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func(srv *http.Server) {
+			if srv.TLSConfig != nil {
+				errs <- srv.ListenAndServeTLS("", "")
+			} else {
+				errs <- srv.ListenAndServe()
+			}
+		}(srv)
+	}
+	var err error
+	select {
+	case err = <-errs:
+	case <-s.ctx.Done():
+		err = s.ctx.Err()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout)
+	defer cancel()
+	for _, srv := range servers {
+		if e := srv.Shutdown(ctx); e != nil {
+			log.Printf("Error finishing requests: %v", e)
+			srv.Close()
+		}
+	}
+	return err
+}
+
+// close stops watching the document storage path, waits up to
+// --shutdownTimeout for ingestion and running changes of documents and then
+// closes the DBs, the one with the documents last.
+func (s *server) close() {
+	if s.watcher != nil {
+		s.watcher.Close()
+	}
+	timeout := time.After(s.shutdownTimeout)
+	if s.jobsStopped != nil {
+		select {
+		case <-s.jobsStopped:
+		case <-timeout:
+			log.Print("Ingestion didn't stop in time")
+		}
+	}
+	// held until exiting, nothing may change the documents after the DBs are closed
+	locked := make(chan struct{})
+	go func() {
+		s.ingestMtx.Lock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-timeout:
+		log.Print("Closing DBs while documents are still being changed")
+	}
+
+	// hashes of files ingested since the last scan
+	if s.scanCache != nil {
+		if err := s.scanCache.Flush(false); err != nil {
+			log.Printf("Error writing scan cache: %v", err)
+		}
+	}
+	type closer interface {
+		Close() error
+	}
+	dbs := []struct {
+		name string
+		db   closer
+		open bool
+	}{
+		{"session", s.sessions, s.sessions != nil},
+		{"fuel", s.fuel, s.fuel != nil},
+		{"jobs", s.jobs, s.jobs != nil},
+		{"scan cache", s.scanCache, s.scanCache != nil},
+		{"classifier", s.classifier, s.classifier != nil},
+		{"documents", s.db, s.db != nil},
+	}
+	for _, d := range dbs {
+		if !d.open {
+			continue
+		}
+		if err := d.db.Close(); err != nil {
+			log.Printf("Error closing %v DB: %v", d.name, err)
+		}
+	}
+	log.Print("Shut down")
+}
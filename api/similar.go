@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/reusing-code/dochan/db"
+	"github.com/reusing-code/dochan/similarity"
+)
+
+const (
+	// minimum similarity for an incoming file to be linked as a duplicate
+	duplicateThreshold = 0.9
+	// default minimum similarity for /similar queries
+	similarThreshold = 0.5
+	// default number of results for /related queries
+	relatedLimit = 10
+)
+
+type SimilarDocument struct {
+	ID         uint64  `json:"id"`
+	Filename   string  `json:"filename"`
+	Similarity float64 `json:"similarity"`
+}
+
+// indexSignature computes and stores the signature of a document. If link is
+// set and the document is a near-duplicate of an indexed one, it is linked to it.
+// Private documents are only linked to those of the same owner or visible to
+// everyone, so the link doesn't reveal documents of others.
+func (s *server) indexSignature(key uint64, content []string, link bool) error {
+	sig := similarity.NewSignature(content)
+	if sig == nil {
+		return nil
+	}
+	if link {
+		f, err := s.db.GetFile(key)
+		if err != nil {
+			return err
+		}
+		for _, match := range s.similar.Query(sig, duplicateThreshold) {
+			if match.Key == key {
+				continue
+			}
+			other, err := s.db.GetFile(match.Key)
+			if err != nil || (other.Owner != "" && other.Owner != f.Owner) {
+				continue
+			}
+			err = s.db.UpdateFile(key, func(f *db.DBFile) error {
+				f.DuplicateOf = match.Key
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			break
+		}
+	}
+	err := s.db.SetSignature(key, sig)
+	if err != nil {
+		return err
+	}
+	s.similar.Add(key, sig)
+	return nil
+}
+
+func (s *server) similarHandler(w http.ResponseWriter, r *http.Request) {
+	key, err := documentKey(r)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	threshold := similarThreshold
+	if param := r.URL.Query().Get("threshold"); param != "" {
+		threshold, err = strconv.ParseFloat(param, 64)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	sig, ok := s.similar.Get(key)
+	if !ok {
+		f, err := s.getDocument(key)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		sig = similarity.NewSignature(f.Content)
+	}
+
+	user := requestUser(r)
+	docs := []SimilarDocument{}
+	for _, match := range s.similar.Query(sig, threshold) {
+		if match.Key == key {
+			continue
+		}
+		f, err := s.getDocument(match.Key)
+		if err != nil || !user.CanRead(f.Owner, f.SharedWith) {
+			continue
+		}
+		docs = append(docs, SimilarDocument{ID: match.Key, Filename: f.Name, Similarity: match.Similarity})
+	}
+
+	js, err := json.Marshal(docs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// relatedHandler ranks documents by the similarity of their search index term
+// vectors, finding documents about the same topic rather than copies.
+func (s *server) relatedHandler(w http.ResponseWriter, r *http.Request) {
+	key, err := documentKey(r)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	limit := relatedLimit
+	if param := r.URL.Query().Get("limit"); param != "" {
+		limit, err = strconv.Atoi(param)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	s.indexMtx.RLock()
+	result, ok := s.searchKeys[key]
+	s.indexMtx.RUnlock()
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	user := requestUser(r)
+	docs := []SimilarDocument{}
+	for _, match := range s.search.MoreLikeThis(result) {
+		if len(docs) >= limit {
+			break
+		}
+		var doc Document
+		err := gob.NewDecoder(bytes.NewBufferString(match.Result)).Decode(&doc)
+		if err != nil {
+			log.Printf("Error decoding value")
+			continue
+		}
+		if !user.CanRead(doc.Owner, doc.SharedWith) {
+			continue
+		}
+		docs = append(docs, SimilarDocument{ID: doc.ID, Filename: doc.Filename, Similarity: match.Score})
+	}
+
+	js, err := json.Marshal(docs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	"github.com/reusing-code/dochan/classifier"
+	"github.com/reusing-code/dochan/db"
+)
+
+type SuggestionResponse struct {
+	classifier.Suggestion
+	DocumentTypes []string `json:"documentTypes"`
+}
+
+// Labels confirmed by the user. Missing fields are taken from the suggestion.
+type ConfirmRequest struct {
+	Type *string  `json:"type"`
+	Tags []string `json:"tags"`
+}
+
+func (s *server) suggestionHandler(w http.ResponseWriter, r *http.Request) {
+	key, err := documentKey(r)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	f, err := s.getDocument(key)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	suggestion, err := s.classifier.GetSuggestion(key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if suggestion == nil {
+		res := s.classifier.Suggest(f.Content)
+		suggestion = &res
+	}
+	js, err := json.Marshal(SuggestionResponse{*suggestion, classifier.DocumentTypes})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+func (s *server) suggestionConfirmHandler(w http.ResponseWriter, r *http.Request) {
+	key, err := documentKey(r)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	var req ConfirmRequest
+	buf, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(buf) > 0 {
+		err = json.Unmarshal(buf, &req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	f, err := s.getDocument(key)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	suggestion, err := s.classifier.GetSuggestion(key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if suggestion == nil {
+		res := s.classifier.Suggest(f.Content)
+		suggestion = &res
+	}
+	docType, tags := suggestion.Accepted()
+	if req.Type != nil {
+		docType = *req.Type
+	}
+	if req.Tags != nil {
+		tags = req.Tags
+	}
+
+	err = s.db.UpdateFile(key, func(f *db.DBFile) error {
+		f.Type = docType
+		f.Tags = tags
+		return nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = s.classifier.Train(key, docType, tags, f.Content)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = s.applyJournal()
+	if err != nil {
+		log.Printf("Error updating search index: %v", err)
+	}
+
+	js, err := json.Marshal(&ResponseDocument{ID: key, Filename: f.Name, Type: docType, Tags: tags})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+func (s *server) suggestionRejectHandler(w http.ResponseWriter, r *http.Request) {
+	key, err := documentKey(r)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	_, err = s.getDocument(key)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	err = s.classifier.Reject(key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte("{}"))
+}
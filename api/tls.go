@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/reusing-code/dochan/certs"
+)
+
+// how often the certificate files are checked for changes
+const certCheckInterval = time.Minute
+
+// configureTLS makes srv serve the certificate of --tlsCert and --tlsKey,
+// which are created self-signed if they don't exist. The certificate is
+// reloaded when the files change or on SIGHUP. It returns the server
+// redirecting plain HTTP if --redirectPort is set.
+func (s *server) configureTLS(srv *http.Server) (*http.Server, error) {
+	if s.tlsCert == "" || s.tlsKey == "" {
+		return nil, fmt.Errorf("--tlsCert and --tlsKey have to be set together")
+	}
+	_, certErr := os.Stat(s.tlsCert)
+	_, keyErr := os.Stat(s.tlsKey)
+	if os.IsNotExist(certErr) && os.IsNotExist(keyErr) {
+		log.Printf("Creating self-signed certificate %v", s.tlsCert)
+		err := certs.GenerateSelfSigned(s.tlsCert, s.tlsKey, certHosts())
+		if err != nil {
+			return nil, err
+		}
+	}
+	reloader, err := certs.NewReloader(s.tlsCert, s.tlsKey)
+	if err != nil {
+		return nil, err
+	}
+	go reloader.Watch(certCheckInterval, s.ctx.Done(), func(err error) {
+		log.Printf("Error reloading certificate: %v", err)
+	})
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		for range hup {
+			err := reloader.Reload()
+			if err != nil {
+				log.Printf("Error reloading certificate: %v", err)
+				continue
+			}
+			log.Print("Reloaded certificate")
+		}
+	}()
+
+	srv.Handler = s.hstsMiddleware(reloader, srv.Handler)
+	srv.TLSConfig = &tls.Config{GetCertificate: reloader.GetCertificate, MinVersion: tls.VersionTLS12}
+	if s.redirectPort == 0 {
+		return nil, nil
+	}
+	return &http.Server{
+		Addr:    ":" + strconv.Itoa(s.redirectPort),
+		Handler: http.HandlerFunc(s.redirectHandler),
+	}, nil
+}
+
+// certHosts returns the names a self-signed certificate is created for
+func certHosts() []string {
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	if name, err := os.Hostname(); err == nil && name != "localhost" {
+		hosts = append([]string{name}, hosts...)
+	}
+	return hosts
+}
+
+// hstsMiddleware tells browsers to only use HTTPS. It is left out for
+// self-signed certificates, browsers don't allow exceptions for them with HSTS.
+func (s *server) hstsMiddleware(reloader *certs.Reloader, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.hstsMaxAge > 0 && !reloader.SelfSigned() {
+			w.Header().Set("Strict-Transport-Security", "max-age="+strconv.Itoa(int(s.hstsMaxAge.Seconds())))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// redirectHandler sends plain HTTP requests to the HTTPS port
+func (s *server) redirectHandler(w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	if s.port != 443 {
+		host = net.JoinHostPort(host, strconv.Itoa(s.port))
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+}
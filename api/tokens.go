@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/gorilla/mux"
+	"github.com/reusing-code/dochan/users"
+)
+
+const (
+	tokenBucket = "tokens"
+	tokenBytes  = 32
+	// prefix of API tokens, to tell them from session tokens
+	tokenPrefix = "dochan_"
+)
+
+// Scopes of API tokens, a token acts with the permissions of its user
+// restricted to its scopes
+const (
+	// search and read documents
+	ScopeRead = "read"
+	// upload documents
+	ScopeUpload = "upload"
+	// read and add fuel records
+	ScopeFuel = "fuel"
+)
+
+var tokenScopes = []string{ScopeRead, ScopeUpload, ScopeFuel}
+
+// Token is stored under the SHA-256 hash of its secret, the hex encoded hash
+// identifies it in the API
+type Token struct {
+	ID       string    `json:"id"`
+	Name     string    `json:"name"`
+	User     string    `json:"user"`
+	Scopes   []string  `json:"scopes"`
+	Created  time.Time `json:"created"`
+	LastUsed time.Time `json:"lastUsed"`
+	// only set in the response creating the token
+	Secret string `json:"token,omitempty"`
+}
+
+type TokenRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
+// routes below /api/documents which change documents, the read scope doesn't
+// cover them whatever the method
+var documentActions = []string{"/suggestions/confirm", "/suggestions/reject"}
+
+// readsDocuments reports whether a request only reads documents
+func readsDocuments(r *http.Request) bool {
+	if (r.Method != "GET" && r.Method != "HEAD") || !strings.HasPrefix(r.URL.Path, "/api/documents") {
+		return false
+	}
+	for _, action := range documentActions {
+		if strings.HasSuffix(r.URL.Path, action) {
+			return false
+		}
+	}
+	return true
+}
+
+// allows reports whether the scopes of the token cover the request
+func (t *Token) allows(r *http.Request) bool {
+	for _, scope := range t.Scopes {
+		switch scope {
+		case ScopeRead:
+			if readsDocuments(r) {
+				return true
+			}
+		case ScopeUpload:
+			if r.Method == "POST" && r.URL.Path == "/api/documents" {
+				return true
+			}
+		case ScopeFuel:
+			if strings.HasPrefix(r.URL.Path, "/api/fuel") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// bearerToken returns the API token of the Authorization header, empty if there is none
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+}
+
+func tokenKey(secret string) []byte {
+	key := sha256.Sum256([]byte(secret))
+	return key[:]
+}
+
+func putToken(bucket *bolt.Bucket, key []byte, token *Token) error {
+	buf := &bytes.Buffer{}
+	err := gob.NewEncoder(buf).Encode(token)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(key, buf.Bytes())
+}
+
+func decodeToken(key, value []byte) (*Token, error) {
+	token := &Token{}
+	err := gob.NewDecoder(bytes.NewBuffer(value)).Decode(token)
+	if err != nil {
+		return nil, err
+	}
+	token.ID = hex.EncodeToString(key)
+	return token, nil
+}
+
+// CreateToken stores a new API token of the user and returns it with its secret
+func (db *SessionDB) CreateToken(user, name string, scopes []string) (*Token, error) {
+	for _, scope := range scopes {
+		valid := false
+		for _, s := range tokenScopes {
+			valid = valid || s == scope
+		}
+		if !valid {
+			return nil, fmt.Errorf("invalid scope %q", scope)
+		}
+	}
+	if len(scopes) == 0 {
+		return nil, fmt.Errorf("no scopes")
+	}
+	b := make([]byte, tokenBytes)
+	_, err := rand.Read(b)
+	if err != nil {
+		return nil, err
+	}
+	secret := tokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+	token := &Token{Name: name, User: user, Scopes: scopes, Created: time.Now()}
+	key := tokenKey(secret)
+	err = db.Handle.Update(func(tx *bolt.Tx) error {
+		return putToken(tx.Bucket([]byte(tokenBucket)), key, token)
+	})
+	if err != nil {
+		return nil, err
+	}
+	token.ID = hex.EncodeToString(key)
+	token.Secret = secret
+	return token, nil
+}
+
+// GetToken returns the API token with the given secret and updates its last use
+func (db *SessionDB) GetToken(secret string) (*Token, error) {
+	key := tokenKey(secret)
+	var token *Token
+	err := db.Handle.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(tokenBucket)).Get(key)
+		if b == nil {
+			return errInvalidSession
+		}
+		var err error
+		token, err = decodeToken(key, b)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if now.Sub(token.LastUsed) > sessionRenewInterval {
+		token.LastUsed = now
+		err = db.Handle.Update(func(tx *bolt.Tx) error {
+			bucket := tx.Bucket([]byte(tokenBucket))
+			if bucket.Get(key) == nil {
+				return errInvalidSession
+			}
+			return putToken(bucket, key, token)
+		})
+	}
+	return token, err
+}
+
+// tokens returns all API tokens, of one user if user is set
+func (db *SessionDB) tokens(user string) ([]Token, error) {
+	list := []Token{}
+	err := db.Handle.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(tokenBucket)).ForEach(func(k, v []byte) error {
+			token, err := decodeToken(k, v)
+			if err != nil {
+				return err
+			}
+			if user == "" || token.User == user {
+				list = append(list, *token)
+			}
+			return nil
+		})
+	})
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+	return list, err
+}
+
+// deleteTokens removes all API tokens matching the filter
+func (db *SessionDB) deleteTokens(filter func(t *Token) bool) error {
+	return db.Handle.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(tokenBucket))
+		var keys [][]byte
+		err := bucket.ForEach(func(k, v []byte) error {
+			token, err := decodeToken(k, v)
+			if err != nil {
+				return err
+			}
+			if filter(token) {
+				keys = append(keys, append([]byte{}, k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			err = bucket.Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// tokensHandler lists the API tokens of the user, admins get the tokens of
+// all users with query parameter all=true
+func (db *SessionDB) tokensHandler(w http.ResponseWriter, r *http.Request) {
+	user := requestUser(r)
+	name := user.Name
+	if r.URL.Query().Get("all") == "true" {
+		if user.Role != users.Admin {
+			http.Error(w, "Admin required", http.StatusForbidden)
+			return
+		}
+		name = ""
+	}
+	list, err := db.tokens(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// createTokenHandler creates an API token of the user, its secret is only
+// part of this response
+func (db *SessionDB) createTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var req TokenRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	user := requestUser(r)
+	token, err := db.CreateToken(user.Name, req.Name, req.Scopes)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	db.auditf(r, "user %q created API token %q with scopes %v", user.Name, token.Name, token.Scopes)
+	writeJSON(w, http.StatusCreated, token)
+}
+
+// revokeTokenHandler deletes an API token of the user, admins may delete any token
+func (db *SessionDB) revokeTokenHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	user := requestUser(r)
+	found := false
+	err := db.deleteTokens(func(t *Token) bool {
+		match := t.ID == id && (t.User == user.Name || user.Role == users.Admin)
+		found = found || match
+		return match
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	db.auditf(r, "user %q revoked API token %v", user.Name, id)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/reusing-code/dochan/users"
+)
+
+func TestTokenScopes(t *testing.T) {
+	for _, c := range []struct {
+		scope, method, path string
+		allowed             bool
+	}{
+		{ScopeRead, "GET", "/api/documents", true},
+		{ScopeRead, "GET", "/api/documents/1/download", true},
+		{ScopeRead, "GET", "/api/documents/1/suggestions", true},
+		{ScopeRead, "GET", "/api/documents/1/suggestions/confirm", false},
+		{ScopeRead, "GET", "/api/documents/1/suggestions/reject", false},
+		{ScopeRead, "POST", "/api/documents/1/suggestions/confirm", false},
+		{ScopeRead, "PATCH", "/api/documents/1", false},
+		{ScopeRead, "GET", "/api/fuel", false},
+		{ScopeUpload, "POST", "/api/documents", true},
+		{ScopeUpload, "GET", "/api/documents", false},
+		{ScopeFuel, "POST", "/api/fuel/submit", true},
+		{ScopeFuel, "GET", "/api/documents", false},
+	} {
+		token := &Token{Scopes: []string{c.scope}}
+		if allowed := token.allows(httptest.NewRequest(c.method, c.path, nil)); allowed != c.allowed {
+			t.Errorf("%v %v with scope %v: want allowed %v, got %v", c.method, c.path, c.scope, c.allowed, allowed)
+		}
+	}
+}
+
+func TestReadTokenCantChangeDocuments(t *testing.T) {
+	defer os.Remove("test.session.db")
+	db := openSessions(t, time.Hour, 0)
+	defer db.Close()
+	db.users.Add("alice", "alicepassword", users.Member)
+	token, err := db.CreateToken("alice", "script", []string{ScopeRead})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changed := false
+	change := func(w http.ResponseWriter, r *http.Request) {
+		changed = true
+	}
+	router := mux.NewRouter()
+	apiRouter := router.PathPrefix("/api").Subrouter()
+	apiRouter.HandleFunc("/documents/{key:[0-9]+}/suggestions/confirm", change).Methods("POST")
+	apiRouter.HandleFunc("/documents/{key:[0-9]+}/suggestions/reject", change).Methods("POST")
+	apiRouter.HandleFunc("/documents/{key:[0-9]+}", func(w http.ResponseWriter, r *http.Request) {})
+	apiRouter.Use(db.authenticationMiddleware)
+	request := func(method, path string) int {
+		r := httptest.NewRequest(method, path, nil)
+		r.Header.Set("Authorization", "Bearer "+token.Secret)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	for _, path := range []string{"/api/documents/1/suggestions/confirm", "/api/documents/1/suggestions/reject"} {
+		if code := request("POST", path); code != http.StatusForbidden {
+			t.Errorf("Want 403 for POST %v with a read token, got %v", path, code)
+		}
+		if code := request("GET", path); code == http.StatusOK {
+			t.Errorf("GET %v with a read token succeeded", path)
+		}
+	}
+	if changed {
+		t.Error("Read token changed a document")
+	}
+	if code := request("GET", "/api/documents/1"); code != http.StatusOK {
+		t.Errorf("Want 200 reading a document with a read token, got %v", code)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/reusing-code/dochan/totp"
+	"github.com/reusing-code/dochan/users"
+)
+
+// issuer shown in authenticator apps
+const totpIssuer = "dochan"
+
+var errSecondFactorRequired = errors.New("second factor required")
+
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+type TOTPRequest struct {
+	Code string `json:"code"`
+	// required to disable TOTP and to replace an enabled one
+	Password string `json:"password"`
+}
+
+type RecoveryCodes struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+// verifySecondFactor checks code for users with TOTP enabled, users without pass
+func (db *SessionDB) verifySecondFactor(u *users.User, code string) error {
+	if !u.TOTPEnabled {
+		return nil
+	}
+	if code == "" {
+		return errSecondFactorRequired
+	}
+	return db.users.VerifySecondFactor(u.Name, code, time.Now())
+}
+
+// beginTOTPHandler creates a TOTP secret for the logged in user, it is active
+// after confirming a code with confirmTOTPHandler. Replacing an enabled secret
+// needs the password and a current code, like disabling it.
+func (db *SessionDB) beginTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	user := requestUser(r)
+	if user.TOTPEnabled {
+		var req TOTPRequest
+		if !readJSON(w, r, &req) {
+			return
+		}
+		if _, err := db.authenticate(w, r, user.Name, req.Password, true, req.Code); err != nil {
+			return
+		}
+	}
+	secret, err := db.users.BeginTOTP(user.Name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, TOTPEnrollment{
+		Secret: totp.Encode(secret),
+		URI:    totp.URI(totpIssuer, user.Name, secret),
+	})
+}
+
+// confirmTOTPHandler enables TOTP if the code matches the new secret and
+// returns the recovery codes, they are only shown once. Replacing an enabled
+// secret needs the password as well.
+func (db *SessionDB) confirmTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	var req TOTPRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	user := requestUser(r)
+	if user.TOTPEnabled {
+		if _, err := db.authenticate(w, r, user.Name, req.Password, false, ""); err != nil {
+			return
+		}
+	}
+	codes, err := db.users.EnableTOTP(user.Name, req.Code, time.Now())
+	if err == users.ErrInvalidCode {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	db.auditf(r, "user %q enabled TOTP", user.Name)
+	writeJSON(w, http.StatusOK, RecoveryCodes{codes})
+}
+
+// disableTOTPHandler removes the second factor of the logged in user, unless
+// an admin requires it
+func (db *SessionDB) disableTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	var req TOTPRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	user := requestUser(r)
+	if user.TOTPRequired {
+		http.Error(w, "TOTP is required for the user", http.StatusForbidden)
+		return
+	}
+	if _, err := db.authenticate(w, r, user.Name, req.Password, true, req.Code); err != nil {
+		return
+	}
+	err := db.users.DisableTOTP(user.Name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	db.auditf(r, "user %q disabled TOTP", user.Name)
+	w.WriteHeader(http.StatusNoContent)
+}
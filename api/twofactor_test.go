@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/reusing-code/dochan/totp"
+	"github.com/reusing-code/dochan/users"
+)
+
+func TestReplaceTOTP(t *testing.T) {
+	defer os.Remove("test.session.db")
+	db := openSessions(t, time.Hour, 0)
+	defer db.Close()
+	db.users.Add("bob", "bobpassword", users.Member)
+	secret, _ := db.users.BeginTOTP("bob")
+	now := time.Now()
+	_, err := db.users.EnableTOTP("bob", totp.Code(secret, now.Add(-totp.Period)), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := mux.NewRouter()
+	apiRouter := router.PathPrefix("/api").Subrouter()
+	apiRouter.HandleFunc("/user/totp", db.beginTOTPHandler).Methods("POST")
+	apiRouter.HandleFunc("/user/totp/confirm", db.confirmTOTPHandler).Methods("POST")
+	apiRouter.Use(db.authenticationMiddleware)
+	session := login(t, db, "bob")
+	request := func(path, body string) int {
+		r := httptest.NewRequest("POST", path, strings.NewReader(body))
+		r.Header.Set("X-Session-Token", session)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	for _, body := range []string{``, `{"password":"bobpassword"}`, `{"password":"wrong","code":"` + totp.Code(secret, now) + `"}`} {
+		if code := request("/api/user/totp", body); code == http.StatusOK {
+			t.Errorf("Enabled TOTP replaced with %q", body)
+		}
+	}
+	if code := request("/api/user/totp/confirm", `{"code":"123456"}`); code != http.StatusUnauthorized {
+		t.Errorf("Want 401 confirming without password, got %v", code)
+	}
+	if code := request("/api/user/totp", `{"password":"bobpassword","code":"`+totp.Code(secret, now)+`"}`); code != http.StatusOK {
+		t.Errorf("Want 200 with password and code, got %v", code)
+	}
+}
+
+func TestMissingCodeHidesPassword(t *testing.T) {
+	defer os.Remove("test.session.db")
+	db := openSessions(t, time.Hour, 0)
+	defer db.Close()
+	db.users.Add("bob", "bobpassword", users.Member)
+	secret, _ := db.users.BeginTOTP("bob")
+	now := time.Now()
+	_, err := db.users.EnableTOTP("bob", totp.Code(secret, now.Add(-totp.Period)), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var answers []string
+	for _, password := range []string{"wrong", "bobpassword"} {
+		w := httptest.NewRecorder()
+		db.sessionCreateHandler(w, httptest.NewRequest("POST", "/api/session/create", strings.NewReader(`{"user":"bob","password":"`+password+`"}`)))
+		if w.Code != http.StatusUnauthorized || w.Header().Get("X-Second-Factor") != "totp" {
+			t.Errorf("Login with password %q without code: want 401 asking for the code, got %v", password, w.Code)
+		}
+		answers = append(answers, w.Body.String())
+	}
+	if answers[0] != answers[1] {
+		t.Errorf("Answer tells whether the password matched: %q and %q", answers[0], answers[1])
+	}
+	if failures := db.lockout.Fail("bob"); failures != 3 {
+		t.Errorf("Want both logins counted as failures, got %v", failures-1)
+	}
+}
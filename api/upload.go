@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/reusing-code/dochan/parser"
+	"github.com/reusing-code/dochan/users"
+)
+
+// uploaded files are stored in this directory below the document storage path
+const uploadDir = "uploads"
+
+type UploadResult struct {
+	ID          uint64 `json:"id,omitempty"`
+	Filename    string `json:"filename"`
+	DuplicateOf uint64 `json:"duplicateOf,omitempty"`
+}
+
+// limitedBody limits a request body like http.MaxBytesReader and counts the
+// bytes read, readers on top of it don't keep the error telling the limit was exceeded
+type limitedBody struct {
+	io.ReadCloser
+	limit, read int64
+	exceeded    bool
+}
+
+// limitBody replaces the body of r by a limitedBody with limit
+func limitBody(w http.ResponseWriter, r *http.Request, limit int64) *limitedBody {
+	b := &limitedBody{ReadCloser: http.MaxBytesReader(w, r.Body, limit), limit: limit}
+	r.Body = b
+	return b
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	// http.MaxBytesReader fails after returning limit bytes if there are more
+	if err != nil && err != io.EOF && b.read >= b.limit {
+		b.exceeded = true
+	}
+	return n, err
+}
+
+// errorStatus returns 413 if the body exceeded the limit, 400 for other errors reading it
+func (b *limitedBody) errorStatus() int {
+	if b.exceeded {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+// uploadHandler accepts a multipart form with the document in field "file".
+// With query parameter private=true it is stored in the private folder of the user.
+func (s *server) uploadHandler(w http.ResponseWriter, r *http.Request) {
+	body := limitBody(w, r, s.maxUpload)
+	reader, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, err.Error(), body.errorStatus())
+		return
+	}
+	var part io.ReadCloser
+	filename := ""
+	for {
+		p, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			http.Error(w, err.Error(), body.errorStatus())
+			return
+		}
+		if p.FormName() == "file" {
+			part = p
+			filename = filepath.Base(p.FileName())
+			break
+		}
+		p.Close()
+	}
+	if part == nil || filename == "." || filename == string(filepath.Separator) {
+		http.Error(w, "Missing file", http.StatusBadRequest)
+		return
+	}
+	if !isDocument(filename) {
+		http.Error(w, fmt.Sprintf("Unsupported file type %q", filepath.Ext(filename)), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	dir := filepath.Join(s.dir, uploadDir)
+	if r.URL.Query().Get("private") == "true" {
+		dir = filepath.Join(s.dir, privateDir, requestUser(r).Name)
+	}
+	err = os.MkdirAll(dir, 0777)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// no document extension, so the watcher ignores it until it is complete
+	tmp, err := ioutil.TempFile(dir, ".upload-")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, part)
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	tmp.Close()
+	if err != nil {
+		http.Error(w, err.Error(), body.errorStatus())
+		return
+	}
+
+	// the temporary file is parsed without holding the ingest lock, only
+	// documents the user can read are reported as duplicates, private
+	// documents of others with the same content don't keep the user from
+	// storing a copy. An explicit upload brings back a purged document.
+	f, rawData, err := parser.ReadFile(tmp.Name())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if key, ok := s.duplicateFor(requestUser(r), f.Hash); ok {
+		writeJSON(w, http.StatusConflict, UploadResult{Filename: filename, DuplicateOf: key})
+		return
+	}
+	content, err := parser.ParseText(r.Context(), f, s.parseTimeout)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	s.ingestMtx.Lock()
+	defer s.ingestMtx.Unlock()
+	// the same content may have been stored while parsing
+	if key, ok := s.duplicateFor(requestUser(r), f.Hash); ok {
+		writeJSON(w, http.StatusConflict, UploadResult{Filename: filename, DuplicateOf: key})
+		return
+	}
+	// the watcher finds the content known and doesn't parse it again
+	target := uniquePath(filepath.Join(dir, filename))
+	err = os.Rename(tmp.Name(), target)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	f.Filename = target
+	key, err := s.addDocument(f, content, rawData)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Uploaded %v as document %v", target, key)
+
+	res := UploadResult{ID: key, Filename: filepath.Base(target)}
+	if file, err := s.db.GetFile(key); err == nil {
+		res.DuplicateOf = file.DuplicateOf
+	}
+	writeJSON(w, http.StatusCreated, res)
+}
+
+// duplicateFor returns the document with the hash among those visible to
+// everyone and the private ones of user
+func (s *server) duplicateFor(user *users.User, hash string) (uint64, bool) {
+	for _, owner := range []string{"", user.Name} {
+		if key, ok := s.db.KeyByHash(owner, hash); ok {
+			return key, true
+		}
+	}
+	return 0, false
+}
+
+// uniquePath appends a counter to the filename if path already exists
+func uniquePath(path string) string {
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	result := path
+	for i := 1; ; i++ {
+		if _, err := os.Stat(result); os.IsNotExist(err) {
+			return result
+		}
+		result = fmt.Sprintf("%s-%d%s", base, i, ext)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	js, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(js)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/reusing-code/dochan/classifier"
+	"github.com/reusing-code/dochan/db"
+	"github.com/reusing-code/dochan/searchTree"
+	"github.com/reusing-code/dochan/similarity"
+	"github.com/reusing-code/dochan/users"
+)
+
+// fakePdftohtml puts a script named pdftohtml first in PATH, it returns the
+// plain text content of the file
+func fakePdftohtml(t *testing.T, dir string) func() {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a shell")
+	}
+	script := `#!/bin/sh
+echo '<?xml version="1.0"?><pdf2xml><page number="1" width="1" height="1"><text top="0" left="0" width="1" height="1">'"$(cat "$2")"'</text></page></pdf2xml>' > "$3"
+`
+	bin, err := filepath.Abs(filepath.Join(dir, "bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(bin, 0777)
+	err = ioutil.WriteFile(filepath.Join(bin, "pdftohtml"), []byte(script), 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", bin+string(os.PathListSeparator)+path)
+	return func() { os.Setenv("PATH", path) }
+}
+
+// uploadServer returns a server storing documents below dir, without watcher and jobs
+func uploadServer(t *testing.T, dir string) *server {
+	s := &server{dir: filepath.Join(dir, "docs"), maxUpload: 1 << 10, parseTimeout: time.Minute}
+	var err error
+	s.db, err = db.New(filepath.Join(dir, "test.documents.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.classifier, err = classifier.New(filepath.Join(dir, "test.classifier.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.search = searchTree.MakeSearchTree()
+	s.searchKeys = make(map[uint64]string)
+	s.similar = similarity.NewIndex()
+	return s
+}
+
+// upload sends content as file filename to the upload handler of s as user
+func upload(t *testing.T, s *server, user *users.User, filename, content, query string) (int, UploadResult) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write([]byte(content))
+	form.Close()
+	r := httptest.NewRequest("POST", "/api/documents"+query, &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	r = r.WithContext(context.WithValue(r.Context(), userContextKey, user))
+	w := httptest.NewRecorder()
+	s.uploadHandler(w, r)
+
+	var res UploadResult
+	if strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") {
+		err = json.Unmarshal(w.Body.Bytes(), &res)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w.Code, res
+}
+
+func TestUpload(t *testing.T) {
+	dir := "upload-test"
+	defer os.RemoveAll(dir)
+	defer fakePdftohtml(t, dir)()
+	s := uploadServer(t, dir)
+	defer s.classifier.Close()
+	defer s.db.Close()
+	alice := &users.User{Name: "alice", Role: users.Member}
+
+	code, res := upload(t, s, alice, "invoice.pdf", "Invoice", "")
+	if code != http.StatusCreated || res.ID == 0 || res.Filename != "invoice.pdf" {
+		t.Fatalf("Upload: want 201 with new document, got %v %+v", code, res)
+	}
+	file, err := s.db.GetFile(res.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file.Owner != "" || file.Path != filepath.Join(s.dir, uploadDir, "invoice.pdf") || strings.Join(file.Content, " ") != "Invoice" {
+		t.Errorf("Wrong stored document %v owned by %q with content %q", file.Path, file.Owner, file.Content)
+	}
+
+	code, dup := upload(t, s, alice, "copy.pdf", "Invoice", "")
+	if code != http.StatusConflict || dup.DuplicateOf != res.ID {
+		t.Errorf("Duplicate upload: want 409 with duplicateOf %v, got %v %+v", res.ID, code, dup)
+	}
+	if _, err := os.Stat(filepath.Join(s.dir, uploadDir, "copy.pdf")); !os.IsNotExist(err) {
+		t.Errorf("Duplicate upload was stored")
+	}
+
+	code, res = upload(t, s, alice, "contract.pdf", "Contract", "?private=true")
+	if code != http.StatusCreated {
+		t.Fatalf("Private upload: want 201, got %v", code)
+	}
+	file, err = s.db.GetFile(res.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file.Owner != "alice" || file.Path != filepath.Join(s.dir, privateDir, "alice", "contract.pdf") {
+		t.Errorf("Private upload stored as %v owned by %q", file.Path, file.Owner)
+	}
+
+	if code, _ := upload(t, s, alice, "big.pdf", strings.Repeat("x", 2<<10), ""); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Upload over maxUpload: want 413, got %v", code)
+	}
+	if code, _ := upload(t, s, alice, "notes.txt", "Notes", ""); code != http.StatusUnsupportedMediaType {
+		t.Errorf("Upload of non-document: want 415, got %v", code)
+	}
+	left, _ := filepath.Glob(filepath.Join(s.dir, uploadDir, ".upload-*"))
+	if len(left) > 0 {
+		t.Errorf("Temporary files left: %v", left)
+	}
+}
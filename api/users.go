@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/reusing-code/dochan/users"
+)
+
+// passwords set through the API, the default user may have a shorter secret
+const minPasswordLength = 8
+
+type UserRequest struct {
+	Name     string     `json:"name"`
+	Password *string    `json:"password"`
+	Role     users.Role `json:"role"`
+	// only for changing users
+	TOTPRequired *bool `json:"totpRequired"`
+	// removes the second factor, e.g. after losing the device and recovery codes
+	ResetTOTP bool `json:"resetTOTP"`
+}
+
+type PasswordRequest struct {
+	Password    string `json:"password"`
+	NewPassword string `json:"newPassword"`
+}
+
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	buf, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	err = json.Unmarshal(buf, v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func validPassword(w http.ResponseWriter, password string) bool {
+	if len(password) < minPasswordLength {
+		http.Error(w, "Password too short", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// userStatus maps errors of the user store to HTTP status codes
+func userStatus(err error) int {
+	switch err {
+	case users.ErrNotFound:
+		return http.StatusNotFound
+	case users.ErrExists, users.ErrLastAdmin:
+		return http.StatusConflict
+	}
+	return http.StatusBadRequest
+}
+
+// currentUserHandler returns the logged in user
+func (db *SessionDB) currentUserHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, requestUser(r))
+}
+
+// changePasswordHandler changes the password of the logged in user
+func (db *SessionDB) changePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var req PasswordRequest
+	if !readJSON(w, r, &req) || !validPassword(w, req.NewPassword) {
+		return
+	}
+	user := requestUser(r)
+	if _, err := db.authenticate(w, r, user.Name, req.Password, false, ""); err != nil {
+		return
+	}
+	err := db.users.SetPassword(user.Name, req.NewPassword)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	db.auditf(r, "user %q changed the password", user.Name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (db *SessionDB) usersHandler(w http.ResponseWriter, r *http.Request) {
+	list, err := db.users.List()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (db *SessionDB) addUserHandler(w http.ResponseWriter, r *http.Request) {
+	var req UserRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if req.Password == nil {
+		http.Error(w, "Missing password", http.StatusBadRequest)
+		return
+	}
+	if !validPassword(w, *req.Password) {
+		return
+	}
+	if req.Role == "" {
+		req.Role = users.Member
+	}
+	user, err := db.users.Add(req.Name, *req.Password, req.Role)
+	if err != nil {
+		http.Error(w, err.Error(), userStatus(err))
+		return
+	}
+	db.auditf(r, "user %q added user %q with role %v", requestUser(r).Name, user.Name, user.Role)
+	writeJSON(w, http.StatusCreated, user)
+}
+
+// updateUserHandler changes the role or resets the password or second factor of a user
+func (db *SessionDB) updateUserHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	var req UserRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if req.Password != nil {
+		if !validPassword(w, *req.Password) {
+			return
+		}
+		err := db.users.SetPassword(name, *req.Password)
+		if err != nil {
+			http.Error(w, err.Error(), userStatus(err))
+			return
+		}
+	}
+	if req.Role != "" {
+		err := db.users.SetRole(name, req.Role)
+		if err != nil {
+			http.Error(w, err.Error(), userStatus(err))
+			return
+		}
+	}
+	if req.TOTPRequired != nil {
+		err := db.users.SetTOTPRequired(name, *req.TOTPRequired)
+		if err != nil {
+			http.Error(w, err.Error(), userStatus(err))
+			return
+		}
+	}
+	if req.ResetTOTP {
+		err := db.users.DisableTOTP(name)
+		if err != nil {
+			http.Error(w, err.Error(), userStatus(err))
+			return
+		}
+	}
+	user, err := db.users.Get(name)
+	if err != nil {
+		http.Error(w, err.Error(), userStatus(err))
+		return
+	}
+	db.auditf(r, "user %q changed user %q, role %v, password reset: %v, TOTP required: %v, TOTP reset: %v",
+		requestUser(r).Name, name, user.Role, req.Password != nil, user.TOTPRequired, req.ResetTOTP)
+	writeJSON(w, http.StatusOK, user)
+}
+
+// deleteUserHandler removes a user and ends all sessions and tokens of it, the documents
+// private to the user are only visible to admins afterwards
+func (db *SessionDB) deleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	err := db.users.Delete(name)
+	if err != nil {
+		http.Error(w, err.Error(), userStatus(err))
+		return
+	}
+	err = db.revokeUser(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	db.auditf(r, "user %q deleted user %q", requestUser(r).Name, name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (db *SessionDB) revokeUser(name string) error {
+	_, err := db.deleteSessions(func(s *Session) bool {
+		return s.User == name
+	})
+	if err != nil {
+		return err
+	}
+	return db.deleteTokens(func(t *Token) bool {
+		return t.User == name
+	})
+}
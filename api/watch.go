@@ -0,0 +1,185 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/reusing-code/dochan/db"
+	"github.com/reusing-code/dochan/parser"
+	"github.com/reusing-code/dochan/watcher"
+)
+
+// time a file has to be unchanged before it is ingested
+const watchDebounce = 2 * time.Second
+
+func (s *server) watchDir() error {
+	w, err := watcher.New(s.dir, watcher.Options{
+		Debounce:     watchDebounce,
+		PollInterval: s.pollInterval,
+		ForcePolling: s.pollInterval > 0,
+	})
+	if err != nil {
+		return err
+	}
+	s.watcher = w
+	go func() {
+		for err := range w.Errors() {
+			log.Printf("Error watching %v: %v", s.dir, err)
+			if err == watcher.ErrOverflow {
+				s.queueScan()
+			}
+		}
+	}()
+	go func() {
+		for ev := range w.Events() {
+			s.handleFileEvent(ev)
+		}
+	}()
+	return nil
+}
+
+// handleFileEvent applies a change of the document storage path, files are
+// parsed without holding the ingest lock
+func (s *server) handleFileEvent(ev watcher.Event) {
+	var err error
+	switch ev.Op {
+	case watcher.Create, watcher.Write:
+		err = s.ingestFile(ev.Path)
+	case watcher.Remove:
+		s.ingestMtx.Lock()
+		err = s.removePath(ev.Path, ev.IsDir)
+		s.ingestMtx.Unlock()
+	case watcher.Rename:
+		s.ingestMtx.Lock()
+		var moved bool
+		moved, err = s.movePath(ev.OldPath, ev.Path, ev.IsDir)
+		s.ingestMtx.Unlock()
+		if err == nil && !moved {
+			err = s.ingestFile(ev.Path)
+		}
+	}
+	if err != nil {
+		log.Printf("Error handling %v of %v: %v", ev.Op, ev.Path, err)
+	}
+}
+
+// filesAt returns the documents stored from path, or from below path for directories
+func (s *server) filesAt(path string, isDir bool) ([]uint64, error) {
+	if isDir {
+		return s.db.KeysByPathPrefix(path + string(filepath.Separator))
+	}
+	if key, ok := s.db.KeyByPath(path); ok {
+		return []uint64{key}, nil
+	}
+	return nil, nil
+}
+
+// ingestFile parses and stores a changed file, failures are recorded
+func (s *server) ingestFile(path string) error {
+	if !isDocument(path) {
+		return nil
+	}
+	err := s.ingestPath(s.ctx, path)
+	if err != nil {
+		s.recordFailure(watchKind, path, err)
+		return err
+	}
+	return s.jobs.RemoveFailure(path)
+}
+
+// storeFile adds a parsed file or updates the document stored from it
+func (s *server) storeFile(path string, f parser.File, content []string, rawData []byte) error {
+	owner := s.ownerOf(path)
+	if s.db.Contains(owner, f.Hash) {
+		// known content, but the file may have been moved while not being watched
+		key, ok := s.db.KeyByHash(owner, f.Hash)
+		if !ok {
+			return nil
+		}
+		file, err := s.db.GetFile(key)
+		if err != nil || file.Path == path {
+			return err
+		}
+		if _, err := os.Stat(file.Path); os.IsNotExist(err) {
+			log.Printf("Moved %v to %v", file.Path, path)
+			return s.updatePath(key, path)
+		}
+		return nil
+	}
+
+	keys, err := s.filesAt(path, false)
+	if err != nil {
+		return err
+	}
+	if len(keys) > 0 {
+		log.Printf("Updating changed file %v", path)
+		err = s.db.ReplaceContent(keys[0], f.Hash, rawData, content)
+		if err != nil {
+			return err
+		}
+		return s.reindex(keys[0])
+	}
+
+	log.Printf("Adding new file %v", path)
+	_, err = s.addDocument(f, content, rawData)
+	return err
+}
+
+func (s *server) removePath(path string, isDir bool) error {
+	keys, err := s.filesAt(path, isDir)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		log.Printf("Removing document %v, source %v was deleted", key, path)
+		err = s.removeDocument(key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// movePath updates the paths of the documents stored from oldPath. It reports
+// whether there were any, a file without has to be ingested.
+func (s *server) movePath(oldPath, path string, isDir bool) (bool, error) {
+	keys, err := s.filesAt(oldPath, isDir)
+	if err != nil {
+		return false, err
+	}
+	if len(keys) == 0 && !isDir {
+		return false, nil
+	}
+	for _, key := range keys {
+		file, err := s.db.GetFile(key)
+		if err != nil {
+			return true, err
+		}
+		err = s.updatePath(key, path+strings.TrimPrefix(file.Path, oldPath))
+		if err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+func (s *server) updatePath(key uint64, path string) error {
+	err := s.db.UpdateFile(key, func(f *db.DBFile) error {
+		// moving into or out of a private folder changes the owner
+		if owner := s.ownerOf(path); owner != s.ownerOf(f.Path) {
+			f.Owner = owner
+			f.SharedWith = nil
+		}
+		f.Path = path
+		f.Name = filepath.Base(path)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// the filename is part of the search result
+	return s.applyJournal()
+}
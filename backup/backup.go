@@ -0,0 +1,461 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"time"
+
+	"github.com/reusing-code/dochan/blob"
+	"github.com/reusing-code/dochan/classifier"
+	"github.com/reusing-code/dochan/db"
+	"github.com/reusing-code/dochan/refuel"
+	"github.com/reusing-code/dochan/users"
+)
+
+// Version of the archive format, version 2 added users and classifier samples
+const Version = 2
+
+const (
+	manifestName = "manifest.json"
+	blobDir      = "blobs"
+)
+
+var ErrNotEmpty = errors.New("archive is not empty, restore needs merging")
+
+// Manifest describes the content of an archive. It is stored as first entry
+// of the gzip compressed tar file, followed by the raw file data of the
+// documents named by their SHA-256 hash. The classifier is restored by
+// training it with the documents marked as trained.
+//
+// Server settings are flags and environment variables of the deployment, they
+// are not part of the archive, nor are sessions and API tokens. The users are,
+// with their password hashes and second factor secrets.
+type Manifest struct {
+	Version   int                   `json:"version"`
+	Created   time.Time             `json:"created"`
+	Documents []Document            `json:"documents"`
+	Purged    []string              `json:"purged"`
+	Fuel      []refuel.RefuelRecord `json:"fuel"`
+	Users     []User                `json:"users"`
+}
+
+type Document struct {
+	ID            uint64    `json:"id"`
+	Name          string    `json:"name"`
+	Path          string    `json:"path"`
+	Hash          string    `json:"hash"`
+	Blob          string    `json:"blob"`
+	Size          int64     `json:"size"`
+	ImportDate    time.Time `json:"importDate"`
+	Content       []string  `json:"content"`
+	Type          string    `json:"type"`
+	Tags          []string  `json:"tags"`
+	DuplicateOf   uint64    `json:"duplicateOf,omitempty"`
+	Tombstoned    time.Time `json:"tombstoned"`
+	Title         string    `json:"title"`
+	DocumentDate  time.Time `json:"documentDate"`
+	Correspondent string    `json:"correspondent"`
+	Notes         string    `json:"notes"`
+	Deleted       time.Time `json:"deleted"`
+	Owner         string    `json:"owner,omitempty"`
+	SharedWith    []string  `json:"sharedWith,omitempty"`
+	// the type and tags are a training sample of the classifier
+	Trained bool `json:"trained,omitempty"`
+}
+
+type User struct {
+	Name          string     `json:"name"`
+	Role          users.Role `json:"role"`
+	Created       time.Time  `json:"created"`
+	PasswordHash  []byte     `json:"passwordHash"`
+	TOTPEnabled   bool       `json:"totpEnabled"`
+	TOTPRequired  bool       `json:"totpRequired"`
+	TOTPSecret    []byte     `json:"totpSecret,omitempty"`
+	TOTPLast      int64      `json:"totpLast,omitempty"`
+	RecoveryCodes [][]byte   `json:"recoveryCodes,omitempty"`
+}
+
+// Sources are the stores exported to and restored from an archive, all but
+// Documents may be nil
+type Sources struct {
+	Documents  *db.DB
+	Fuel       *refuel.DB
+	Users      *users.Store
+	Classifier *classifier.Classifier
+}
+
+type Options struct {
+	// Add to an archive that already has documents, documents with a known
+	// hash are skipped
+	Merge bool
+}
+
+type Report struct {
+	// keys of the restored documents
+	Documents []uint64 `json:"documents"`
+	Skipped   int      `json:"skipped"`
+	Fuel      int      `json:"fuel"`
+	// users added or replaced
+	Users int `json:"users"`
+}
+
+func fromDB(key uint64, f *db.DBFile) Document {
+	return Document{key, f.Name, f.Path, f.Hash, f.Blob, f.Size, f.ImportDate, f.Content, f.Type, f.Tags,
+		f.DuplicateOf, f.Tombstoned, f.Title, f.DocumentDate, f.Correspondent, f.Notes, f.Deleted, f.Owner, f.SharedWith, false}
+}
+
+func fromUser(u *users.User) User {
+	return User{u.Name, u.Role, u.Created, u.PasswordHash, u.TOTPEnabled, u.TOTPRequired, u.TOTPSecret, u.TOTPLast, u.RecoveryCodes}
+}
+
+func (u *User) toUser() *users.User {
+	return &users.User{Name: u.Name, Role: u.Role, Created: u.Created, PasswordHash: u.PasswordHash,
+		TOTPEnabled: u.TOTPEnabled, TOTPRequired: u.TOTPRequired, TOTPSecret: u.TOTPSecret, TOTPLast: u.TOTPLast,
+		RecoveryCodes: u.RecoveryCodes}
+}
+
+func (d *Document) toDB() db.DBFile {
+	return db.DBFile{Name: d.Name, Path: d.Path, Hash: d.Hash, Blob: d.Blob, Size: d.Size, ImportDate: d.ImportDate,
+		Content: d.Content, Type: d.Type, Tags: d.Tags, Tombstoned: d.Tombstoned, Title: d.Title,
+		DocumentDate: d.DocumentDate, Correspondent: d.Correspondent, Notes: d.Notes, Deleted: d.Deleted,
+		Owner: d.Owner, SharedWith: d.SharedWith}
+}
+
+// Snapshot is the content of the stores at the time it was taken. The raw
+// file data of its documents is kept until Close, so it can be written while
+// documents are changed and purged.
+type Snapshot struct {
+	Manifest *Manifest
+	d        *db.DB
+	unpin    func() error
+}
+
+// NewSnapshot reads the metadata of all documents, fuel records and users.
+// Close has to be called after writing it.
+func NewSnapshot(src Sources) (*Snapshot, error) {
+	d := src.Documents
+	m := &Manifest{Version: Version, Created: time.Now(), Documents: []Document{}, Fuel: []refuel.RefuelRecord{}, Users: []User{}}
+	snap := &Snapshot{m, d, d.PinBlobs()}
+	err := d.GetAllFiles(func(key uint64, file db.DBFile) {
+		doc := fromDB(key, &file)
+		doc.Trained = src.Classifier != nil && src.Classifier.IsTrained(key)
+		m.Documents = append(m.Documents, doc)
+	})
+	if err == nil {
+		m.Purged, err = d.PurgedHashes()
+	}
+	if err == nil && src.Fuel != nil {
+		err = src.Fuel.GetAllFuelRecords(func(key uint64, record *refuel.RefuelRecord) {
+			m.Fuel = append(m.Fuel, *record)
+		})
+	}
+	if err == nil && src.Users != nil {
+		var list []users.User
+		list, err = src.Users.List()
+		for i := range list {
+			m.Users = append(m.Users, fromUser(&list[i]))
+		}
+	}
+	if err != nil {
+		snap.Close()
+		return nil, err
+	}
+	return snap, nil
+}
+
+// Close releases the raw file data of purged documents
+func (s *Snapshot) Close() error {
+	return s.unpin()
+}
+
+// Write writes the archive to w. The raw data is checked against its hash.
+func (s *Snapshot) Write(w io.Writer) error {
+	m := s.Manifest
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	js, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = writeEntry(tw, manifestName, m.Created, bytes.NewReader(js), int64(len(js)))
+	if err != nil {
+		return err
+	}
+	written := make(map[string]bool)
+	for _, doc := range m.Documents {
+		if written[doc.Blob] {
+			continue
+		}
+		written[doc.Blob] = true
+		err = exportBlob(tw, s.d, &doc)
+		if err != nil {
+			return err
+		}
+	}
+	err = tw.Close()
+	if err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// Export writes all documents with their raw file data, fuel records and
+// users to w
+func Export(w io.Writer, src Sources) (*Manifest, error) {
+	snap, err := NewSnapshot(src)
+	if err != nil {
+		return nil, err
+	}
+	defer snap.Close()
+	return snap.Manifest, snap.Write(w)
+}
+
+func exportBlob(tw *tar.Writer, d *db.DB, doc *Document) error {
+	b, err := d.Blobs.Open(doc.Blob)
+	if err != nil {
+		return fmt.Errorf("raw data of document %v: %v", doc.ID, err)
+	}
+	defer b.Close()
+	data, err := ioutil.ReadAll(b)
+	if err != nil {
+		return err
+	}
+	if blob.Hash(data) != doc.Blob {
+		return fmt.Errorf("raw data of document %v does not match its hash", doc.ID)
+	}
+	return writeEntry(tw, path.Join(blobDir, doc.Blob), doc.ImportDate, bytes.NewReader(data), int64(len(data)))
+}
+
+func writeEntry(tw *tar.Writer, name string, modTime time.Time, r io.Reader, size int64) error {
+	err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: size, ModTime: modTime, Typeflag: tar.TypeReg})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, r)
+	return err
+}
+
+// reader iterates over the raw file data of an archive after reading its manifest
+type reader struct {
+	tr       *tar.Reader
+	manifest *Manifest
+	// documents by the hash of their raw data
+	blobs map[string][]*Document
+}
+
+func newReader(r io.Reader) (*reader, error) {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(gr)
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, err
+	}
+	if hdr.Name != manifestName {
+		return nil, fmt.Errorf("archive starts with %q instead of the manifest", hdr.Name)
+	}
+	m := &Manifest{}
+	err = json.NewDecoder(tr).Decode(m)
+	if err != nil {
+		return nil, err
+	}
+	if m.Version < 1 || m.Version > Version {
+		return nil, fmt.Errorf("unsupported archive version %d", m.Version)
+	}
+	res := &reader{tr: tr, manifest: m, blobs: make(map[string][]*Document)}
+	for i := range m.Documents {
+		doc := &m.Documents[i]
+		res.blobs[doc.Blob] = append(res.blobs[doc.Blob], doc)
+	}
+	return res, nil
+}
+
+// next returns the next raw file data after checking it against the hashes of
+// the documents using it, io.EOF after the last one
+func (r *reader) next() ([]byte, []*Document, error) {
+	hdr, err := r.tr.Next()
+	if err != nil {
+		return nil, nil, err
+	}
+	hash := path.Base(hdr.Name)
+	docs, ok := r.blobs[hash]
+	if path.Dir(hdr.Name) != blobDir || !ok {
+		return nil, nil, fmt.Errorf("unexpected archive entry %q", hdr.Name)
+	}
+	data, err := ioutil.ReadAll(r.tr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if blob.Hash(data) != hash {
+		return nil, nil, fmt.Errorf("raw data %v does not match its hash", hash)
+	}
+	sum := sha1.Sum(data)
+	for _, doc := range docs {
+		if doc.Hash != "" && doc.Hash != hex.EncodeToString(sum[:]) {
+			return nil, nil, fmt.Errorf("raw data of document %v does not match its hash", doc.ID)
+		}
+	}
+	delete(r.blobs, hash)
+	return data, docs, nil
+}
+
+// missing returns an error if the raw data of any document wasn't read
+func (r *reader) missing() error {
+	for hash, docs := range r.blobs {
+		return fmt.Errorf("raw data %v of document %v missing in archive", hash, docs[0].ID)
+	}
+	return nil
+}
+
+// Verify checks that an archive is complete and all raw file data matches
+// its hashes
+func Verify(r io.Reader) (*Manifest, error) {
+	ar, err := newReader(r)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		_, _, err = ar.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ar.manifest, ar.missing()
+}
+
+// Restore adds the content of an archive to the stores. Without merging the
+// documents have to be empty and users of the archive replace existing ones of
+// the same name, merging keeps existing users.
+func Restore(r io.Reader, src Sources, opts Options) (*Report, error) {
+	d, fuel := src.Documents, src.Fuel
+	if !opts.Merge {
+		empty := true
+		err := d.GetAllFiles(func(key uint64, file db.DBFile) { empty = false })
+		if err != nil {
+			return nil, err
+		}
+		if !empty {
+			return nil, ErrNotEmpty
+		}
+	}
+	ar, err := newReader(r)
+	if err != nil {
+		return nil, err
+	}
+	report := &Report{Documents: []uint64{}}
+	keys := make(map[uint64]uint64)
+	restored := make(map[uint64]bool)
+	for {
+		data, docs, err := ar.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return report, err
+		}
+		for _, doc := range docs {
+			key, err := d.ImportFile(doc.toDB(), data)
+			if err == db.ErrDuplicate {
+				report.Skipped++
+				if existing, ok := d.KeyByHash(doc.Owner, doc.Hash); ok {
+					keys[doc.ID] = existing
+				}
+				continue
+			}
+			if err != nil {
+				return report, err
+			}
+			keys[doc.ID] = key
+			restored[doc.ID] = true
+			report.Documents = append(report.Documents, key)
+		}
+	}
+	err = ar.missing()
+	if err != nil {
+		return report, err
+	}
+
+	if src.Classifier != nil {
+		for _, doc := range ar.manifest.Documents {
+			// version 1 archives don't tell, documents with labels were confirmed
+			trained := doc.Trained || (ar.manifest.Version < 2 && (doc.Type != "" || len(doc.Tags) > 0))
+			if !trained || !restored[doc.ID] {
+				continue
+			}
+			err = src.Classifier.Train(keys[doc.ID], doc.Type, doc.Tags, doc.Content)
+			if err != nil {
+				return report, err
+			}
+		}
+	}
+	if src.Users != nil {
+		for i := range ar.manifest.Users {
+			stored, err := src.Users.Import(ar.manifest.Users[i].toUser(), !opts.Merge)
+			if err != nil {
+				return report, fmt.Errorf("user %q: %v", ar.manifest.Users[i].Name, err)
+			}
+			if stored {
+				report.Users++
+			}
+		}
+	}
+
+	// keys change, so links between documents are restored afterwards
+	for _, doc := range ar.manifest.Documents {
+		if doc.DuplicateOf == 0 || !restored[doc.ID] {
+			continue
+		}
+		err = d.UpdateFile(keys[doc.ID], func(f *db.DBFile) error {
+			f.DuplicateOf = keys[doc.DuplicateOf]
+			return nil
+		})
+		if err != nil {
+			return report, err
+		}
+	}
+	for _, hash := range ar.manifest.Purged {
+		err = d.SetPurged(hash)
+		if err != nil {
+			return report, err
+		}
+	}
+	if fuel != nil {
+		before, err := countFuel(fuel)
+		if err != nil {
+			return report, err
+		}
+		// duplicates are skipped by AddFuelRecord
+		for i := range ar.manifest.Fuel {
+			err = fuel.AddFuelRecord(&ar.manifest.Fuel[i])
+			if err != nil {
+				return report, err
+			}
+		}
+		after, err := countFuel(fuel)
+		if err != nil {
+			return report, err
+		}
+		report.Fuel = after - before
+	}
+	return report, nil
+}
+
+func countFuel(fuel *refuel.DB) (int, error) {
+	count := 0
+	err := fuel.GetAllFuelRecords(func(key uint64, record *refuel.RefuelRecord) { count++ })
+	return count, err
+}
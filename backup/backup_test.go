@@ -0,0 +1,221 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/reusing-code/dochan/classifier"
+	"github.com/reusing-code/dochan/db"
+	"github.com/reusing-code/dochan/refuel"
+	"github.com/reusing-code/dochan/users"
+)
+
+func openDB(t *testing.T, name string) *db.DB {
+	d, err := db.New(name + ".db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func cleanup(name string) {
+	os.Remove(name + ".db")
+	os.RemoveAll(name + ".blobs")
+	os.Remove(name + ".fuel.db")
+	os.Remove(name + ".session.db")
+	os.Remove(name + ".classifier.db")
+}
+
+// openSources opens all stores of an archive, the returned function closes them
+func openSources(t *testing.T, name string) (Sources, func()) {
+	d := openDB(t, name)
+	fuel, err := refuel.New(name + ".fuel.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handle, err := bolt.Open(name+".session.db", 0644, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := users.New(handle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := classifier.New(name + ".classifier.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Sources{d, fuel, store, c}, func() {
+		c.Close()
+		handle.Close()
+		fuel.Close()
+		d.Close()
+	}
+}
+
+func addFile(t *testing.T, d *db.DB, path string, content string) uint64 {
+	sum := sha1.Sum([]byte(content))
+	key, err := d.AddFile(path, hex.EncodeToString(sum[:]), []byte(content), []string{content})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestExportRestore(t *testing.T) {
+	defer cleanup("test")
+	defer cleanup("restore")
+	srcSources, closeSrc := openSources(t, "test")
+	defer closeSrc()
+	src, fuel := srcSources.Documents, srcSources.Fuel
+
+	keyA := addFile(t, src, "a.pdf", "first document")
+	keyB := addFile(t, src, "b.pdf", "second document")
+	keyC := addFile(t, src, "c.pdf", "purged document")
+	src.UpdateFile(keyA, func(f *db.DBFile) error {
+		f.Type = "invoice"
+		f.Tags = []string{"car"}
+		f.Title = "Insurance"
+		return nil
+	})
+	src.UpdateFile(keyB, func(f *db.DBFile) error {
+		f.DuplicateOf = keyA
+		f.Deleted = time.Now()
+		return nil
+	})
+	src.PurgeFile(keyC)
+	fuel.AddFuelRecord(&refuel.RefuelRecord{Date: time.Now(), CostCent: 5000, TotalKM: 1000})
+	srcSources.Users.Add("alice", "password1", users.Admin)
+	srcSources.Users.Add("bob", "password2", users.Member)
+	srcSources.Classifier.Train(keyA, "invoice", []string{"car"}, []string{"first document"})
+
+	var buf bytes.Buffer
+	m, err := Export(&buf, srcSources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Documents) != 2 || len(m.Purged) != 1 || len(m.Fuel) != 1 || len(m.Users) != 2 || !m.Documents[0].Trained {
+		t.Errorf("Unexpected manifest %+v", m)
+	}
+	_, err = Verify(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dstSources, closeDst := openSources(t, "restore")
+	defer closeDst()
+	dst := dstSources.Documents
+	dstSources.Users.Add("alice", "other", users.Admin)
+	dst.AddFile("other.pdf", "other", []byte("other"), []string{"other"})
+	_, err = Restore(bytes.NewReader(buf.Bytes()), dstSources, Options{})
+	if err != ErrNotEmpty {
+		t.Errorf("Want ErrNotEmpty, got %v", err)
+	}
+
+	report, err := Restore(bytes.NewReader(buf.Bytes()), dstSources, Options{Merge: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Documents) != 2 || report.Skipped != 0 || report.Fuel != 1 || report.Users != 1 {
+		t.Errorf("Unexpected report %+v", report)
+	}
+	if _, err = dstSources.Users.Authenticate("bob", "password2"); err != nil {
+		t.Errorf("User not restored: %v", err)
+	}
+	if _, err = dstSources.Users.Authenticate("alice", "other"); err != nil {
+		t.Errorf("Existing user replaced while merging: %v", err)
+	}
+	if !dstSources.Classifier.IsTrained(report.Documents[0]) || dstSources.Classifier.IsTrained(report.Documents[1]) {
+		t.Error("Classifier samples not restored")
+	}
+	a, _ := dst.GetFile(report.Documents[0])
+	b, _ := dst.GetFile(report.Documents[1])
+	raw, _ := dst.ReadRaw(a)
+	if a.Title != "Insurance" || a.Type != "invoice" || len(a.Tags) != 1 || string(raw) != "first document" {
+		t.Errorf("Metadata not restored: %+v", a)
+	}
+	if b.DuplicateOf != report.Documents[0] || b.Deleted.IsZero() {
+		t.Errorf("Duplicate link or trash not restored: %v %v", b.DuplicateOf, b.Deleted)
+	}
+	if !dst.IsPurged("", m.Purged[0]) {
+		t.Error("Purged hash not restored")
+	}
+
+	report, err = Restore(bytes.NewReader(buf.Bytes()), dstSources, Options{Merge: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Documents) != 0 || report.Skipped != 2 || report.Fuel != 0 || report.Users != 0 {
+		t.Errorf("Unexpected report merging again %+v", report)
+	}
+}
+
+// rewrite copies an archive, changing the data of entries with modify
+func rewrite(t *testing.T, archive []byte, modify func(hdr *tar.Header, data []byte) []byte) []byte {
+	gr, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gr)
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		data := make([]byte, hdr.Size)
+		io.ReadFull(tr, data)
+		data = modify(hdr, data)
+		if data == nil {
+			continue
+		}
+		hdr.Size = int64(len(data))
+		tw.WriteHeader(hdr)
+		tw.Write(data)
+	}
+	tw.Close()
+	gw.Close()
+	return buf.Bytes()
+}
+
+func TestVerify(t *testing.T) {
+	defer cleanup("test")
+	src := openDB(t, "test")
+	defer src.Close()
+	addFile(t, src, "a.pdf", "first document")
+
+	var buf bytes.Buffer
+	_, err := Export(&buf, Sources{Documents: src})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	corrupt := rewrite(t, buf.Bytes(), func(hdr *tar.Header, data []byte) []byte {
+		if hdr.Name != manifestName {
+			data[0] = 'F'
+		}
+		return data
+	})
+	if _, err = Verify(bytes.NewReader(corrupt)); err == nil {
+		t.Error("Expected error for corrupt raw data")
+	}
+	incomplete := rewrite(t, buf.Bytes(), func(hdr *tar.Header, data []byte) []byte {
+		if hdr.Name != manifestName {
+			return nil
+		}
+		return data
+	})
+	if _, err = Verify(bytes.NewReader(incomplete)); err == nil {
+		t.Error("Expected error for missing raw data")
+	}
+}
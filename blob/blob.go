@@ -0,0 +1,66 @@
+package blob
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+)
+
+var ErrNotFound = errors.New("blob not found")
+
+// Store keeps file contents addressed by the hex encoded SHA-256 hash of
+// their data. Storing the same data twice keeps a single copy.
+type Store interface {
+	// Put stores the data read from r and returns its hash
+	Put(r io.Reader) (string, error)
+	// Open returns the data with the given hash, ErrNotFound if there is none
+	Open(hash string) (Blob, error)
+	// Delete removes the data with the given hash, unknown hashes are ignored
+	Delete(hash string) error
+}
+
+// Cipher encrypts blobs at rest
+type Cipher interface {
+	Encrypt(plain []byte) ([]byte, error)
+	// Decrypt returns data stored without encryption unchanged
+	Decrypt(data []byte) ([]byte, error)
+}
+
+type Blob interface {
+	io.ReadSeeker
+	io.Closer
+	Size() int64
+}
+
+// Hash returns the hash data is stored under
+func Hash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// ValidHash reports whether hash is a hex encoded SHA-256 hash
+func ValidHash(hash string) bool {
+	if len(hash) != hex.EncodedLen(sha256.Size) {
+		return false
+	}
+	for _, c := range hash {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// ReadAll returns the complete data of a blob
+func ReadAll(s Store, hash string) ([]byte, error) {
+	b, err := s.Open(hash)
+	if err != nil {
+		return nil, err
+	}
+	defer b.Close()
+	buf := bytes.NewBuffer(make([]byte, 0, b.Size()))
+	_, err = io.Copy(buf, b)
+	return buf.Bytes(), err
+}
@@ -0,0 +1,147 @@
+package blob
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+var tempDir string = "temp/"
+
+func TestFileStore(t *testing.T) {
+	defer os.RemoveAll(tempDir)
+	s, err := NewFileStore(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte("some document data")
+	hash, err := s.Put(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash != Hash(data) {
+		t.Errorf("Want hash %v, got %v", Hash(data), hash)
+	}
+	again, err := s.Put(bytes.NewReader(data))
+	if err != nil || again != hash {
+		t.Errorf("Storing the same data again failed: %v %v", again, err)
+	}
+
+	b, err := s.Open(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Size() != int64(len(data)) {
+		t.Errorf("Want size %v, got %v", len(data), b.Size())
+	}
+	b.Seek(5, io.SeekStart)
+	rest, _ := ioutil.ReadAll(b)
+	b.Close()
+	if string(rest) != "document data" {
+		t.Errorf("Wrong data after seeking: %q", rest)
+	}
+	all, err := ReadAll(s, hash)
+	if err != nil || !bytes.Equal(all, data) {
+		t.Errorf("Wrong data read: %q %v", all, err)
+	}
+
+	err = s.Delete(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Open(hash)
+	if err != ErrNotFound {
+		t.Errorf("Want ErrNotFound for deleted blob, got %v", err)
+	}
+	_, err = s.Open("../../etc/passwd")
+	if err != ErrNotFound {
+		t.Errorf("Want ErrNotFound for invalid hash, got %v", err)
+	}
+}
+
+// xorCipher marks and scrambles data, enough to tell stored data from plain data
+type xorCipher struct{}
+
+func (xorCipher) Encrypt(plain []byte) ([]byte, error) {
+	data := []byte("enc:")
+	for _, b := range plain {
+		data = append(data, b^0x55)
+	}
+	return data, nil
+}
+
+func (xorCipher) Decrypt(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte("enc:")) {
+		return data, nil
+	}
+	plain := []byte{}
+	for _, b := range data[4:] {
+		plain = append(plain, b^0x55)
+	}
+	return plain, nil
+}
+
+func TestEncryptedFileStore(t *testing.T) {
+	defer os.RemoveAll(tempDir)
+	plainStore, err := NewFileStore(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := []byte("stored before encryption")
+	legacyHash, err := plainStore.Put(bytes.NewReader(legacy))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewEncryptedFileStore(tempDir, xorCipher{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("secret document data")
+	hash, err := s.Put(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash != Hash(data) {
+		t.Errorf("Want hash of plain data %v, got %v", Hash(data), hash)
+	}
+	stored, _ := ioutil.ReadFile(s.path(hash))
+	if bytes.Contains(stored, data) {
+		t.Errorf("Data stored unencrypted: %q", stored)
+	}
+
+	b, err := s.Open(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Size() != int64(len(data)) {
+		t.Errorf("Want size %v, got %v", len(data), b.Size())
+	}
+	b.Seek(7, io.SeekStart)
+	rest, _ := ioutil.ReadAll(b)
+	b.Close()
+	if string(rest) != "document data" {
+		t.Errorf("Wrong data after seeking: %q", rest)
+	}
+
+	all, err := ReadAll(s, legacyHash)
+	if err != nil || !bytes.Equal(all, legacy) {
+		t.Errorf("Wrong unencrypted data read: %q %v", all, err)
+	}
+	// storing again encrypts existing plain data
+	_, err = s.Put(bytes.NewReader(legacy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, _ = ioutil.ReadFile(s.path(legacyHash))
+	if !bytes.HasPrefix(stored, []byte("enc:")) {
+		t.Errorf("Existing blob not encrypted: %q", stored)
+	}
+	_, err = s.Open(Hash([]byte("missing")))
+	if err != ErrNotFound {
+		t.Errorf("Want ErrNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,169 @@
+package blob
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// FileStore stores blobs as files below a directory, fanned out into
+// subdirectories by the first two characters of their hash
+type FileStore struct {
+	dir    string
+	cipher Cipher
+}
+
+func NewFileStore(dir string) (*FileStore, error) {
+	return NewEncryptedFileStore(dir, nil)
+}
+
+// NewEncryptedFileStore returns a FileStore encrypting the data of its blobs
+// with c. Blobs are still addressed by the hash of their plain data. Blobs are
+// decrypted into memory when opened.
+func NewEncryptedFileStore(dir string, c Cipher) (*FileStore, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &FileStore{dir, c}, nil
+}
+
+func (s *FileStore) path(hash string) string {
+	return filepath.Join(s.dir, hash[:2], hash)
+}
+
+func (s *FileStore) Put(r io.Reader) (string, error) {
+	if s.cipher != nil {
+		return s.putEncrypted(r)
+	}
+	tmp, err := ioutil.TempFile(s.dir, ".put-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, h), r)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	tmp.Close()
+	if err != nil {
+		return "", err
+	}
+	hash := hex.EncodeToString(h.Sum(nil))
+
+	path := s.path(hash)
+	if _, err := os.Stat(path); err == nil {
+		return hash, nil
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return "", err
+	}
+	return hash, os.Rename(tmp.Name(), path)
+}
+
+// putEncrypted always replaces an existing blob, so storing it again encrypts
+// it with the current key
+func (s *FileStore) putEncrypted(r io.Reader) (string, error) {
+	plain, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	hash := Hash(plain)
+	data, err := s.cipher.Encrypt(plain)
+	if err != nil {
+		return "", err
+	}
+	tmp, err := ioutil.TempFile(s.dir, ".put-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	tmp.Close()
+	if err != nil {
+		return "", err
+	}
+	path := s.path(hash)
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return "", err
+	}
+	return hash, os.Rename(tmp.Name(), path)
+}
+
+type file struct {
+	*os.File
+	size int64
+}
+
+func (f *file) Size() int64 {
+	return f.size
+}
+
+type memBlob struct {
+	*bytes.Reader
+}
+
+func (memBlob) Close() error {
+	return nil
+}
+
+func (s *FileStore) Open(hash string) (Blob, error) {
+	if !ValidHash(hash) {
+		return nil, ErrNotFound
+	}
+	if s.cipher != nil {
+		data, err := ioutil.ReadFile(s.path(hash))
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+		data, err = s.cipher.Decrypt(data)
+		if err != nil {
+			return nil, fmt.Errorf("decrypt blob %v: %v", hash, err)
+		}
+		return memBlob{bytes.NewReader(data)}, nil
+	}
+	f, err := os.Open(s.path(hash))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &file{f, info.Size()}, nil
+}
+
+func (s *FileStore) Delete(hash string) error {
+	if !ValidHash(hash) {
+		return nil
+	}
+	err := os.Remove(s.path(hash))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,167 @@
+// Package certs serves TLS certificates from files, reloading them when they
+// change, and creates self-signed certificates for a first start.
+package certs
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// validity of self-signed certificates
+const selfSignedValidity = 5 * 365 * 24 * time.Hour
+
+// Reloader holds the certificate of a certificate and key file
+type Reloader struct {
+	certFile string
+	keyFile  string
+
+	mtx        sync.RWMutex
+	cert       *tls.Certificate
+	selfSigned bool
+	modified   time.Time
+}
+
+// NewReloader loads the certificate and key files
+func NewReloader(certFile, keyFile string) (*Reloader, error) {
+	r := &Reloader{certFile: certFile, keyFile: keyFile}
+	err := r.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload reads the files again, the previous certificate stays in use if they are invalid
+func (r *Reloader) Reload() error {
+	modified := r.lastModified()
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	cert.Leaf = leaf
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.cert = &cert
+	r.selfSigned = bytes.Equal(leaf.RawIssuer, leaf.RawSubject)
+	r.modified = modified
+	return nil
+}
+
+// Changed reports whether the files were modified since they were loaded
+func (r *Reloader) Changed() bool {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	return !r.lastModified().Equal(r.modified)
+}
+
+// Watch reloads the files when they change until done is closed, errors are
+// passed to onError
+func (r *Reloader) Watch(interval time.Duration, done <-chan struct{}, onError func(err error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if !r.Changed() {
+				continue
+			}
+			err := r.Reload()
+			if err != nil {
+				onError(err)
+			}
+		}
+	}
+}
+
+// lastModified returns the latest modification time of both files, zero if
+// one can't be read
+func (r *Reloader) lastModified() time.Time {
+	var latest time.Time
+	for _, path := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+// GetCertificate can be used as tls.Config.GetCertificate
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	return r.cert, nil
+}
+
+// SelfSigned reports whether the current certificate is self-signed, browsers
+// don't trust it without an exception
+func (r *Reloader) SelfSigned() bool {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	return r.selfSigned
+}
+
+// GenerateSelfSigned writes a new self-signed certificate for the hosts, which
+// may be names or IP addresses, and its key
+func GenerateSelfSigned(certFile, keyFile string, hosts []string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"dochan"}, CommonName: hosts[0]},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	// the key first, a certificate without key would be used on the next start
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
@@ -0,0 +1,74 @@
+package certs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+
+	err = GenerateSelfSigned(certFile, keyFile, []string{"localhost", "127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.SelfSigned() {
+		t.Error("Generated certificate not self-signed")
+	}
+	cert, _ := r.GetCertificate(nil)
+	if err = cert.Leaf.VerifyHostname("127.0.0.1"); err != nil {
+		t.Error(err)
+	}
+	if err = cert.Leaf.VerifyHostname("localhost"); err != nil {
+		t.Error(err)
+	}
+	if r.Changed() {
+		t.Error("Changed without modification")
+	}
+
+	err = GenerateSelfSigned(certFile, keyFile, []string{"example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	if !r.Changed() {
+		t.Fatal("Modification not detected")
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		r.Watch(time.Millisecond, done, func(err error) { t.Error(err) })
+		close(stopped)
+	}()
+	for i := 0; i < 1000 && r.Changed(); i++ {
+		time.Sleep(time.Millisecond)
+	}
+	close(done)
+	<-stopped
+	cert, _ = r.GetCertificate(nil)
+	if err = cert.Leaf.VerifyHostname("example.com"); err != nil {
+		t.Errorf("Certificate not reloaded: %v", err)
+	}
+
+	ioutil.WriteFile(keyFile, []byte("invalid"), 0600)
+	if err = r.Reload(); err == nil {
+		t.Error("Invalid key loaded")
+	}
+	if c, _ := r.GetCertificate(nil); c != cert {
+		t.Error("Certificate replaced by invalid one")
+	}
+}
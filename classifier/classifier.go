@@ -0,0 +1,548 @@
+package classifier
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/reusing-code/dochan/crypt"
+	"github.com/reusing-code/dochan/searchTree"
+)
+
+// Document types the classifier is expected to learn. Other types are
+// accepted as well, these are only used as a hint for clients.
+var DocumentTypes = []string{"invoice", "contract", "payslip", "tax notice"}
+
+// TagThreshold is the minimum confidence for a tag to be part of an accepted suggestion
+const TagThreshold = 0.5
+
+const (
+	sampleBucket     = "samples"
+	modelBucket      = "model"
+	modelKey         = "model"
+	suggestionBucket = "suggestions"
+)
+
+var ErrEncrypted = errors.New("classifier DB is encrypted, a passphrase or key file is required")
+
+// Cipher encrypts training samples, model and suggestions at rest, they are
+// derived from the text of the documents
+type Cipher interface {
+	Encrypt(plain []byte) ([]byte, error)
+	// Decrypt returns data stored without encryption unchanged
+	Decrypt(data []byte) ([]byte, error)
+}
+
+// Classifier is a multinomial naive Bayes classifier for document types
+// and tags. It is trained on confirmed documents only and persists
+// training samples, model and pending suggestions in a bolt DB.
+type Classifier struct {
+	Handle *bolt.DB
+	mtx    sync.RWMutex
+	model  *model
+	cipher Cipher
+}
+
+type Score struct {
+	Label      string  `json:"label"`
+	Confidence float64 `json:"confidence"`
+}
+
+type Suggestion struct {
+	Types []Score `json:"types"`
+	Tags  []Score `json:"tags"`
+}
+
+type Sample struct {
+	Type  string
+	Tags  []string
+	Terms map[string]int
+}
+
+type classStats struct {
+	Docs   int
+	Terms  int
+	Counts map[string]int
+}
+
+type model struct {
+	All   classStats
+	Types map[string]*classStats
+	Tags  map[string]*classStats
+}
+
+func New(path string) (*Classifier, error) {
+	return NewEncrypted(path, nil)
+}
+
+// NewEncrypted opens the classifier DB at path like New, its records are
+// encrypted with c unless it is nil, e.g. with the keys of the documents DB.
+// Records stored before encryption was enabled are encrypted on opening.
+func NewEncrypted(path string, c Cipher) (*Classifier, error) {
+	result := &Classifier{cipher: c}
+	var err error
+	result.Handle, err = bolt.Open(path, 0644, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = result.Handle.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{sampleBucket, modelBucket, suggestionBucket} {
+			_, err := tx.CreateBucketIfNotExists([]byte(name))
+			if err != nil {
+				return fmt.Errorf("create bucket %q: %q", name, err)
+			}
+		}
+		return nil
+	})
+	if err == nil && c != nil {
+		err = result.reseal(false)
+	}
+	if err == nil {
+		result.model, err = result.loadModel()
+	}
+	if err != nil {
+		result.Handle.Close()
+		return nil, err
+	}
+	return result, nil
+}
+
+func (c *Classifier) Close() error {
+	if c != nil && c.Handle != nil {
+		return c.Handle.Close()
+	}
+	return errors.New("No DB")
+}
+
+// Terms returns the term frequencies of the given content as used for training and classification
+func Terms(content []string) map[string]int {
+	result := make(map[string]int)
+	for _, str := range content {
+		for _, token := range searchTree.Tokenize(str) {
+			result[token]++
+		}
+	}
+	return result
+}
+
+// IsTrained reports whether the document with the given key is part of the training data
+func (c *Classifier) IsTrained(key uint64) bool {
+	found := false
+	c.Handle.View(func(tx *bolt.Tx) error {
+		found = tx.Bucket([]byte(sampleBucket)).Get(itob(key)) != nil
+		return nil
+	})
+	return found
+}
+
+// Train adds the document with the given key and its confirmed labels to the
+// training data. A previous sample of the same document is replaced.
+func (c *Classifier) Train(key uint64, docType string, tags []string, content []string) error {
+	sample := &Sample{Type: docType, Tags: tags, Terms: Terms(content)}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	next := c.model.clone()
+	err := c.Handle.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(sampleBucket))
+		old, err := c.decodeSample(bucket.Get(itob(key)))
+		if err != nil {
+			return err
+		}
+		if old != nil {
+			next.remove(old)
+		}
+		next.add(sample)
+		err = c.putGob(bucket, itob(key), sample)
+		if err != nil {
+			return err
+		}
+		err = tx.Bucket([]byte(suggestionBucket)).Delete(itob(key))
+		if err != nil {
+			return err
+		}
+		return c.putGob(tx.Bucket([]byte(modelBucket)), []byte(modelKey), next)
+	})
+	if err != nil {
+		return err
+	}
+	c.model = next
+	return nil
+}
+
+// Forget removes the document with the given key from the training data
+func (c *Classifier) Forget(key uint64) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	next := c.model.clone()
+	err := c.Handle.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(sampleBucket))
+		old, err := c.decodeSample(bucket.Get(itob(key)))
+		if err != nil {
+			return err
+		}
+		err = tx.Bucket([]byte(suggestionBucket)).Delete(itob(key))
+		if err != nil {
+			return err
+		}
+		if old == nil {
+			return nil
+		}
+		next.remove(old)
+		err = bucket.Delete(itob(key))
+		if err != nil {
+			return err
+		}
+		return c.putGob(tx.Bucket([]byte(modelBucket)), []byte(modelKey), next)
+	})
+	if err != nil {
+		return err
+	}
+	c.model = next
+	return nil
+}
+
+// Suggest classifies the given content. Types are sorted by confidence and
+// sum up to 1, tags are scored independently of each other.
+func (c *Classifier) Suggest(content []string) Suggestion {
+	terms := Terms(content)
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	return Suggestion{Types: c.model.scoreTypes(terms), Tags: c.model.scoreTags(terms)}
+}
+
+func (c *Classifier) StoreSuggestion(key uint64, s Suggestion) error {
+	return c.Handle.Update(func(tx *bolt.Tx) error {
+		return c.putGob(tx.Bucket([]byte(suggestionBucket)), itob(key), &s)
+	})
+}
+
+// GetSuggestion returns the pending suggestion for a document, or nil if there is none
+func (c *Classifier) GetSuggestion(key uint64) (*Suggestion, error) {
+	var result *Suggestion
+	err := c.Handle.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(suggestionBucket)).Get(itob(key))
+		if b == nil {
+			return nil
+		}
+		result = &Suggestion{}
+		return c.decode(b, result)
+	})
+	if err != nil {
+		return nil, err
+	}
+	// gob drops empty slices
+	if result != nil && result.Types == nil {
+		result.Types = []Score{}
+	}
+	if result != nil && result.Tags == nil {
+		result.Tags = []Score{}
+	}
+	return result, nil
+}
+
+// Reject replaces the pending suggestion for a document with an empty one,
+// so it is not suggested again until the document is reclassified.
+func (c *Classifier) Reject(key uint64) error {
+	return c.StoreSuggestion(key, Suggestion{Types: []Score{}, Tags: []Score{}})
+}
+
+// Accepted returns the labels of a suggestion that would be applied when
+// confirming it without corrections.
+func (s Suggestion) Accepted() (docType string, tags []string) {
+	if len(s.Types) > 0 {
+		docType = s.Types[0].Label
+	}
+	tags = []string{}
+	for _, tag := range s.Tags {
+		if tag.Confidence >= TagThreshold {
+			tags = append(tags, tag.Label)
+		}
+	}
+	return
+}
+
+func (c *Classifier) loadModel() (*model, error) {
+	result := newModel()
+	var b []byte
+	err := c.Handle.View(func(tx *bolt.Tx) error {
+		b = tx.Bucket([]byte(modelBucket)).Get([]byte(modelKey))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return result, nil
+	}
+	err = c.decode(b, result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func newModel() *model {
+	return &model{
+		All:   classStats{Counts: make(map[string]int)},
+		Types: make(map[string]*classStats),
+		Tags:  make(map[string]*classStats),
+	}
+}
+
+func (m *model) clone() *model {
+	result := newModel()
+	result.All = *m.All.clone()
+	for k, v := range m.Types {
+		result.Types[k] = v.clone()
+	}
+	for k, v := range m.Tags {
+		result.Tags[k] = v.clone()
+	}
+	return result
+}
+
+func (m *model) add(s *Sample) {
+	m.All.add(s.Terms, 1)
+	if s.Type != "" {
+		stats(m.Types, s.Type).add(s.Terms, 1)
+	}
+	for _, tag := range s.Tags {
+		stats(m.Tags, tag).add(s.Terms, 1)
+	}
+}
+
+func (m *model) remove(s *Sample) {
+	m.All.add(s.Terms, -1)
+	if s.Type != "" {
+		removeStats(m.Types, s.Type, s.Terms)
+	}
+	for _, tag := range s.Tags {
+		removeStats(m.Tags, tag, s.Terms)
+	}
+}
+
+func stats(m map[string]*classStats, label string) *classStats {
+	s, ok := m[label]
+	if !ok {
+		s = &classStats{Counts: make(map[string]int)}
+		m[label] = s
+	}
+	return s
+}
+
+func removeStats(m map[string]*classStats, label string, terms map[string]int) {
+	s, ok := m[label]
+	if !ok {
+		return
+	}
+	s.add(terms, -1)
+	if s.Docs <= 0 {
+		delete(m, label)
+	}
+}
+
+func (s *classStats) clone() *classStats {
+	result := &classStats{Docs: s.Docs, Terms: s.Terms, Counts: make(map[string]int, len(s.Counts))}
+	for k, v := range s.Counts {
+		result.Counts[k] = v
+	}
+	return result
+}
+
+func (s *classStats) add(terms map[string]int, sign int) {
+	if s.Counts == nil {
+		s.Counts = make(map[string]int)
+	}
+	s.Docs += sign
+	for term, n := range terms {
+		s.Terms += sign * n
+		s.Counts[term] += sign * n
+		if s.Counts[term] <= 0 {
+			delete(s.Counts, term)
+		}
+	}
+}
+
+// logLikelihood uses Laplace smoothing over the whole vocabulary
+func (s *classStats) logLikelihood(terms map[string]int, vocabulary map[string]int) float64 {
+	result := 0.0
+	denom := math.Log(float64(s.Terms + len(vocabulary)))
+	for term, n := range terms {
+		if _, ok := vocabulary[term]; !ok {
+			continue
+		}
+		result += float64(n) * (math.Log(float64(s.Counts[term]+1)) - denom)
+	}
+	return result
+}
+
+// complementLogLikelihood is the logLikelihood of the documents not in s. Only
+// the counts of the given terms are derived from the totals, so it doesn't
+// depend on the size of the vocabulary.
+func (m *model) complementLogLikelihood(s *classStats, terms map[string]int) float64 {
+	result := 0.0
+	denom := math.Log(float64(m.All.Terms - s.Terms + len(m.All.Counts)))
+	for term, n := range terms {
+		all, ok := m.All.Counts[term]
+		if !ok {
+			continue
+		}
+		result += float64(n) * (math.Log(float64(all-s.Counts[term]+1)) - denom)
+	}
+	return result
+}
+
+func (m *model) scoreTypes(terms map[string]int) []Score {
+	result := []Score{}
+	typedDocs := 0
+	for _, s := range m.Types {
+		typedDocs += s.Docs
+	}
+	if typedDocs == 0 {
+		return result
+	}
+	logScores := make([]float64, 0, len(m.Types))
+	maxScore := math.Inf(-1)
+	for label, s := range m.Types {
+		score := math.Log(float64(s.Docs)/float64(typedDocs)) + s.logLikelihood(terms, m.All.Counts)
+		logScores = append(logScores, score)
+		result = append(result, Score{Label: label})
+		maxScore = math.Max(maxScore, score)
+	}
+	// softmax, shifted by the maximum to avoid underflow
+	sum := 0.0
+	for i, score := range logScores {
+		result[i].Confidence = math.Exp(score - maxScore)
+		sum += result[i].Confidence
+	}
+	for i := range result {
+		result[i].Confidence /= sum
+	}
+	sortScores(result)
+	return result
+}
+
+func (m *model) scoreTags(terms map[string]int) []Score {
+	result := []Score{}
+	for label, with := range m.Tags {
+		withoutDocs := m.All.Docs - with.Docs
+		confidence := 1.0
+		if withoutDocs > 0 {
+			logOdds := math.Log(float64(with.Docs)/float64(withoutDocs)) +
+				with.logLikelihood(terms, m.All.Counts) - m.complementLogLikelihood(with, terms)
+			confidence = 1 / (1 + math.Exp(-logOdds))
+		}
+		result = append(result, Score{Label: label, Confidence: confidence})
+	}
+	sortScores(result)
+	return result
+}
+
+func sortScores(scores []Score) {
+	sort.Slice(scores, func(i, j int) bool {
+		if scores[i].Confidence != scores[j].Confidence {
+			return scores[i].Confidence > scores[j].Confidence
+		}
+		return scores[i].Label < scores[j].Label
+	})
+}
+
+func (c *Classifier) decodeSample(b []byte) (*Sample, error) {
+	if b == nil {
+		return nil, nil
+	}
+	s := &Sample{}
+	err := c.decode(b, s)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// putGob stores v gob encoded, encrypted if the classifier has a cipher
+func (c *Classifier) putGob(bucket *bolt.Bucket, key []byte, v interface{}) error {
+	buf := &bytes.Buffer{}
+	err := gob.NewEncoder(buf).Encode(v)
+	if err != nil {
+		return err
+	}
+	b := buf.Bytes()
+	if c.cipher != nil {
+		b, err = c.cipher.Encrypt(b)
+		if err != nil {
+			return err
+		}
+	}
+	return bucket.Put(key, b)
+}
+
+// decode is the counterpart of putGob
+func (c *Classifier) decode(b []byte, v interface{}) error {
+	if crypt.IsEncrypted(b) {
+		if c.cipher == nil {
+			return ErrEncrypted
+		}
+		var err error
+		b, err = c.cipher.Decrypt(b)
+		if err != nil {
+			return err
+		}
+	}
+	return gob.NewDecoder(bytes.NewBuffer(b)).Decode(v)
+}
+
+// Reseal encrypts all records with the current key of the cipher, so older
+// keys can be retired
+func (c *Classifier) Reseal() error {
+	if c.cipher == nil {
+		return errors.New("classifier DB is not encrypted")
+	}
+	return c.reseal(true)
+}
+
+// reseal encrypts the records stored without encryption, or all with all set
+func (c *Classifier) reseal(all bool) error {
+	return c.Handle.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{sampleBucket, modelBucket, suggestionBucket} {
+			bucket := tx.Bucket([]byte(name))
+			// the bucket can't be changed while iterating over it
+			records := make(map[string][]byte)
+			err := bucket.ForEach(func(k, v []byte) error {
+				if all || !crypt.IsEncrypted(v) {
+					records[string(k)] = append([]byte{}, v...)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for k, v := range records {
+				plain, err := c.cipher.Decrypt(v)
+				if err != nil {
+					return err
+				}
+				sealed, err := c.cipher.Encrypt(plain)
+				if err != nil {
+					return err
+				}
+				err = bucket.Put([]byte(k), sealed)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func itob(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
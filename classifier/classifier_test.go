@@ -0,0 +1,237 @@
+package classifier
+
+import (
+	"bytes"
+	"math"
+	"os"
+	"testing"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/reusing-code/dochan/crypt"
+)
+
+var trainingData = []struct {
+	docType string
+	tags    []string
+	content []string
+}{
+	{"invoice", []string{"car"}, []string{"Rechnung Nr. 123", "Inspektion Fahrzeug Betrag 350 EUR zahlbar bis"}},
+	{"invoice", []string{"phone"}, []string{"Rechnung Mobilfunk", "Betrag 19,99 EUR zahlbar bis 01.02."}},
+	{"payslip", []string{}, []string{"Entgeltabrechnung Januar", "Bruttolohn Nettolohn Lohnsteuer"}},
+	{"payslip", []string{}, []string{"Entgeltabrechnung Februar", "Bruttolohn Nettolohn Sozialversicherung"}},
+	{"contract", []string{"car"}, []string{"Kaufvertrag Fahrzeug", "Verkäufer Käufer Unterschrift"}},
+}
+
+func TestTrainSuggest(t *testing.T) {
+	defer os.Remove("test.db")
+	c, err := New("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	s := c.Suggest([]string{"Rechnung"})
+	if len(s.Types) != 0 || len(s.Tags) != 0 {
+		t.Errorf("Untrained classifier should not suggest anything, got %v", s)
+	}
+
+	for i, td := range trainingData {
+		err = c.Train(uint64(i+1), td.docType, td.tags, td.content)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s = c.Suggest([]string{"Rechnung Werkstatt", "Betrag 120 EUR zahlbar bis"})
+	docType, _ := s.Accepted()
+	if docType != "invoice" {
+		t.Errorf("Want type %q, got %q (%v)", "invoice", docType, s.Types)
+	}
+	sum := 0.0
+	for _, score := range s.Types {
+		sum += score.Confidence
+	}
+	if sum < 0.999 || sum > 1.001 {
+		t.Errorf("Type confidences should sum up to 1, got %v", sum)
+	}
+
+	s = c.Suggest([]string{"Fahrzeug"})
+	_, tags := s.Accepted()
+	if len(tags) != 1 || tags[0] != "car" {
+		t.Errorf("Want tags [car], got %v (%v)", tags, s.Tags)
+	}
+}
+
+func TestPersistForget(t *testing.T) {
+	defer os.Remove("test.db")
+	c, err := New("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, td := range trainingData {
+		err = c.Train(uint64(i+1), td.docType, td.tags, td.content)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.Close()
+
+	c, err = New("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if !c.IsTrained(3) {
+		t.Error("Sample not persisted")
+	}
+	docType, _ := c.Suggest([]string{"Nettolohn"}).Accepted()
+	if docType != "payslip" {
+		t.Errorf("Want type %q after reopening, got %q", "payslip", docType)
+	}
+
+	err = c.Forget(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Forget(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.IsTrained(3) {
+		t.Error("Sample not removed")
+	}
+	for _, score := range c.Suggest([]string{"Nettolohn"}).Types {
+		if score.Label == "payslip" {
+			t.Errorf("Forgotten type still suggested: %v", score)
+		}
+	}
+}
+
+func TestRejectSuggestion(t *testing.T) {
+	defer os.Remove("test.db")
+	c, err := New("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	s, err := c.GetSuggestion(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != nil {
+		t.Errorf("Want no suggestion, got %v", s)
+	}
+	err = c.StoreSuggestion(1, Suggestion{Types: []Score{{"invoice", 0.9}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Reject(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err = c.GetSuggestion(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s == nil || len(s.Types) != 0 {
+		t.Errorf("Want empty suggestion after reject, got %v", s)
+	}
+}
+
+func TestComplementLogLikelihood(t *testing.T) {
+	m := newModel()
+	for _, td := range trainingData {
+		m.add(&Sample{Type: td.docType, Tags: td.tags, Terms: Terms(td.content)})
+	}
+	terms := Terms([]string{"Rechnung Fahrzeug Betrag", "unbekannt"})
+	for label, with := range m.Tags {
+		without := m.All.clone()
+		without.Terms -= with.Terms
+		for term, n := range with.Counts {
+			without.Counts[term] -= n
+		}
+		want := without.logLikelihood(terms, m.All.Counts)
+		if got := m.complementLogLikelihood(with, terms); math.Abs(got-want) > 1e-9 {
+			t.Errorf("Tag %v: want %v, got %v", label, want, got)
+		}
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	defer os.Remove("test.db")
+	defer os.Remove("test.keys.db")
+	c, err := New("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, td := range trainingData {
+		err = c.Train(uint64(i+1), td.docType, td.tags, td.content)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.StoreSuggestion(10, c.Suggest([]string{"Nettolohn"}))
+	c.Close()
+
+	handle, err := bolt.Open("test.keys.db", 0644, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handle.Close()
+	var keys *crypt.Keyring
+	err = handle.Update(func(tx *bolt.Tx) error {
+		keys, err = crypt.Open(tx, "keys", crypt.Passphrase("secret"))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// records stored before are encrypted on opening
+	c, err = NewEncrypted("test.db", keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Train(6, "payslip", nil, []string{"Entgeltabrechnung März"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	raw, err := bolt.Open("test.db", 0644, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := 0
+	raw.View(func(tx *bolt.Tx) error {
+		for _, name := range []string{sampleBucket, modelBucket, suggestionBucket} {
+			tx.Bucket([]byte(name)).ForEach(func(k, v []byte) error {
+				records++
+				if !crypt.IsEncrypted(v) || bytes.Contains(v, []byte("Nettolohn")) {
+					t.Errorf("Record %x of %v not encrypted", k, name)
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	raw.Close()
+	if records != len(trainingData)+3 {
+		t.Errorf("Want %d records, got %d", len(trainingData)+3, records)
+	}
+
+	if _, err = New("test.db"); err != ErrEncrypted {
+		t.Errorf("Want ErrEncrypted without key, got %v", err)
+	}
+	c, err = NewEncrypted("test.db", keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if docType, _ := c.Suggest([]string{"Nettolohn"}).Accepted(); docType != "payslip" || !c.IsTrained(6) {
+		t.Errorf("Want type payslip after reopening, got %q", docType)
+	}
+	if s, err := c.GetSuggestion(10); err != nil || s == nil {
+		t.Errorf("Suggestion not readable: %v %v", s, err)
+	}
+}
@@ -4,8 +4,20 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
+	bolt "github.com/coreos/bbolt"
+	"github.com/reusing-code/dochan/backup"
+	"github.com/reusing-code/dochan/classifier"
+	"github.com/reusing-code/dochan/crypt"
+	"github.com/reusing-code/dochan/db"
 	"github.com/reusing-code/dochan/eml"
+	"github.com/reusing-code/dochan/jobs"
+	"github.com/reusing-code/dochan/migrate"
+	"github.com/reusing-code/dochan/reconcile"
+	"github.com/reusing-code/dochan/refuel"
+	"github.com/reusing-code/dochan/users"
 
 	"gopkg.in/abiosoft/ishell.v2"
 )
@@ -31,21 +43,425 @@ func main() {
 			output := c.ReadLine()
 			os.MkdirAll(output, 0777)
 			num := 0
+			failed := 0
 
 			err := eml.ExtractAttachmentsFromDirRec(input, func(filename string, content []byte, messageID string) error {
 				target := filepath.Join(output, messageID+"-"+filename)
 				err := ioutil.WriteFile(target, content, 0666)
 				num++
 				return err
+			}, func(path string, err error) {
+				c.Printf("Error in file %q: %v\n", path, err)
+				failed++
 			})
 			if err != nil {
 				c.Println(err)
 			}
 
 			c.Printf("Extracted attachments: %d\n", num)
+			if failed > 0 {
+				c.Printf("Failed mails: %d\n", failed)
+			}
+		},
+	})
+
+	shell.AddCmd(&ishell.Cmd{
+		Name: "reconcile",
+		Help: "update paths of moved documents and report missing ones (server must be stopped)",
+		Func: func(c *ishell.Context) {
+			c.ShowPrompt(false)
+			defer c.ShowPrompt(true)
+
+			c.Print("DB file (e.g. dochan.documents.db): ")
+			dbFile := c.ReadLine()
+			c.Print("Document dir: ")
+			dir := c.ReadLine()
+			c.Print("Tombstone missing documents? (y/n): ")
+			tombstone := c.ReadLine() == "y"
+			c.Print("Dry run? (y/n): ")
+			dryRun := c.ReadLine() == "y"
+
+			d, err := openDB(c, dbFile)
+			if err != nil {
+				c.Println(err)
+				return
+			}
+			defer d.Close()
+
+			report, err := reconcile.Run(d, reconcile.Options{
+				Dir:        dir,
+				Extensions: []string{"pdf"},
+				Tombstone:  tombstone,
+				DryRun:     dryRun,
+			})
+			if err != nil {
+				c.Println(err)
+				return
+			}
+			for _, move := range report.Moved {
+				c.Printf("Moved %d: %s -> %s\n", move.Key, move.OldPath, move.NewPath)
+			}
+			for _, orphan := range report.Orphans {
+				c.Printf("Missing %d: %s\n", orphan.Key, orphan.Path)
+			}
+			c.Printf("Checked: %d, moved: %d, missing: %d, tombstoned: %d, reappeared: %d, stale hashes: %d\n",
+				report.Checked, len(report.Moved), len(report.Orphans), report.Tombstoned, len(report.Found), report.StaleHashes)
+			if dryRun {
+				c.Println("Dry run, nothing changed")
+			}
+		},
+	})
+
+	shell.AddCmd(&ishell.Cmd{
+		Name: "migrate",
+		Help: "upgrade the schema of a documents or fuel DB (server must be stopped)",
+		Func: func(c *ishell.Context) {
+			c.ShowPrompt(false)
+			defer c.ShowPrompt(true)
+
+			c.Print("DB file (e.g. dochan.documents.db or dochan.fuel.db): ")
+			dbFile := c.ReadLine()
+			c.Print("Dry run? (y/n): ")
+			opts := migrate.Options{Backup: true, DryRun: c.ReadLine() == "y"}
+
+			var res *migrate.Result
+			var err error
+			if strings.HasSuffix(dbFile, ".fuel.db") {
+				res, err = refuel.Migrate(dbFile, opts)
+			} else {
+				res, err = db.Migrate(dbFile, opts)
+			}
+			if err != nil {
+				c.Println(err)
+				return
+			}
+			for _, desc := range res.Applied {
+				c.Printf("Applied: %s\n", desc)
+			}
+			c.Printf("Schema version: %d -> %d\n", res.From, res.To)
+			if res.Backup != "" {
+				c.Printf("Backup: %s\n", res.Backup)
+			}
+			if opts.DryRun {
+				c.Println("Dry run, nothing changed")
+			}
+		},
+	})
+
+	shell.AddCmd(&ishell.Cmd{
+		Name: "export",
+		Help: "write all documents, fuel records and users to a backup archive (server must be stopped)",
+		Func: func(c *ishell.Context) {
+			c.ShowPrompt(false)
+			defer c.ShowPrompt(true)
+
+			src, closeAll, err := openArchive(c)
+			if err != nil {
+				c.Println(err)
+				return
+			}
+			defer closeAll()
+			if src.Documents.Encrypted() {
+				c.Print("Documents are encrypted but the archive is not, export anyway? (y/n): ")
+				if c.ReadLine() != "y" {
+					return
+				}
+			}
+			c.Print("Output file (e.g. dochan.tar.gz): ")
+			out, err := os.Create(c.ReadLine())
+			if err != nil {
+				c.Println(err)
+				return
+			}
+			defer out.Close()
+
+			m, err := backup.Export(out, src)
+			if err != nil {
+				c.Println(err)
+				return
+			}
+			c.Printf("Exported %d documents, %d fuel records and %d users\n", len(m.Documents), len(m.Fuel), len(m.Users))
+		},
+	})
+
+	shell.AddCmd(&ishell.Cmd{
+		Name: "verify",
+		Help: "check a backup archive for missing or corrupt files",
+		Func: func(c *ishell.Context) {
+			c.ShowPrompt(false)
+			defer c.ShowPrompt(true)
+
+			c.Print("Backup file: ")
+			in, err := os.Open(c.ReadLine())
+			if err != nil {
+				c.Println(err)
+				return
+			}
+			defer in.Close()
+
+			m, err := backup.Verify(in)
+			if err != nil {
+				c.Println(err)
+				return
+			}
+			c.Printf("OK, %d documents, %d fuel records and %d users from %v\n", len(m.Documents), len(m.Fuel), len(m.Users), m.Created)
+		},
+	})
+
+	shell.AddCmd(&ishell.Cmd{
+		Name: "restore",
+		Help: "restore a backup archive (server must be stopped)",
+		Func: func(c *ishell.Context) {
+			c.ShowPrompt(false)
+			defer c.ShowPrompt(true)
+
+			c.Print("Backup file: ")
+			in, err := os.Open(c.ReadLine())
+			if err != nil {
+				c.Println(err)
+				return
+			}
+			defer in.Close()
+			src, closeAll, err := openArchive(c)
+			if err != nil {
+				c.Println(err)
+				return
+			}
+			defer closeAll()
+			c.Print("Merge into existing documents and users? (y/n): ")
+			merge := c.ReadLine() == "y"
+
+			report, err := backup.Restore(in, src, backup.Options{Merge: merge})
+			if report != nil {
+				c.Printf("Restored %d documents, skipped %d, added %d fuel records and %d users\n",
+					len(report.Documents), report.Skipped, report.Fuel, report.Users)
+			}
+			if err != nil {
+				c.Println(err)
+			}
+		},
+	})
+
+	shell.AddCmd(&ishell.Cmd{
+		Name: "adduser",
+		Help: "add a user, or reset the password and role of an existing one (server must be stopped)",
+		Func: func(c *ishell.Context) {
+			c.ShowPrompt(false)
+			defer c.ShowPrompt(true)
+
+			c.Print("Session DB file (e.g. dochan.session.db): ")
+			handle, err := bolt.Open(c.ReadLine(), 0644, &bolt.Options{Timeout: 5 * time.Second})
+			if err != nil {
+				c.Println(err)
+				return
+			}
+			defer handle.Close()
+			store, err := users.New(handle)
+			if err != nil {
+				c.Println(err)
+				return
+			}
+			c.Print("Name: ")
+			name := c.ReadLine()
+			c.Print("Role (admin, member, readonly): ")
+			role := users.Role(c.ReadLine())
+			c.Print("Password: ")
+			password := c.ReadPassword()
+
+			_, err = store.Add(name, password, role)
+			if err == users.ErrExists {
+				err = store.SetPassword(name, password)
+				if err == nil {
+					err = store.SetRole(name, role)
+				}
+			}
+			if err != nil {
+				c.Println(err)
+				return
+			}
+			c.Printf("Saved user %s\n", name)
+		},
+	})
+
+	shell.AddCmd(&ishell.Cmd{
+		Name: "failures",
+		Help: "list files which failed to be imported and optionally queue them again (server must be stopped)",
+		Func: func(c *ishell.Context) {
+			c.ShowPrompt(false)
+			defer c.ShowPrompt(true)
+
+			c.Print("Jobs DB file (e.g. dochan.jobs.db): ")
+			handle, err := bolt.Open(c.ReadLine(), 0644, &bolt.Options{Timeout: 5 * time.Second})
+			if err != nil {
+				c.Println(err)
+				return
+			}
+			defer handle.Close()
+			queue, err := jobs.Open(handle)
+			if err != nil {
+				c.Println(err)
+				return
+			}
+			failures, err := queue.Failures()
+			if err != nil {
+				c.Println(err)
+				return
+			}
+			var paths []string
+			for _, f := range failures {
+				c.Printf("%s  %-5s %s: %s\n", f.Time.Format("2006-01-02 15:04"), f.Stage, f.Path, f.Error)
+				paths = append(paths, f.Path)
+			}
+			c.Printf("Failed files: %d\n", len(failures))
+			if len(failures) == 0 {
+				return
+			}
+			c.Print("Retry them on next server start? (y/n): ")
+			if strings.TrimSpace(c.ReadLine()) != "y" {
+				return
+			}
+			job, err := queue.Retry("retry", paths)
+			if err != nil {
+				c.Println(err)
+				return
+			}
+			c.Printf("Queued %d files\n", job.Total)
+		},
+	})
+
+	shell.AddCmd(&ishell.Cmd{
+		Name: "reencrypt",
+		Help: "encrypt all documents with a new data key, optionally change the passphrase or key file (server must be stopped)",
+		Func: func(c *ishell.Context) {
+			c.ShowPrompt(false)
+			defer c.ShowPrompt(true)
+
+			c.Print("DB file (e.g. dochan.documents.db): ")
+			dbFile := c.ReadLine()
+			c.Println("Current key, leave empty if the DB is not encrypted yet")
+			secret, err := readSecret(c)
+			if err != nil {
+				c.Println(err)
+				return
+			}
+			c.Println("New key, leave empty to keep the current one")
+			newSecret, err := readSecret(c)
+			if err != nil {
+				c.Println(err)
+				return
+			}
+			if secret == nil {
+				secret, newSecret = newSecret, nil
+			}
+			if secret == nil {
+				c.Println("No key given")
+				return
+			}
+
+			d, err := db.NewWithSecret(dbFile, secret)
+			if err != nil {
+				c.Println(err)
+				return
+			}
+			defer d.Close()
+			if newSecret != nil {
+				err = d.ChangeSecret(newSecret)
+				if err != nil {
+					c.Println(err)
+					return
+				}
+				c.Println("Changed key")
+			}
+			// the classifier next to the documents DB uses its keys
+			var others []db.Resealer
+			if base := strings.TrimSuffix(dbFile, ".documents.db"); base != dbFile {
+				if _, err := os.Stat(base + ".classifier.db"); err == nil {
+					cl, err := classifier.NewEncrypted(base+".classifier.db", d.Cipher())
+					if err != nil {
+						c.Println(err)
+						return
+					}
+					defer cl.Close()
+					others = append(others, cl)
+				}
+			}
+			n, err := d.Reencrypt(others...)
+			if err != nil {
+				c.Println(err)
+				return
+			}
+			c.Printf("Encrypted %d documents with a new data key\n", n)
 		},
 	})
 
 	// run shell
 	shell.Run()
 }
+
+// readSecret asks for a key file or passphrase, it returns nil if both are empty
+func readSecret(c *ishell.Context) (crypt.Secret, error) {
+	c.Print("Key file (empty to use a passphrase): ")
+	if keyFile := c.ReadLine(); keyFile != "" {
+		return crypt.KeyFile(keyFile)
+	}
+	c.Print("Passphrase: ")
+	if passphrase := c.ReadPassword(); passphrase != "" {
+		return crypt.Passphrase(passphrase), nil
+	}
+	return nil, nil
+}
+
+// openDB opens the documents DB at path, asking for its key if it is encrypted
+func openDB(c *ishell.Context, path string) (*db.DB, error) {
+	d, err := db.New(path)
+	if err != db.ErrEncrypted {
+		return d, err
+	}
+	secret, err := readSecret(c)
+	if err != nil {
+		return nil, err
+	}
+	return db.NewWithSecret(path, secret)
+}
+
+// openArchive asks for the DB file base name and opens the documents, fuel,
+// session and classifier DB. The returned function closes them.
+func openArchive(c *ishell.Context) (backup.Sources, func(), error) {
+	c.Print("DB file base name (e.g. dochan): ")
+	base := c.ReadLine()
+	var src backup.Sources
+	var sessions *bolt.DB
+	closeAll := func() {
+		if src.Classifier != nil {
+			src.Classifier.Close()
+		}
+		if sessions != nil {
+			sessions.Close()
+		}
+		if src.Fuel != nil {
+			src.Fuel.Close()
+		}
+		if src.Documents != nil {
+			src.Documents.Close()
+		}
+	}
+	var err error
+	src.Documents, err = openDB(c, base+".documents.db")
+	if err == nil {
+		src.Fuel, err = refuel.New(base + ".fuel.db")
+	}
+	if err == nil {
+		sessions, err = bolt.Open(base+".session.db", 0644, &bolt.Options{Timeout: 5 * time.Second})
+	}
+	if err == nil {
+		src.Users, err = users.New(sessions)
+	}
+	if err == nil {
+		src.Classifier, err = classifier.NewEncrypted(base+".classifier.db", src.Documents.Cipher())
+	}
+	if err != nil {
+		closeAll()
+		return src, nil, err
+	}
+	return src, closeAll, nil
+}
@@ -0,0 +1,308 @@
+// Package crypt implements envelope encryption of data at rest. Data is
+// encrypted with AES-256-GCM using random data keys, which are stored in a bolt
+// bucket encrypted with a key derived from a passphrase or key file. Changing
+// the passphrase only rewraps the data keys; rotating the data key encrypts new
+// data with a fresh one while older data stays readable until it is encrypted
+// again.
+package crypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	bolt "github.com/coreos/bbolt"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	saltKey    = "salt"
+	currentKey = "current"
+	keyPrefix  = "key."
+
+	keySize   = 32
+	nonceSize = 12
+	// minimum size of a key file, it should be random data
+	minKeyFileSize = 32
+)
+
+// magic and format version prefixed to encrypted data, followed by the id of
+// the data key and the nonce
+var magic = []byte("\x00dce\x01")
+
+const headerSize = 5 + 4 + nonceSize
+
+var (
+	ErrWrongSecret = errors.New("wrong passphrase or key file")
+	ErrCorrupt     = errors.New("encrypted data is corrupt")
+)
+
+// Secret derives the key encrypting the data keys
+type Secret interface {
+	deriveKey(salt []byte) ([]byte, error)
+}
+
+type passphrase string
+
+// Passphrase returns a secret deriving the key from p with scrypt
+func Passphrase(p string) Secret {
+	return passphrase(p)
+}
+
+func (p passphrase) deriveKey(salt []byte) ([]byte, error) {
+	if p == "" {
+		return nil, errors.New("empty passphrase")
+	}
+	return scrypt.Key([]byte(p), salt, 1<<15, 8, 1, keySize)
+}
+
+type keyFile []byte
+
+// KeyFile returns a secret deriving the key from the contents of the file at path
+func KeyFile(path string) (Secret, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < minKeyFileSize {
+		return nil, fmt.Errorf("key file %v too short, use at least %d random bytes", path, minKeyFileSize)
+	}
+	return keyFile(b), nil
+}
+
+func (k keyFile) deriveKey(salt []byte) ([]byte, error) {
+	mac := hmac.New(sha256.New, k)
+	mac.Write(salt)
+	return mac.Sum(nil), nil
+}
+
+// Keyring holds the data keys of a DB
+type Keyring struct {
+	bucket  []byte
+	current uint32
+	keys    map[uint32][]byte
+	aeads   map[uint32]cipher.AEAD
+	// encrypts the data keys
+	wrap cipher.AEAD
+}
+
+// Exists reports whether bucket holds a keyring, i.e. whether the DB is encrypted
+func Exists(tx *bolt.Tx, bucket string) bool {
+	b := tx.Bucket([]byte(bucket))
+	return b != nil && b.Get([]byte(currentKey)) != nil
+}
+
+// Open loads the keyring stored in bucket, creating it with a new data key if
+// there is none. It fails with ErrWrongSecret if secret does not match the one
+// the keyring was created with.
+func Open(tx *bolt.Tx, bucket string, secret Secret) (*Keyring, error) {
+	b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+	if err != nil {
+		return nil, fmt.Errorf("create bucket %q: %q", bucket, err)
+	}
+	k := &Keyring{
+		bucket: []byte(bucket),
+		keys:   make(map[uint32][]byte),
+		aeads:  make(map[uint32]cipher.AEAD),
+	}
+	salt := b.Get([]byte(saltKey))
+	if salt == nil {
+		salt, err = randomBytes(keySize)
+		if err != nil {
+			return nil, err
+		}
+		err = b.Put([]byte(saltKey), salt)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = k.setSecret(secret, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	err = b.ForEach(func(name, v []byte) error {
+		if !bytes.HasPrefix(name, []byte(keyPrefix)) {
+			return nil
+		}
+		id := name[len(keyPrefix):]
+		if len(id) != 4 || len(v) < nonceSize {
+			return ErrCorrupt
+		}
+		key, err := k.wrap.Open(nil, v[:nonceSize], v[nonceSize:], id)
+		if err != nil {
+			return ErrWrongSecret
+		}
+		return k.add(binary.BigEndian.Uint32(id), key)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	current := b.Get([]byte(currentKey))
+	if current == nil {
+		return k, k.Rotate(tx)
+	}
+	k.current = binary.BigEndian.Uint32(current)
+	if _, ok := k.aeads[k.current]; !ok {
+		return nil, fmt.Errorf("current data key %d missing", k.current)
+	}
+	return k, nil
+}
+
+func (k *Keyring) setSecret(secret Secret, salt []byte) error {
+	kek, err := secret.deriveKey(salt)
+	if err != nil {
+		return err
+	}
+	k.wrap, err = newAEAD(kek)
+	return err
+}
+
+func (k *Keyring) add(id uint32, key []byte) error {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return err
+	}
+	k.keys[id] = key
+	k.aeads[id] = aead
+	return nil
+}
+
+func (k *Keyring) putKey(b *bolt.Bucket, id uint32) error {
+	nonce, err := randomBytes(nonceSize)
+	if err != nil {
+		return err
+	}
+	name := append([]byte(keyPrefix), uint32Bytes(id)...)
+	return b.Put(name, k.wrap.Seal(nonce, nonce, k.keys[id], uint32Bytes(id)))
+}
+
+// Rotate creates a new data key, which encrypts all data from now on
+func (k *Keyring) Rotate(tx *bolt.Tx) error {
+	b := tx.Bucket(k.bucket)
+	id := k.current + 1
+	key, err := randomBytes(keySize)
+	if err != nil {
+		return err
+	}
+	err = k.add(id, key)
+	if err != nil {
+		return err
+	}
+	err = k.putKey(b, id)
+	if err != nil {
+		return err
+	}
+	k.current = id
+	return b.Put([]byte(currentKey), uint32Bytes(id))
+}
+
+// ChangeSecret encrypts the data keys with a key derived from secret. The data
+// itself is unchanged.
+func (k *Keyring) ChangeSecret(tx *bolt.Tx, secret Secret) error {
+	b := tx.Bucket(k.bucket)
+	salt, err := randomBytes(keySize)
+	if err != nil {
+		return err
+	}
+	err = k.setSecret(secret, salt)
+	if err != nil {
+		return err
+	}
+	err = b.Put([]byte(saltKey), salt)
+	if err != nil {
+		return err
+	}
+	for id := range k.keys {
+		err = k.putKey(b, id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Retire removes all data keys but the current one. Data encrypted with them
+// can't be read anymore, it has to be encrypted again before.
+func (k *Keyring) Retire(tx *bolt.Tx) error {
+	b := tx.Bucket(k.bucket)
+	for id := range k.keys {
+		if id == k.current {
+			continue
+		}
+		err := b.Delete(append([]byte(keyPrefix), uint32Bytes(id)...))
+		if err != nil {
+			return err
+		}
+		delete(k.keys, id)
+		delete(k.aeads, id)
+	}
+	return nil
+}
+
+// Encrypt encrypts plain with the current data key
+func (k *Keyring) Encrypt(plain []byte) ([]byte, error) {
+	out := make([]byte, headerSize, headerSize+len(plain)+k.aeads[k.current].Overhead())
+	copy(out, magic)
+	binary.BigEndian.PutUint32(out[len(magic):], k.current)
+	nonce := out[len(magic)+4:]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return k.aeads[k.current].Seal(out, nonce, plain, out[:len(magic)+4]), nil
+}
+
+// Decrypt returns the plain data encrypted by Encrypt. Data without the header
+// was stored before encryption was enabled and is returned unchanged.
+func (k *Keyring) Decrypt(data []byte) ([]byte, error) {
+	if !IsEncrypted(data) {
+		return data, nil
+	}
+	if len(data) < headerSize {
+		return nil, ErrCorrupt
+	}
+	id := binary.BigEndian.Uint32(data[len(magic):])
+	aead, ok := k.aeads[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown data key %d", id)
+	}
+	plain, err := aead.Open(nil, data[len(magic)+4:headerSize], data[headerSize:], data[:len(magic)+4])
+	if err != nil {
+		return nil, ErrCorrupt
+	}
+	return plain, nil
+}
+
+// IsEncrypted reports whether data was encrypted by a Keyring
+func IsEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, magic)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	_, err := io.ReadFull(rand.Reader, b)
+	return b, err
+}
+
+func uint32Bytes(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
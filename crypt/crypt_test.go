@@ -0,0 +1,147 @@
+package crypt
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	bolt "github.com/coreos/bbolt"
+)
+
+const testBucket = "keys"
+
+func openDB(t *testing.T) *bolt.DB {
+	handle, err := bolt.Open("test.db", 0644, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return handle
+}
+
+func openKeyring(handle *bolt.DB, secret Secret) (*Keyring, error) {
+	var k *Keyring
+	err := handle.Update(func(tx *bolt.Tx) error {
+		var err error
+		k, err = Open(tx, testBucket, secret)
+		return err
+	})
+	return k, err
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	defer os.Remove("test.db")
+	handle := openDB(t)
+	defer handle.Close()
+
+	handle.View(func(tx *bolt.Tx) error {
+		if Exists(tx, testBucket) {
+			t.Error("Keyring exists in new DB")
+		}
+		return nil
+	})
+	k, err := openKeyring(handle, Passphrase("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := []byte("some extracted text")
+	data, err := k.Encrypt(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsEncrypted(data) || bytes.Contains(data, plain) {
+		t.Errorf("Data not encrypted: %q", data)
+	}
+	again, _ := k.Encrypt(plain)
+	if bytes.Equal(data, again) {
+		t.Error("Same ciphertext for encrypting twice")
+	}
+
+	k, err = openKeyring(handle, Passphrase("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := k.Decrypt(data)
+	if err != nil || !bytes.Equal(res, plain) {
+		t.Errorf("Wrong decrypted data %q: %v", res, err)
+	}
+	res, err = k.Decrypt([]byte("%PDF-1.4"))
+	if err != nil || string(res) != "%PDF-1.4" {
+		t.Errorf("Unencrypted data changed: %q %v", res, err)
+	}
+	data[len(data)-1] ^= 1
+	_, err = k.Decrypt(data)
+	if err != ErrCorrupt {
+		t.Errorf("Want ErrCorrupt for modified data, got %v", err)
+	}
+
+	_, err = openKeyring(handle, Passphrase("wrong"))
+	if err != ErrWrongSecret {
+		t.Errorf("Want ErrWrongSecret, got %v", err)
+	}
+}
+
+func TestRotate(t *testing.T) {
+	defer os.Remove("test.db")
+	defer os.Remove("test.key")
+	handle := openDB(t)
+	defer handle.Close()
+
+	k, err := openKeyring(handle, Passphrase("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, _ := k.Encrypt([]byte("old"))
+	err = handle.Update(func(tx *bolt.Tx) error {
+		return k.Rotate(tx)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recent, _ := k.Encrypt([]byte("new"))
+
+	err = ioutil.WriteFile("test.key", bytes.Repeat([]byte{42}, 16), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = KeyFile("test.key"); err == nil {
+		t.Error("Short key file accepted")
+	}
+	ioutil.WriteFile("test.key", bytes.Repeat([]byte{42}, 64), 0600)
+	keyFile, err := KeyFile("test.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = handle.Update(func(tx *bolt.Tx) error {
+		return k.ChangeSecret(tx, keyFile)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = openKeyring(handle, Passphrase("secret")); err != ErrWrongSecret {
+		t.Errorf("Old passphrase still works: %v", err)
+	}
+	k, err = openKeyring(handle, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range [][]byte{old, recent} {
+		if _, err := k.Decrypt(data); err != nil {
+			t.Errorf("Decrypt after changing the key file: %v", err)
+		}
+	}
+
+	err = handle.Update(func(tx *bolt.Tx) error {
+		return k.Retire(tx)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, _ = openKeyring(handle, keyFile)
+	if _, err := k.Decrypt(old); err == nil {
+		t.Error("Data of retired key still readable")
+	}
+	if res, err := k.Decrypt(recent); err != nil || string(res) != "new" {
+		t.Errorf("Data of current key not readable: %q %v", res, err)
+	}
+}
@@ -0,0 +1,163 @@
+package db
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/reusing-code/dochan/blob"
+	"github.com/reusing-code/dochan/crypt"
+)
+
+// keyBucket holds the data keys of an encrypted DB
+const keyBucket = "keys"
+
+var ErrEncrypted = errors.New("DB is encrypted, a passphrase or key file is required")
+
+// Resealer is a store encrypted with the keys of the DB, e.g. the classifier
+type Resealer interface {
+	// Reseal encrypts all data with the current key
+	Reseal() error
+}
+
+// openKeys loads the data keys if secret is set, a DB once encrypted can't be
+// opened without one
+func (db *DB) openKeys(secret crypt.Secret) error {
+	return db.Handle.Update(func(tx *bolt.Tx) error {
+		if secret == nil {
+			if crypt.Exists(tx, keyBucket) {
+				return ErrEncrypted
+			}
+			return nil
+		}
+		var err error
+		db.keys, err = crypt.Open(tx, keyBucket, secret)
+		return err
+	})
+}
+
+// Encrypted reports whether the DB was opened with a key, all new data is
+// encrypted then
+func (db *DB) Encrypted() bool {
+	return db.keys != nil
+}
+
+// Cipher returns the keys of the DB for stores derived from the documents,
+// which have to be encrypted as well. It is nil if the DB isn't encrypted.
+func (db *DB) Cipher() blob.Cipher {
+	if db.keys == nil {
+		return nil
+	}
+	return db.keys
+}
+
+// encodeFile serializes f, the extracted text is encrypted if the DB is
+func (db *DB) encodeFile(f *DBFile) ([]byte, error) {
+	if db.keys != nil && f.Content != nil {
+		buf := &bytes.Buffer{}
+		err := gob.NewEncoder(buf).Encode(f.Content)
+		if err != nil {
+			return nil, err
+		}
+		sealed, err := db.keys.Encrypt(buf.Bytes())
+		if err != nil {
+			return nil, err
+		}
+		c := *f
+		c.Content = nil
+		c.SealedContent = sealed
+		f = &c
+	}
+	buf := &bytes.Buffer{}
+	err := gob.NewEncoder(buf).Encode(f)
+	return buf.Bytes(), err
+}
+
+// decodeFile is the counterpart of encodeFile
+func (db *DB) decodeFile(b []byte, f *DBFile) error {
+	err := gob.NewDecoder(bytes.NewBuffer(b)).Decode(f)
+	if err != nil || f.SealedContent == nil {
+		return err
+	}
+	if db.keys == nil {
+		return ErrEncrypted
+	}
+	plain, err := db.keys.Decrypt(f.SealedContent)
+	if err != nil {
+		return err
+	}
+	f.SealedContent = nil
+	return gob.NewDecoder(bytes.NewBuffer(plain)).Decode(&f.Content)
+}
+
+// ChangeSecret encrypts the data keys with a new passphrase or key file
+func (db *DB) ChangeSecret(secret crypt.Secret) error {
+	if db.keys == nil {
+		return errors.New("DB is not encrypted")
+	}
+	return db.Handle.Update(func(tx *bolt.Tx) error {
+		return db.keys.ChangeSecret(tx, secret)
+	})
+}
+
+// Reencrypt encrypts the extracted text and raw file data of all documents
+// and the data of others with a new data key and removes the old keys
+// afterwards. Data stored before encryption was enabled gets encrypted as
+// well. It returns the number of documents. The server must not be running.
+func (db *DB) Reencrypt(others ...Resealer) (int, error) {
+	if db.keys == nil {
+		return 0, errors.New("DB is not encrypted")
+	}
+	err := db.Handle.Update(func(tx *bolt.Tx) error {
+		return db.keys.Rotate(tx)
+	})
+	if err != nil {
+		return 0, err
+	}
+	keys, err := db.FindFiles(func(f *DBFile) bool { return true })
+	if err != nil {
+		return 0, err
+	}
+	for _, key := range keys {
+		f := &DBFile{}
+		err = db.Handle.Update(func(tx *bolt.Tx) error {
+			bucket := tx.Bucket([]byte(fileBucket))
+			err := db.decodeFile(bucket.Get(Itob(key)), f)
+			if err != nil {
+				return err
+			}
+			b, err := db.encodeFile(f)
+			if err != nil {
+				return err
+			}
+			return bucket.Put(Itob(key), b)
+		})
+		if err != nil {
+			return 0, err
+		}
+		if f.Blob == "" {
+			continue
+		}
+		// storing a blob again replaces it, encrypted with the current key
+		raw, err := db.ReadRaw(f)
+		if err != nil {
+			return 0, err
+		}
+		_, err = db.Blobs.Put(bytes.NewReader(raw))
+		if err != nil {
+			return 0, err
+		}
+	}
+	for _, other := range others {
+		err = other.Reseal()
+		if err != nil {
+			return 0, err
+		}
+	}
+	// nothing refers to the old keys anymore
+	err = db.Handle.Update(func(tx *bolt.Tx) error {
+		return db.keys.Retire(tx)
+	})
+	return len(keys), err
+}
@@ -3,59 +3,167 @@ package db
 import (
 	"bytes"
 	"encoding/binary"
-	"encoding/gob"
 	"errors"
 	"fmt"
+	"log"
 	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
 	bolt "github.com/coreos/bbolt"
+	"github.com/reusing-code/dochan/blob"
+	"github.com/reusing-code/dochan/crypt"
+	"github.com/reusing-code/dochan/migrate"
 )
 
 type DB struct {
-	Handle    *bolt.DB
-	hashTable map[string]bool
+	Handle *bolt.DB
+	// raw file data of the documents
+	Blobs blob.Store
+	// set if the DB is encrypted
+	keys *crypt.Keyring
+	// blobs released while pinned are deleted when the last pin is removed
+	pinMtx   sync.Mutex
+	pins     int
+	released []string
 }
 
 type DBFile struct {
 	Name       string
 	Path       string
+	Hash       string
 	ImportDate time.Time
-	RawData    []byte
-	Content    []string
+	// only set in DBs written before the blob store existed, moved there on open
+	RawData []byte
+	// hash of the raw file data in the blob store
+	Blob    string
+	Size    int64
+	Content []string
+	// Content encrypted at rest, only set in the stored record
+	SealedContent []byte
+	Type          string
+	Tags          []string
+	// key of the document this one is a (near) duplicate of, 0 if none
+	DuplicateOf uint64
+	// set when the source file was found missing, the document itself is kept
+	Tombstoned time.Time
+	// metadata edited by the user
+	Title         string
+	DocumentDate  time.Time
+	Correspondent string
+	Notes         string
+	// set when the document was moved to the trash
+	Deleted time.Time
+	// user the document is private to, empty for documents of all users
+	Owner string
+	// users allowed to read a private document
+	SharedWith []string
 }
 
 const (
-	hashBucket = "hashes"
-	hashKey    = "hashes"
-	fileBucket = "files"
+	fileBucket      = "files"
+	signatureBucket = "signatures"
 )
 
+var (
+	ErrDuplicate = errors.New("Document with the same hash exists")
+	ErrNotFound  = errors.New("Document not found")
+)
+
+// New opens the DB at path, raw file data is stored in a directory next to it
+// with the extension .blobs
 func New(path string) (*DB, error) {
+	return NewWithSecret(path, nil)
+}
+
+// NewWithSecret opens the DB at path like New. If secret is set, the raw file
+// data and extracted text of documents are encrypted, a DB that was encrypted
+// before requires it.
+func NewWithSecret(path string, secret crypt.Secret) (*DB, error) {
+	result, err := open(path)
+	if err != nil {
+		return nil, err
+	}
+	err = result.openKeys(secret)
+	if err != nil {
+		result.Close()
+		return nil, err
+	}
+	var c blob.Cipher
+	if result.keys != nil {
+		c = result.keys
+	}
+	result.Blobs, err = blob.NewEncryptedFileStore(blobDir(path), c)
+	if err != nil {
+		result.Close()
+		return nil, err
+	}
+	err = result.migrate(path)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func blobDir(path string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + ".blobs"
+}
+
+func NewWithStore(path string, store blob.Store) (*DB, error) {
+	result, err := open(path)
+	if err != nil {
+		return nil, err
+	}
+	err = result.openKeys(nil)
+	if err != nil {
+		result.Close()
+		return nil, err
+	}
+	result.Blobs = store
+	err = result.migrate(path)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func open(path string) (*DB, error) {
 	result := &DB{}
 	var err error
-	result.Handle, err = bolt.Open(path, 0644, nil)
+	// don't block forever if another process (server or console) has the DB open
+	result.Handle, err = bolt.Open(path, 0644, &bolt.Options{Timeout: 5 * time.Second})
 	if err != nil {
 		return nil, err
 	}
 	err = result.Handle.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte(hashBucket))
-		if err != nil {
-			return fmt.Errorf("create bucket %q: %q", hashBucket, err)
-		}
-		_, err = tx.CreateBucketIfNotExists([]byte(fileBucket))
-		if err != nil {
-			return fmt.Errorf("create bucket %q: %q", fileBucket, err)
+		for _, name := range append([]string{fileBucket, signatureBucket, purgedBucket, journalBucket}, indexBuckets...) {
+			_, err := tx.CreateBucketIfNotExists([]byte(name))
+			if err != nil {
+				return fmt.Errorf("create bucket %q: %q", name, err)
+			}
 		}
 		return nil
 	})
 	if err != nil {
+		result.Close()
 		return nil, err
 	}
-	result.hashTable, err = result.loadHashTable()
 	return result, nil
 }
 
+func (db *DB) migrate(path string) error {
+	res, err := migrate.Run(db.Handle, db.migrations(false), migrate.Options{Backup: true})
+	if err != nil {
+		db.Close()
+		return err
+	}
+	if len(res.Applied) > 0 {
+		log.Printf("Migrated %v from schema version %d to %d, backup: %q", path, res.From, res.To, res.Backup)
+	}
+	return nil
+}
+
 func (db *DB) Close() error {
 	if db != nil && db.Handle != nil {
 		return db.Handle.Close()
@@ -63,90 +171,310 @@ func (db *DB) Close() error {
 	return errors.New("No DB")
 }
 
-func (db *DB) loadHashTable() (map[string]bool, error) {
-	result := make(map[string]bool)
-	var b []byte
-	err := db.Handle.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte(hashBucket))
-		b = bucket.Get([]byte(hashKey))
+// Contains reports whether a source file of owner with the hash was imported,
+// including purged documents
+func (db *DB) Contains(owner, hash string) bool {
+	_, ok := db.KeyByHash(owner, hash)
+	return ok || db.IsPurged(owner, hash)
+}
+
+// IsPurged reports whether a document of owner with the hash was purged from
+// the trash
+func (db *DB) IsPurged(owner, hash string) bool {
+	purged := false
+	db.Handle.View(func(tx *bolt.Tx) error {
+		purged = tx.Bucket([]byte(purgedBucket)).Get(hashKey(owner, hash)) != nil
 		return nil
 	})
-	if err != nil {
-		return result, err
+	return purged
+}
+
+// AddFile stores a new document. It fails with ErrDuplicate if a document
+// with the same hash and owner exists.
+func (db *DB) AddFile(path string, hash string, rawData []byte, content []string) (uint64, error) {
+	return db.ImportFile(DBFile{Name: filepath.Base(path), Path: path, Hash: hash, Content: content, ImportDate: time.Now()}, rawData)
+}
+
+// ImportFile stores a new document with all its metadata, e.g. from a backup.
+// If f.Blob is set, rawData has to match it. It fails with ErrDuplicate if a
+// document with the same hash and owner exists.
+func (db *DB) ImportFile(f DBFile, rawData []byte) (uint64, error) {
+	if f.Blob != "" && f.Blob != blob.Hash(rawData) {
+		return 0, fmt.Errorf("Raw data of %v does not match its hash", f.Name)
 	}
-	if b == nil || len(b) == 0 {
-		return result, nil
+	blobHash, err := db.Blobs.Put(bytes.NewReader(rawData))
+	if err != nil {
+		return 0, err
 	}
-	dec := gob.NewDecoder(bytes.NewBuffer(b))
-	err = dec.Decode(&result)
+	f.Blob = blobHash
+	f.Size = int64(len(rawData))
+	f.RawData = nil
+	var keyInt uint64
+	err = db.Handle.Update(func(tx *bolt.Tx) error {
+		if f.Hash != "" && tx.Bucket([]byte(hashIndexBucket)).Get(hashKey(f.Owner, f.Hash)) != nil {
+			return ErrDuplicate
+		}
+		bucket := tx.Bucket([]byte(fileBucket))
+
+		keyInt, _ = bucket.NextSequence()
+		key := Itob(keyInt)
+
+		b, err := db.encodeFile(&f)
+		if err != nil {
+			return err
+		}
+		err = bucket.Put(key, b)
+		if err != nil {
+			return err
+		}
+		err = updateIndexes(tx, keyInt, nil, &f)
+		if err != nil {
+			return err
+		}
+		err = writeJournal(tx, JournalUpdate, keyInt)
+		if err != nil {
+			return err
+		}
+		// imported again on purpose
+		return tx.Bucket([]byte(purgedBucket)).Delete(hashKey(f.Owner, f.Hash))
+	})
 	if err != nil {
-		return result, err
+		// the blob may be referenced by another document
+		db.releaseBlob(blobHash)
+		return 0, err
 	}
-	return result, nil
+	return keyInt, nil
 }
 
-func (db *DB) storeHashTable() error {
-	buf := &bytes.Buffer{}
-	enc := gob.NewEncoder(buf)
-	err := enc.Encode(db.hashTable)
+// UpdateFile applies modify to the stored document with the given key
+func (db *DB) UpdateFile(key uint64, modify func(f *DBFile) error) error {
+	return db.Handle.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(fileBucket))
+		b := bucket.Get(Itob(key))
+		if b == nil {
+			return ErrNotFound
+		}
+		// decoded twice, modify may change slices in place
+		old := &DBFile{}
+		err := db.decodeFile(b, old)
+		if err != nil {
+			return err
+		}
+		f := &DBFile{}
+		err = db.decodeFile(b, f)
+		if err != nil {
+			return err
+		}
+		err = modify(f)
+		if err != nil {
+			return err
+		}
+		b, err = db.encodeFile(f)
+		if err != nil {
+			return err
+		}
+		err = bucket.Put(Itob(key), b)
+		if err != nil {
+			return err
+		}
+		err = updateIndexes(tx, key, old, f)
+		if err != nil {
+			return err
+		}
+		return writeJournal(tx, JournalUpdate, key)
+	})
+}
+
+// ReplaceContent updates a document after its source file has changed
+func (db *DB) ReplaceContent(key uint64, hash string, rawData []byte, content []string) error {
+	blobHash, err := db.Blobs.Put(bytes.NewReader(rawData))
 	if err != nil {
 		return err
 	}
-	err = db.Handle.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte(hashBucket))
-		err := bucket.Put([]byte(hashKey), buf.Bytes())
-		return err
+	oldBlob := ""
+	err = db.UpdateFile(key, func(f *DBFile) error {
+		oldBlob = f.Blob
+		f.Hash = hash
+		f.Blob = blobHash
+		f.Size = int64(len(rawData))
+		f.Content = content
+		return nil
 	})
 	if err != nil {
 		return err
 	}
+	if oldBlob != blobHash {
+		return db.releaseBlob(oldBlob)
+	}
 	return nil
 }
 
-func (db *DB) Contains(hash string) bool {
-	_, ok := db.hashTable[hash]
-	return ok
+// UpdatePath records a new location of the source file of a document
+func (db *DB) UpdatePath(key uint64, path string) error {
+	return db.UpdateFile(key, func(f *DBFile) error {
+		f.Path = path
+		f.Name = filepath.Base(path)
+		return nil
+	})
 }
 
-func (db *DB) AddFile(path string, hash string, rawData []byte, content []string) error {
-	err := db.Handle.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte(fileBucket))
-
-		keyInt, _ := bucket.NextSequence()
+// DeleteFile removes a document, its source may be imported again
+func (db *DB) DeleteFile(key uint64) error {
+	return db.deleteFile(key, false)
+}
 
-		filename := filepath.Base(path)
-		key := Itob(keyInt)
-		f := &DBFile{Name: filename, Path: path, RawData: rawData, Content: content, ImportDate: time.Now()}
+// PurgeFile removes a document for good, its hash is kept to prevent
+// importing the source again
+func (db *DB) PurgeFile(key uint64) error {
+	return db.deleteFile(key, true)
+}
 
-		buf := &bytes.Buffer{}
-		enc := gob.NewEncoder(buf)
-		err := enc.Encode(f)
+func (db *DB) deleteFile(key uint64, purge bool) error {
+	blobHash := ""
+	err := db.Handle.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(fileBucket))
+		b := bucket.Get(Itob(key))
+		if b == nil {
+			return ErrNotFound
+		}
+		var f DBFile
+		err := db.decodeFile(b, &f)
 		if err != nil {
 			return err
 		}
-		err = bucket.Put(key, buf.Bytes())
+		blobHash = f.Blob
+		err = bucket.Delete(Itob(key))
 		if err != nil {
 			return err
 		}
-		return nil
+		err = updateIndexes(tx, key, &f, nil)
+		if err != nil {
+			return err
+		}
+		err = writeJournal(tx, JournalRemove, key)
+		if err != nil {
+			return err
+		}
+		if purge && f.Hash != "" {
+			err = tx.Bucket([]byte(purgedBucket)).Put(hashKey(f.Owner, f.Hash), timeKey(time.Now()))
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Bucket([]byte(signatureBucket)).Delete(Itob(key))
 	})
 	if err != nil {
 		return err
 	}
+	return db.releaseBlob(blobHash)
+}
 
-	db.hashTable[hash] = true
-	db.storeHashTable()
-	return nil
+// PurgedHashes returns the hashes of all purged documents, those of private
+// documents prefixed with their owner
+func (db *DB) PurgedHashes() ([]string, error) {
+	hashes := []string{}
+	err := db.Handle.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(purgedBucket)).ForEach(func(k, v []byte) error {
+			hashes = append(hashes, string(k))
+			return nil
+		})
+	})
+	return hashes, err
+}
+
+// SetPurged blocks a hash returned by PurgedHashes from being imported, unless
+// a document with it exists
+func (db *DB) SetPurged(hash string) error {
+	return db.Handle.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(hashIndexBucket)).Get([]byte(hash)) != nil {
+			return nil
+		}
+		return tx.Bucket([]byte(purgedBucket)).Put([]byte(hash), timeKey(time.Now()))
+	})
+}
+
+// releaseBlob deletes raw file data no document refers to anymore
+func (db *DB) releaseBlob(hash string) error {
+	if hash == "" {
+		return nil
+	}
+	db.pinMtx.Lock()
+	defer db.pinMtx.Unlock()
+	if db.pins > 0 {
+		db.released = append(db.released, hash)
+		return nil
+	}
+	return db.deleteUnused(hash)
+}
+
+func (db *DB) deleteUnused(hash string) error {
+	used, err := db.blobUsed(hash)
+	if err != nil || used {
+		return err
+	}
+	return db.Blobs.Delete(hash)
+}
+
+// PinBlobs keeps the raw file data of documents purged or replaced from now
+// on until unpin is called, e.g. while an export reads it without blocking
+// changes
+func (db *DB) PinBlobs() (unpin func() error) {
+	db.pinMtx.Lock()
+	db.pins++
+	db.pinMtx.Unlock()
+	var once sync.Once
+	return func() error {
+		var err error
+		once.Do(func() {
+			db.pinMtx.Lock()
+			defer db.pinMtx.Unlock()
+			db.pins--
+			if db.pins > 0 {
+				return
+			}
+			released := db.released
+			db.released = nil
+			for _, hash := range released {
+				// the same data may have been imported again meanwhile
+				if e := db.deleteUnused(hash); e != nil && err == nil {
+					err = e
+				}
+			}
+		})
+		return err
+	}
+}
+
+// OpenRaw returns the raw file data of a document
+func (db *DB) OpenRaw(f *DBFile) (blob.Blob, error) {
+	return db.Blobs.Open(f.Blob)
+}
+
+// ReadRaw returns the complete raw file data of a document
+func (db *DB) ReadRaw(f *DBFile) ([]byte, error) {
+	return blob.ReadAll(db.Blobs, f.Blob)
+}
+
+// FindFiles returns the keys of all documents matching the filter
+func (db *DB) FindFiles(filter func(file *DBFile) bool) ([]uint64, error) {
+	result := []uint64{}
+	err := db.GetAllFiles(func(key uint64, file DBFile) {
+		if filter(&file) {
+			result = append(result, key)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
 }
 
 func (db *DB) GetAllFiles(cb func(key uint64, file DBFile)) error {
 	err := db.Handle.View(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(fileBucket))
 		err := bucket.ForEach(func(k, v []byte) error {
-			buf := bytes.NewBuffer(v)
-			dec := gob.NewDecoder(buf)
 			var f DBFile
-			err := dec.Decode(&f)
+			err := db.decodeFile(v, &f)
 			if err != nil {
 				return err
 			}
@@ -172,12 +500,9 @@ func (db *DB) GetFile(key uint64) (*DBFile, error) {
 		bucket := tx.Bucket([]byte(fileBucket))
 		b := bucket.Get(Itob(key))
 		if b == nil {
-			return fmt.Errorf("Document with key %v not found", key)
+			return ErrNotFound
 		}
-		buf := bytes.NewBuffer(b)
-		dec := gob.NewDecoder(buf)
-
-		err := dec.Decode(f)
+		err := db.decodeFile(b, f)
 		if err != nil {
 			return err
 		}
@@ -190,6 +515,30 @@ func (db *DB) GetFile(key uint64) (*DBFile, error) {
 	return f, nil
 }
 
+// SetSignature stores the MinHash signature of a document used for duplicate detection
+func (db *DB) SetSignature(key uint64, sig []uint64) error {
+	b := make([]byte, 0, 8*len(sig))
+	for _, v := range sig {
+		b = append(b, Itob(v)...)
+	}
+	return db.Handle.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(signatureBucket)).Put(Itob(key), b)
+	})
+}
+
+func (db *DB) GetAllSignatures(cb func(key uint64, sig []uint64)) error {
+	return db.Handle.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(signatureBucket)).ForEach(func(k, v []byte) error {
+			sig := make([]uint64, len(v)/8)
+			for i := range sig {
+				sig[i] = Btoi(v[i*8 : (i+1)*8])
+			}
+			cb(Btoi(k), sig)
+			return nil
+		})
+	})
+}
+
 func Itob(v uint64) []byte {
 	b := make([]byte, 8)
 	binary.BigEndian.PutUint64(b, v)
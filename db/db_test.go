@@ -1,12 +1,23 @@
 package db
 
 import (
+	"bytes"
+	"encoding/gob"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/reusing-code/dochan/blob"
+	"github.com/reusing-code/dochan/crypt"
+	"github.com/reusing-code/dochan/migrate"
 )
 
 func TestOpenCloseDB(t *testing.T) {
 	defer os.Remove("test.db")
+	defer os.RemoveAll("test.blobs")
 	db, err := New("test.db")
 	if err != nil {
 		t.Fatal(err)
@@ -23,41 +34,638 @@ func TestOpenCloseDB(t *testing.T) {
 	}
 }
 
-func TestSetGetHashTable(t *testing.T) {
+func TestIndexes(t *testing.T) {
+	defer os.Remove("test.db")
+	defer os.RemoveAll("test.blobs")
+	db, err := New("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	start := time.Now()
+	keyA, _ := db.AddFile("dir/a.pdf", "hashA", []byte("a"), []string{"a"})
+	keyB, _ := db.AddFile("dir/sub/b.pdf", "hashB", []byte("b"), []string{"b"})
+	keyC, _ := db.AddFile("dirx/c.pdf", "hashC", []byte("c"), []string{"c"})
+	middle := time.Now()
+	keyD, _ := db.AddFile("d.pdf", "hashD", []byte("d"), []string{"d"})
+
+	if key, ok := db.KeyByHash("", "hashB"); !ok || key != keyB {
+		t.Errorf("Want %v for hash, got %v %v", keyB, key, ok)
+	}
+	if key, ok := db.KeyByPath("dir/a.pdf"); !ok || key != keyA {
+		t.Errorf("Want %v for path, got %v %v", keyA, key, ok)
+	}
+	keys, _ := db.KeysByPathPrefix("dir/")
+	if len(keys) != 2 || keys[0] != keyA || keys[1] != keyB {
+		t.Errorf("Want [%v %v] below dir/, got %v", keyA, keyB, keys)
+	}
+	keys, _ = db.KeysByImportDate(start, middle)
+	if len(keys) != 3 || keys[0] != keyA || keys[2] != keyC {
+		t.Errorf("Want 3 keys imported before %v, got %v", middle, keys)
+	}
+	keys, _ = db.KeysByImportDate(middle, time.Time{})
+	if len(keys) != 1 || keys[0] != keyD {
+		t.Errorf("Want [%v] imported after %v, got %v", keyD, middle, keys)
+	}
+
+	db.UpdateFile(keyA, func(f *DBFile) error {
+		f.Tags = []string{"car", "tax"}
+		return nil
+	})
+	db.UpdateFile(keyC, func(f *DBFile) error {
+		f.Tags = []string{"car"}
+		return nil
+	})
+	db.UpdateFile(keyA, func(f *DBFile) error {
+		f.Tags[1] = "insurance"
+		return nil
+	})
+	keys, _ = db.KeysByTag("car")
+	if len(keys) != 2 || keys[0] != keyA || keys[1] != keyC {
+		t.Errorf("Want [%v %v] for tag, got %v", keyA, keyC, keys)
+	}
+	keys, _ = db.KeysByTag("tax")
+	if len(keys) != 0 {
+		t.Errorf("Removed tag still indexed: %v", keys)
+	}
+	keys, _ = db.KeysByTag("ca")
+	if len(keys) != 0 {
+		t.Errorf("Tag prefix matched: %v", keys)
+	}
+
+	db.UpdatePath(keyB, "e.pdf")
+	db.DeleteFile(keyD)
+	if _, ok := db.KeyByPath("dir/sub/b.pdf"); ok {
+		t.Error("Old path still indexed")
+	}
+	if _, ok := db.KeyByHash("", "hashD"); ok || db.Contains("", "hashD") {
+		t.Error("Hash of deleted file still indexed")
+	}
+	keys, _ = db.KeysByImportDate(start, time.Time{})
+	if len(keys) != 3 {
+		t.Errorf("Want 3 keys after delete, got %v", keys)
+	}
+}
+
+func TestAddUpdateFile(t *testing.T) {
+	defer os.Remove("test.db")
+	defer os.RemoveAll("test.blobs")
+	db, err := New("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	key, err := db.AddFile("a/b.pdf", "hash", []byte("raw"), []string{"content"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !db.Contains("", "hash") {
+		t.Error("Hash not found after adding file")
+	}
+	err = db.UpdateFile(key, func(f *DBFile) error {
+		f.Type = "invoice"
+		f.Tags = []string{"car"}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := db.GetFile(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Name != "b.pdf" || f.Type != "invoice" || len(f.Tags) != 1 {
+		t.Errorf("Unexpected file after update: %v %v %v", f.Name, f.Type, f.Tags)
+	}
+	err = db.UpdateFile(key+1, func(f *DBFile) error { return nil })
+	if err != ErrNotFound {
+		t.Errorf("Want ErrNotFound updating unknown file, got %v", err)
+	}
+}
+
+func TestSignatures(t *testing.T) {
+	defer os.Remove("test.db")
+	defer os.RemoveAll("test.blobs")
+	db, err := New("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	err = db.SetSignature(7, []uint64{1, 2, 1 << 63})
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	err = db.GetAllSignatures(func(key uint64, sig []uint64) {
+		count++
+		if key != 7 || len(sig) != 3 || sig[2] != 1<<63 {
+			t.Errorf("Unexpected signature %v: %v", key, sig)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("Want 1 signature, got %d", count)
+	}
+}
+
+func TestFindDeleteFile(t *testing.T) {
+	defer os.Remove("test.db")
+	defer os.RemoveAll("test.blobs")
+	db, err := New("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	key, err := db.AddFile("a/b.pdf", "hash1", []byte("raw"), []string{"content"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.UpdatePath(key, "c/d.pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := db.FindFiles(func(f *DBFile) bool { return f.Path == "c/d.pdf" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != key {
+		t.Errorf("Want key %v for moved file, got %v", key, keys)
+	}
+
+	err = db.ReplaceContent(key, "hash2", []byte("new"), []string{"new content"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.Contains("", "hash1") || !db.Contains("", "hash2") {
+		t.Error("Hash table not updated after replacing content")
+	}
+
+	err = db.DeleteFile(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.Contains("", "hash2") {
+		t.Error("Hash of deleted file still known")
+	}
+	_, err = db.GetFile(key)
+	if err == nil {
+		t.Error("Deleted file still stored")
+	}
+}
+
+func TestRebuildIndexes(t *testing.T) {
+	defer os.Remove("test.db")
+	defer os.RemoveAll("test.blobs")
+	db, err := New("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	_, err = db.AddFile("a.pdf", "hash", []byte("raw"), []string{"content"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Handle.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(hashIndexBucket)).Put([]byte("stale"), Itob(42))
+	})
+
+	stale, err := db.RebuildIndexes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stale != 1 || db.Contains("", "stale") || !db.Contains("", "hash") {
+		t.Errorf("Unexpected indexes after rebuild: %d stale", stale)
+	}
+	if _, ok := db.KeyByPath("a.pdf"); !ok {
+		t.Error("Path index not rebuilt")
+	}
+}
+
+func TestPurgeFile(t *testing.T) {
+	defer os.Remove("test.db")
+	defer os.RemoveAll("test.blobs")
+	db, err := New("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	key, err := db.AddFile("a/b.pdf", "hash1", []byte("raw"), []string{"content"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.PurgeFile(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !db.Contains("", "hash1") || !db.IsPurged("", "hash1") {
+		t.Error("Hash of purged file not blocked")
+	}
+	_, err = db.RebuildIndexes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !db.IsPurged("", "hash1") {
+		t.Error("Purged hash dropped by rebuild")
+	}
+
+	_, err = db.AddFile("a/b.pdf", "hash1", []byte("raw"), []string{"content"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.IsPurged("", "hash1") {
+		t.Error("Hash still purged after adding the file again")
+	}
+}
+
+func TestHashPerOwner(t *testing.T) {
+	defer os.Remove("test.db")
+	defer os.RemoveAll("test.blobs")
+	db, err := New("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	shared, err := db.AddFile("a.pdf", "hash", []byte("raw"), []string{"content"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	private, err := db.ImportFile(DBFile{Path: "private/alice/a.pdf", Hash: "hash", Owner: "alice"}, []byte("raw"))
+	if err != nil {
+		t.Fatalf("Copy of another owner rejected: %v", err)
+	}
+	if _, err = db.ImportFile(DBFile{Path: "private/alice/b.pdf", Hash: "hash", Owner: "alice"}, []byte("raw")); err != ErrDuplicate {
+		t.Errorf("Want ErrDuplicate for the same owner, got %v", err)
+	}
+	if k, _ := db.KeyByHash("", "hash"); k != shared {
+		t.Errorf("Want shared document %v, got %v", shared, k)
+	}
+	if k, _ := db.KeyByHash("alice", "hash"); k != private {
+		t.Errorf("Want private document %v, got %v", private, k)
+	}
+	if db.Contains("bob", "hash") {
+		t.Error("Hash of other owners visible")
+	}
+	err = db.PurgeFile(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !db.IsPurged("alice", "hash") || db.IsPurged("", "hash") {
+		t.Error("Purged hash not scoped by owner")
+	}
+
+	// both copies share the raw file data
+	f, _ := db.GetFile(shared)
+	if _, err = db.Blobs.Open(f.Blob); err != nil {
+		t.Errorf("Raw data of the remaining copy deleted: %v", err)
+	}
+	err = db.DeleteFile(shared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Blobs.Open(f.Blob); err == nil {
+		t.Error("Raw data of deleted copies still stored")
+	}
+}
+
+func TestPinBlobs(t *testing.T) {
 	defer os.Remove("test.db")
+	defer os.RemoveAll("test.blobs")
 	db, err := New("test.db")
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer db.Close()
 
-	table, err := db.loadHashTable()
+	a, err := db.AddFile("a.pdf", "hashA", []byte("raw A"), []string{"A"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := db.AddFile("b.pdf", "hashB", []byte("raw B"), []string{"B"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileA, _ := db.GetFile(a)
+	fileB, _ := db.GetFile(b)
+	unpin := db.PinBlobs()
+	for _, key := range []uint64{a, b} {
+		err = db.PurgeFile(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []*DBFile{fileA, fileB} {
+		if _, err := blob.ReadAll(db.Blobs, f.Blob); err != nil {
+			t.Errorf("Blob of %v deleted while pinned: %v", f.Path, err)
+		}
+	}
+	// imported again while pinned, the blob is in use again
+	_, err = db.AddFile("a.pdf", "hashA", []byte("raw A"), []string{"A"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = unpin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := blob.ReadAll(db.Blobs, fileA.Blob); err != nil {
+		t.Errorf("Blob in use deleted: %v", err)
+	}
+	if _, err := blob.ReadAll(db.Blobs, fileB.Blob); err != blob.ErrNotFound {
+		t.Errorf("Released blob not deleted after unpinning: %v", err)
+	}
+}
+
+func TestBlobs(t *testing.T) {
+	defer os.Remove("test.db")
+	defer os.RemoveAll("test.blobs")
+	db, err := New("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := db.AddFile("a/b.pdf", "hash1", []byte("raw"), []string{"content"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, _ := db.GetFile(key)
+	raw, err := db.ReadRaw(f)
+	if err != nil || string(raw) != "raw" || f.Size != 3 {
+		t.Errorf("Wrong raw data %q (size %v): %v", raw, f.Size, err)
+	}
+	oldBlob := f.Blob
+	err = db.ReplaceContent(key, "hash2", []byte("new"), []string{"new content"})
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(table) != 0 {
-		t.Error("Hash table not empty")
+	if _, err = db.Blobs.Open(oldBlob); err == nil {
+		t.Error("Replaced raw data still stored")
 	}
 
-	table = make(map[string]bool)
-	table["test"] = true
-	table["bla"] = true
+	// documents written before the blob store existed, the second one before
+	// hashes were stored with documents
+	legacy := DBFile{Name: "c.pdf", Path: "c.pdf", Hash: "hash3", RawData: []byte("legacy")}
+	unhashed := DBFile{Name: "d.pdf", Path: "d.pdf", RawData: []byte("unhashed")}
+	err = db.Handle.Update(func(tx *bolt.Tx) error {
+		for i, f := range []DBFile{legacy, unhashed} {
+			buf := &bytes.Buffer{}
+			err := gob.NewEncoder(buf).Encode(f)
+			if err != nil {
+				return err
+			}
+			err = tx.Bucket([]byte(fileBucket)).Put(Itob(key+1+uint64(i)), buf.Bytes())
+			if err != nil {
+				return err
+			}
+		}
+		// hash table of DBs without indexes
+		buf := &bytes.Buffer{}
+		err := gob.NewEncoder(buf).Encode(map[string]bool{"hash3": true, sourceHash([]byte("unhashed")): true, "gone": false})
+		if err != nil {
+			return err
+		}
+		hashes, err := tx.CreateBucket([]byte("hashes"))
+		if err != nil {
+			return err
+		}
+		err = hashes.Put([]byte("hashes"), buf.Bytes())
+		if err != nil {
+			return err
+		}
+		return migrate.SetVersion(tx, 0)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	res, err := Migrate("test.db", migrate.Options{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.From != 0 || res.To != 5 || len(res.Applied) != 5 || res.Backup != "" {
+		t.Errorf("Unexpected dry run result %+v", res)
+	}
+	defer os.Remove("test.db.v0.bak")
+	db, err = New("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := os.Stat("test.db.v0.bak"); err != nil {
+		t.Error("No backup made before migrating")
+	}
+	f, _ = db.GetFile(key + 1)
+	raw, err = db.ReadRaw(f)
+	if f.RawData != nil || string(raw) != "legacy" {
+		t.Errorf("Raw data not moved to blob store: %q %q %v", f.RawData, raw, err)
+	}
+	if k, ok := db.KeyByHash("", "hash3"); !ok || k != key+1 || !db.IsPurged("", "gone") {
+		t.Error("Hash table not moved to indexes")
+	}
+	if k, ok := db.KeyByHash("", sourceHash([]byte("unhashed"))); !ok || k != key+2 {
+		t.Error("Document stored without hash not found by the hash of its content")
+	}
 
-	db.hashTable = table
-	err = db.storeHashTable()
+	f, _ = db.GetFile(key)
+	err = db.DeleteFile(key)
 	if err != nil {
 		t.Fatal(err)
 	}
+	if _, err = db.Blobs.Open(f.Blob); err == nil {
+		t.Error("Raw data of deleted file still stored")
+	}
+}
 
-	table, err = db.loadHashTable()
+func TestBackfillHashes(t *testing.T) {
+	defer os.Remove("test.db")
+	defer os.Remove("test.db.v0.bak")
+	defer os.Remove("test.db.v3.bak")
+	defer os.RemoveAll("test.blobs")
+	secret := crypt.Passphrase("secret")
+	db, err := NewWithSecret("test.db", secret)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(table) != 2 {
-		t.Error("Hash table does not have 2 entries")
+	// moved to the blob store by a version of moveRawData not adding hashes
+	key, err := db.AddFile("a.pdf", "", []byte("raw"), []string{"content"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Handle.Update(func(tx *bolt.Tx) error {
+		return migrate.SetVersion(tx, 3)
+	})
+	if err != nil {
+		t.Fatal(err)
 	}
-	_, ok := table["bla"]
-	if !ok {
-		t.Error("Table entry not present")
+	db.Close()
+
+	if _, err = Migrate("test.db", migrate.Options{DryRun: true}); err == nil {
+		t.Error("Raw data of an encrypted DB hashed without key")
+	}
+	db, err = NewWithSecret("test.db", secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	f, err := db.GetFile(key)
+	if err != nil || f.Hash != sourceHash([]byte("raw")) || len(f.Content) != 1 {
+		t.Errorf("Wrong document after adding its hash %+v: %v", f, err)
+	}
+	if k, ok := db.KeyByHash("", sourceHash([]byte("raw"))); !ok || k != key {
+		t.Error("Document not found by the added hash")
+	}
+}
+
+func TestJournal(t *testing.T) {
+	defer os.Remove("test.db")
+	defer os.RemoveAll("test.blobs")
+	db, err := New("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	keyA, _ := db.AddFile("a.pdf", "hashA", []byte("a"), []string{"a"})
+	keyB, _ := db.AddFile("b.pdf", "hashB", []byte("b"), []string{"b"})
+	seq, err := db.JournalSeq()
+	if err != nil || seq != 2 {
+		t.Errorf("Want journal seq 2, got %v %v", seq, err)
+	}
+	db.UpdatePath(keyA, "c.pdf")
+	db.DeleteFile(keyB)
+	_, err = db.AddFile("d.pdf", "hashA", []byte("a"), []string{"a"})
+	if err != ErrDuplicate {
+		t.Errorf("Want ErrDuplicate, got %v", err)
+	}
+
+	entries, err := db.Journal(seq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []JournalEntry{{3, JournalUpdate, keyA}, {4, JournalRemove, keyB}}
+	if len(entries) != len(want) || entries[0] != want[0] || entries[1] != want[1] {
+		t.Errorf("Want journal %v, got %v", want, entries)
+	}
+
+	err = db.TrimJournal(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, _ = db.Journal(0)
+	if len(entries) != 1 || entries[0] != want[1] {
+		t.Errorf("Want %v after trimming, got %v", want[1:], entries)
+	}
+}
+
+// sealedStore is encrypted with the keys of a DB
+type sealedStore struct {
+	cipher blob.Cipher
+	data   []byte
+}
+
+func (s *sealedStore) Reseal() error {
+	plain, err := s.cipher.Decrypt(s.data)
+	if err != nil {
+		return err
+	}
+	s.data, err = s.cipher.Encrypt(plain)
+	return err
+}
+
+func TestEncryption(t *testing.T) {
+	defer os.Remove("test.db")
+	defer os.RemoveAll("test.blobs")
+	db, err := New("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plainKey, _ := db.AddFile("a.pdf", "hashA", []byte("plain raw"), []string{"plain text"})
+	db.Close()
+
+	secret := crypt.Passphrase("secret")
+	db, err = NewWithSecret("test.db", secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := db.AddFile("b.pdf", "hashB", []byte("secret raw"), []string{"secret text"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := func(key uint64) (record, raw []byte) {
+		db.Handle.View(func(tx *bolt.Tx) error {
+			record = append(record, tx.Bucket([]byte(fileBucket)).Get(Itob(key))...)
+			return nil
+		})
+		f, _ := db.GetFile(key)
+		raw, _ = ioutil.ReadFile(filepath.Join("test.blobs", f.Blob[:2], f.Blob))
+		return record, raw
+	}
+	record, raw := stored(key)
+	if bytes.Contains(record, []byte("secret text")) || bytes.Contains(raw, []byte("secret raw")) {
+		t.Error("Document stored unencrypted")
+	}
+	f, err := db.GetFile(key)
+	if err != nil || len(f.Content) != 1 || f.Content[0] != "secret text" {
+		t.Errorf("Wrong content %q: %v", f.Content, err)
+	}
+	if data, err := db.ReadRaw(f); err != nil || string(data) != "secret raw" {
+		t.Errorf("Wrong raw data %q: %v", data, err)
+	}
+	// data stored before encryption was enabled stays readable
+	f, err = db.GetFile(plainKey)
+	if err != nil || f.Content[0] != "plain text" {
+		t.Errorf("Wrong content %q: %v", f.Content, err)
+	}
+
+	other := &sealedStore{cipher: db.Cipher()}
+	other.data, err = other.cipher.Encrypt([]byte("derived"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := db.Reencrypt(other)
+	if err != nil || n != 2 {
+		t.Fatalf("Reencrypt: %v %v", n, err)
+	}
+	if plain, err := other.cipher.Decrypt(other.data); err != nil || string(plain) != "derived" {
+		t.Errorf("Other store not encrypted with the new key: %q %v", plain, err)
+	}
+	record, raw = stored(plainKey)
+	if bytes.Contains(record, []byte("plain text")) || bytes.Contains(raw, []byte("plain raw")) {
+		t.Error("Document not encrypted by Reencrypt")
+	}
+	err = db.ChangeSecret(crypt.Passphrase("other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	if _, err = New("test.db"); err != ErrEncrypted {
+		t.Errorf("Want ErrEncrypted without key, got %v", err)
+	}
+	if _, err = NewWithSecret("test.db", secret); err != crypt.ErrWrongSecret {
+		t.Errorf("Want ErrWrongSecret for old passphrase, got %v", err)
+	}
+	db, err = NewWithSecret("test.db", crypt.Passphrase("other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, k := range []uint64{plainKey, key} {
+		f, err := db.GetFile(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.ReadRaw(f); err != nil {
+			t.Errorf("Raw data of %v not readable after reencrypting: %v", k, err)
+		}
 	}
 }
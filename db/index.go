@@ -0,0 +1,252 @@
+package db
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+)
+
+// Secondary indexes, kept up to date in the same transaction as the documents.
+// Unique indexes map their key to the document key, the others end their keys
+// with the document key and have no value.
+const (
+	hashIndexBucket = "index.hash"
+	pathIndexBucket = "index.path"
+	dateIndexBucket = "index.importDate"
+	tagIndexBucket  = "index.tag"
+	// raw file data, shared by documents of different owners with the same content
+	blobIndexBucket = "index.blob"
+	// hashes of purged documents, which must not be imported again
+	purgedBucket = "purged"
+)
+
+var indexBuckets = []string{hashIndexBucket, pathIndexBucket, dateIndexBucket, tagIndexBucket, blobIndexBucket}
+
+type indexEntry struct {
+	bucket string
+	key    []byte
+	unique bool
+}
+
+func indexEntries(key uint64, f *DBFile) []indexEntry {
+	var entries []indexEntry
+	if f.Hash != "" {
+		entries = append(entries, indexEntry{hashIndexBucket, hashKey(f.Owner, f.Hash), true})
+	}
+	if f.Path != "" {
+		entries = append(entries, indexEntry{pathIndexBucket, []byte(f.Path), true})
+	}
+	entries = append(entries, indexEntry{dateIndexBucket, append(timeKey(f.ImportDate), Itob(key)...), false})
+	for _, tag := range f.Tags {
+		entries = append(entries, indexEntry{tagIndexBucket, append(tagPrefix(tag), Itob(key)...), false})
+	}
+	if f.Blob != "" {
+		entries = append(entries, indexEntry{blobIndexBucket, append([]byte(f.Blob), Itob(key)...), false})
+	}
+	return entries
+}
+
+// hashKey is the key of a source file hash in the hash index and the purged
+// hashes. Documents of different owners may have the same content, the hashes
+// of private documents are prefixed with their owner.
+func hashKey(owner, hash string) []byte {
+	if owner == "" {
+		return []byte(hash)
+	}
+	return []byte(owner + "/" + hash)
+}
+
+// timeKey encodes t so that keys sort by time, times before 1970 sort first
+func timeKey(t time.Time) []byte {
+	if t.Before(time.Unix(0, 0)) {
+		return Itob(0)
+	}
+	return Itob(uint64(t.UnixNano()))
+}
+
+func tagPrefix(tag string) []byte {
+	return append([]byte(tag), 0)
+}
+
+// updateIndexes replaces the index entries of the old version of a document
+// with those of the new one. old is nil for new documents, f for deleted ones.
+func updateIndexes(tx *bolt.Tx, key uint64, old, f *DBFile) error {
+	if old != nil {
+		for _, e := range indexEntries(key, old) {
+			bucket := tx.Bucket([]byte(e.bucket))
+			// don't remove the entry of another document with the same hash or path
+			if e.unique && !bytes.Equal(bucket.Get(e.key), Itob(key)) {
+				continue
+			}
+			err := bucket.Delete(e.key)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if f != nil {
+		for _, e := range indexEntries(key, f) {
+			value := []byte{}
+			if e.unique {
+				value = Itob(key)
+			}
+			err := tx.Bucket([]byte(e.bucket)).Put(e.key, value)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// rebuildIndexes recreates all indexes from the stored documents and returns
+// the number of hash index entries that did not belong to their document
+func rebuildIndexes(tx *bolt.Tx) (int, error) {
+	files := tx.Bucket([]byte(fileBucket))
+	stale := 0
+	if hashes := tx.Bucket([]byte(hashIndexBucket)); hashes != nil {
+		err := hashes.ForEach(func(k, v []byte) error {
+			b := files.Get(v)
+			if b == nil {
+				stale++
+				return nil
+			}
+			var f DBFile
+			err := gob.NewDecoder(bytes.NewBuffer(b)).Decode(&f)
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(hashKey(f.Owner, f.Hash), k) {
+				stale++
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	for _, name := range indexBuckets {
+		if tx.Bucket([]byte(name)) != nil {
+			err := tx.DeleteBucket([]byte(name))
+			if err != nil {
+				return 0, err
+			}
+		}
+		_, err := tx.CreateBucket([]byte(name))
+		if err != nil {
+			return 0, fmt.Errorf("create bucket %q: %q", name, err)
+		}
+	}
+	err := files.ForEach(func(k, v []byte) error {
+		var f DBFile
+		err := gob.NewDecoder(bytes.NewBuffer(v)).Decode(&f)
+		if err != nil {
+			return err
+		}
+		return updateIndexes(tx, Btoi(k), nil, &f)
+	})
+	return stale, err
+}
+
+// RebuildIndexes recreates the secondary indexes from the stored documents and
+// returns the number of hashes that did not belong to any document
+func (db *DB) RebuildIndexes() (int, error) {
+	stale := 0
+	err := db.Handle.Update(func(tx *bolt.Tx) error {
+		var err error
+		stale, err = rebuildIndexes(tx)
+		return err
+	})
+	return stale, err
+}
+
+func (db *DB) uniqueKey(bucket string, value string) (uint64, bool) {
+	var key uint64
+	found := false
+	db.Handle.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket([]byte(bucket)).Get([]byte(value)); v != nil {
+			key, found = Btoi(v), true
+		}
+		return nil
+	})
+	return key, found
+}
+
+// KeyByHash returns the key of the document of owner with the given source
+// file hash, owner is empty for documents visible to everyone
+func (db *DB) KeyByHash(owner, hash string) (uint64, bool) {
+	return db.uniqueKey(hashIndexBucket, string(hashKey(owner, hash)))
+}
+
+// KeyByPath returns the key of the document stored from path
+func (db *DB) KeyByPath(path string) (uint64, bool) {
+	return db.uniqueKey(pathIndexBucket, path)
+}
+
+// scanKeys returns the document keys of all index entries in [from, to), an
+// empty to means no upper bound. With suffixKey the document key ends the index
+// key, otherwise it is the value.
+func (db *DB) scanKeys(bucket string, from, to []byte, suffixKey bool) ([]uint64, error) {
+	result := []uint64{}
+	err := db.Handle.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte(bucket)).Cursor()
+		for k, v := c.Seek(from); k != nil && (len(to) == 0 || bytes.Compare(k, to) < 0); k, v = c.Next() {
+			if suffixKey {
+				result = append(result, Btoi(k[len(k)-8:]))
+			} else {
+				result = append(result, Btoi(v))
+			}
+		}
+		return nil
+	})
+	return result, err
+}
+
+// prefixEnd returns the first key after all keys starting with prefix, nil if
+// there is none
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// KeysByPathPrefix returns the keys of all documents with a path starting with
+// prefix, ordered by path
+func (db *DB) KeysByPathPrefix(prefix string) ([]uint64, error) {
+	return db.scanKeys(pathIndexBucket, []byte(prefix), prefixEnd([]byte(prefix)), false)
+}
+
+// KeysByImportDate returns the keys of all documents imported in [from, to),
+// ordered by import date. A zero to means no upper bound.
+func (db *DB) KeysByImportDate(from, to time.Time) ([]uint64, error) {
+	var end []byte
+	if !to.IsZero() {
+		end = timeKey(to)
+	}
+	return db.scanKeys(dateIndexBucket, timeKey(from), end, true)
+}
+
+// blobUsed reports whether a document refers to the raw file data with hash
+func (db *DB) blobUsed(hash string) (bool, error) {
+	used := false
+	err := db.Handle.View(func(tx *bolt.Tx) error {
+		k, _ := tx.Bucket([]byte(blobIndexBucket)).Cursor().Seek([]byte(hash))
+		used = k != nil && bytes.HasPrefix(k, []byte(hash))
+		return nil
+	})
+	return used, err
+}
+
+// KeysByTag returns the keys of all documents with the given tag
+func (db *DB) KeysByTag(tag string) ([]uint64, error) {
+	prefix := tagPrefix(tag)
+	return db.scanKeys(tagIndexBucket, prefix, prefixEnd(prefix), true)
+}
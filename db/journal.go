@@ -0,0 +1,73 @@
+package db
+
+import (
+	bolt "github.com/coreos/bbolt"
+)
+
+// The journal records every change of a document in the same transaction as
+// the change itself. Indexes kept outside the DB, like the search index, apply
+// it to stay consistent with the committed documents.
+const journalBucket = "journal"
+
+type JournalOp byte
+
+const (
+	// the document was added or changed
+	JournalUpdate JournalOp = iota + 1
+	JournalRemove
+)
+
+type JournalEntry struct {
+	Seq uint64
+	Op  JournalOp
+	Key uint64
+}
+
+func writeJournal(tx *bolt.Tx, op JournalOp, key uint64) error {
+	bucket := tx.Bucket([]byte(journalBucket))
+	seq, err := bucket.NextSequence()
+	if err != nil {
+		return err
+	}
+	return bucket.Put(Itob(seq), append([]byte{byte(op)}, Itob(key)...))
+}
+
+// JournalSeq returns the sequence number of the latest journal entry, 0 if the
+// journal is empty
+func (db *DB) JournalSeq() (uint64, error) {
+	var seq uint64
+	err := db.Handle.View(func(tx *bolt.Tx) error {
+		if k, _ := tx.Bucket([]byte(journalBucket)).Cursor().Last(); k != nil {
+			seq = Btoi(k)
+		}
+		return nil
+	})
+	return seq, err
+}
+
+// Journal returns all journal entries after seq, oldest first
+func (db *DB) Journal(seq uint64) ([]JournalEntry, error) {
+	var entries []JournalEntry
+	err := db.Handle.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte(journalBucket)).Cursor()
+		for k, v := c.Seek(Itob(seq + 1)); k != nil; k, v = c.Next() {
+			entries = append(entries, JournalEntry{Seq: Btoi(k), Op: JournalOp(v[0]), Key: Btoi(v[1:])})
+		}
+		return nil
+	})
+	return entries, err
+}
+
+// TrimJournal removes all journal entries up to and including seq
+func (db *DB) TrimJournal(seq uint64) error {
+	return db.Handle.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte(journalBucket)).Cursor()
+		for k, _ := c.First(); k != nil && Btoi(k) <= seq; k, _ = c.First() {
+			err := c.Delete()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,193 @@
+package db
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/gob"
+	"encoding/hex"
+	"log"
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/reusing-code/dochan/blob"
+	"github.com/reusing-code/dochan/crypt"
+	"github.com/reusing-code/dochan/migrate"
+)
+
+// migrations upgrade the schema of the DB, append new ones at the end. In a
+// dry run they must not change anything outside of the transaction.
+func (db *DB) migrations(dryRun bool) []migrate.Migration {
+	return []migrate.Migration{
+		{Version: 1, Description: "move raw file data to the blob store", Up: func(tx *bolt.Tx) error {
+			return db.moveRawData(tx, dryRun)
+		}},
+		{Version: 2, Description: "replace the hash table by secondary indexes", Up: buildIndexes},
+		{Version: 3, Description: "index hashes of private documents per owner", Up: func(tx *bolt.Tx) error {
+			_, err := rebuildIndexes(tx)
+			return err
+		}},
+		{Version: 4, Description: "add source file hashes of documents stored before they were recorded", Up: db.backfillHashes},
+		{Version: 5, Description: "index documents by their raw file data", Up: func(tx *bolt.Tx) error {
+			_, err := rebuildIndexes(tx)
+			return err
+		}},
+	}
+}
+
+// Migrate upgrades the DB at path without opening it for use. New does the
+// same on every start, Migrate allows dry runs.
+func Migrate(path string, opts migrate.Options) (*migrate.Result, error) {
+	store, err := blob.NewFileStore(blobDir(path))
+	if err != nil {
+		return nil, err
+	}
+	db := &DB{Blobs: store}
+	db.Handle, err = bolt.Open(path, 0644, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	return migrate.Run(db.Handle, db.migrations(opts.DryRun), opts)
+}
+
+// sourceHash returns the hash of a source file as the parser computes it
+func sourceHash(data []byte) string {
+	sum := sha1.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// moveRawData moves the raw file data of documents stored inside the DB to
+// the blob store. Documents stored before hashes were recorded get the hash of
+// their raw data, which buildIndexes needs to replace the hash table.
+func (db *DB) moveRawData(tx *bolt.Tx, dryRun bool) error {
+	bucket := tx.Bucket([]byte(fileBucket))
+	if bucket == nil {
+		return nil
+	}
+	// the bucket can't be changed while iterating over it
+	var keys [][]byte
+	err := bucket.ForEach(func(k, v []byte) error {
+		var f DBFile
+		err := gob.NewDecoder(bytes.NewBuffer(v)).Decode(&f)
+		if err != nil {
+			return err
+		}
+		if f.RawData != nil {
+			keys = append(keys, append([]byte{}, k...))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		var f DBFile
+		err := gob.NewDecoder(bytes.NewBuffer(bucket.Get(k))).Decode(&f)
+		if err != nil {
+			return err
+		}
+		if f.Hash == "" {
+			f.Hash = sourceHash(f.RawData)
+		}
+		f.Blob = blob.Hash(f.RawData)
+		if !dryRun {
+			f.Blob, err = db.Blobs.Put(bytes.NewReader(f.RawData))
+			if err != nil {
+				return err
+			}
+		}
+		f.Size = int64(len(f.RawData))
+		f.RawData = nil
+		buf := &bytes.Buffer{}
+		err = gob.NewEncoder(buf).Encode(&f)
+		if err != nil {
+			return err
+		}
+		err = bucket.Put(k, buf.Bytes())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// buildIndexes creates the secondary indexes and moves purged hashes out of
+// the hash table, which was stored as a single gob encoded map
+func buildIndexes(tx *bolt.Tx) error {
+	_, err := rebuildIndexes(tx)
+	if err != nil {
+		return err
+	}
+	purged, err := tx.CreateBucketIfNotExists([]byte(purgedBucket))
+	if err != nil {
+		return err
+	}
+	hashes := tx.Bucket([]byte("hashes"))
+	if hashes == nil {
+		return nil
+	}
+	if b := hashes.Get([]byte("hashes")); len(b) > 0 {
+		table := make(map[string]bool)
+		err = gob.NewDecoder(bytes.NewBuffer(b)).Decode(&table)
+		if err != nil {
+			return err
+		}
+		for hash, stored := range table {
+			if !stored {
+				err = purged.Put([]byte(hash), timeKey(time.Now()))
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return tx.DeleteBucket([]byte("hashes"))
+}
+
+// backfillHashes adds the hash of their raw data to documents which moved to
+// the blob store without one, so they are found by their hash again. Raw data
+// of an encrypted DB can only be read with its key.
+func (db *DB) backfillHashes(tx *bolt.Tx) error {
+	if db.keys == nil && crypt.Exists(tx, keyBucket) {
+		return ErrEncrypted
+	}
+	bucket := tx.Bucket([]byte(fileBucket))
+	if bucket == nil {
+		return nil
+	}
+	files := make(map[string]*DBFile)
+	err := bucket.ForEach(func(k, v []byte) error {
+		f := &DBFile{}
+		err := gob.NewDecoder(bytes.NewBuffer(v)).Decode(f)
+		if err != nil {
+			return err
+		}
+		if f.Hash == "" && f.Blob != "" {
+			files[string(k)] = f
+		}
+		return nil
+	})
+	if err != nil || len(files) == 0 {
+		return err
+	}
+	for k, f := range files {
+		raw, err := db.ReadRaw(f)
+		if err != nil {
+			// the document stays without hash, like documents without raw data
+			log.Printf("Can't hash raw data of document %v: %v", Btoi([]byte(k)), err)
+			continue
+		}
+		f.Hash = sourceHash(raw)
+		buf := &bytes.Buffer{}
+		err = gob.NewEncoder(buf).Encode(f)
+		if err != nil {
+			return err
+		}
+		err = bucket.Put([]byte(k), buf.Bytes())
+		if err != nil {
+			return err
+		}
+	}
+	_, err = rebuildIndexes(tx)
+	return err
+}
@@ -30,21 +30,23 @@ func ExtractAttachments(eml io.Reader, cb func(filename string, content []byte,
 	return nil
 }
 
-func ExtractAttachmentsFromDirRec(dir string, cb func(filename string, content []byte, messageID string) error) error {
+// ExtractAttachmentsFromDirRec extracts the attachments of all mails below
+// dir. Mails which can't be read or parsed are passed to onError and skipped.
+func ExtractAttachmentsFromDirRec(dir string, cb func(filename string, content []byte, messageID string) error, onError func(path string, err error)) error {
 	err := godirwalk.Walk(dir, &godirwalk.Options{
 		Unsorted: true,
 		Callback: func(path string, de *godirwalk.Dirent) error {
 			if de.IsRegular() && filepath.Ext(path) == ".eml" {
 				fmt.Println(path)
 				f, err := os.Open(path)
-				defer f.Close()
 				if err != nil {
-					return err
+					onError(path, err)
+					return nil
 				}
+				defer f.Close()
 				err = ExtractAttachments(f, cb)
 				if err != nil {
-					fmt.Printf("Error in file %q: %q\n", path, err)
-					return nil
+					onError(path, err)
 				}
 			}
 			return nil
@@ -1,7 +1,9 @@
 package eml
 
 import (
+	"errors"
 	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -40,6 +42,8 @@ func TestExtractAttachmentsFromDirRec(t *testing.T) {
 		}
 		count++
 		return nil
+	}, func(path string, err error) {
+		t.Errorf("Error in %q: %v", path, err)
 	})
 	if err != nil {
 		t.Fatal(err)
@@ -48,3 +52,18 @@ func TestExtractAttachmentsFromDirRec(t *testing.T) {
 		t.Errorf("Wrong number of files extracted %d", count)
 	}
 }
+
+func TestExtractAttachmentsFromDirRecError(t *testing.T) {
+	var failed []string
+	err := ExtractAttachmentsFromDirRec("testdata", func(filename string, content []byte, messageID string) error {
+		return errors.New("disk full")
+	}, func(path string, err error) {
+		failed = append(failed, path)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failed) != 1 || failed[0] != filepath.Join("testdata", "document.eml") {
+		t.Errorf("Wrong failed mails %v", failed)
+	}
+}
@@ -24,7 +24,8 @@ require (
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/saintfish/chardet v0.0.0-20120816061221-3af4cd4741ca // indirect
 	github.com/stretchr/testify v1.2.2 // indirect
-	golang.org/x/sys v0.0.0-20180606202747-9527bec2660b // indirect
+	golang.org/x/crypto v0.0.0-20181203042331-505ab145d0a9
+	golang.org/x/sys v0.0.0-20180606202747-9527bec2660b
 	golang.org/x/text v0.3.0
 	gopkg.in/abiosoft/ishell.v2 v2.0.0
 )
@@ -0,0 +1,519 @@
+// Package jobs runs the items of background jobs, e.g. the files of a
+// directory scan, from a queue persisted in a bolt DB. Items interrupted by a
+// shutdown are run again after a restart, failed ones are retried with
+// increasing delays.
+package jobs
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+)
+
+const (
+	jobBucket     = "jobs"
+	taskBucket    = "tasks"
+	failureBucket = "failures"
+	// workers without due items check again at least this often
+	idleInterval = time.Minute
+)
+
+var ErrNotFound = errors.New("job not found")
+
+type State string
+
+const (
+	Queued  State = "queued"
+	Running State = "running"
+	Done    State = "done"
+)
+
+type Job struct {
+	ID    uint64 `json:"id"`
+	Kind  string `json:"kind"`
+	State State  `json:"state"`
+	// items of the job, the ones processed successfully and the ones which
+	// failed on every attempt
+	Total     int       `json:"total"`
+	Processed int       `json:"processed"`
+	Failed    int       `json:"failed"`
+	Created   time.Time `json:"created"`
+	Started   time.Time `json:"started"`
+	Finished  time.Time `json:"finished"`
+}
+
+// Task is an item of a job waiting to be processed
+type Task struct {
+	JobID    uint64
+	Item     string
+	Attempts int
+	// not run before this time
+	Next  time.Time
+	Error string
+}
+
+// Failure is an item which failed on every attempt, kept until it is processed
+// successfully
+type Failure struct {
+	Path string `json:"path"`
+	// of the content, if it was read
+	Hash     string    `json:"hash,omitempty"`
+	Stage    string    `json:"stage,omitempty"`
+	Error    string    `json:"error"`
+	Attempts int       `json:"attempts"`
+	Time     time.Time `json:"time"`
+	JobID    uint64    `json:"jobId,omitempty"`
+	Kind     string    `json:"kind"`
+}
+
+// ItemError can be returned by handlers to record the stage an item failed in
+// and the hash of its content
+type ItemError struct {
+	Stage string
+	Hash  string
+	Err   error
+}
+
+func (e *ItemError) Error() string {
+	return e.Err.Error()
+}
+
+// Handler processes an item of a job, it should return soon after ctx is done
+type Handler func(ctx context.Context, job *Job, item string) error
+
+// Queue keeps jobs and their remaining items in a bolt DB
+type Queue struct {
+	Handle *bolt.DB
+	// attempts per item before it counts as failed
+	MaxAttempts int
+	// delay before the first retry, doubled for every further one
+	RetryDelay time.Duration
+	// finished jobs kept for the status API
+	KeepJobs int
+
+	mtx sync.Mutex
+	// keys of the tasks being processed
+	running map[string]bool
+	// closed and replaced when items are added
+	wake chan struct{}
+	// replaced in tests
+	now func() time.Time
+}
+
+func New(path string) (*Queue, error) {
+	handle, err := bolt.Open(path, 0644, nil)
+	if err != nil {
+		return nil, err
+	}
+	q, err := Open(handle)
+	if err != nil {
+		handle.Close()
+		return nil, err
+	}
+	return q, nil
+}
+
+// Open uses an opened bolt DB
+func Open(handle *bolt.DB) (*Queue, error) {
+	q := &Queue{
+		Handle:      handle,
+		MaxAttempts: 3,
+		RetryDelay:  time.Minute,
+		KeepJobs:    100,
+		running:     make(map[string]bool),
+		wake:        make(chan struct{}),
+		now:         time.Now,
+	}
+	err := q.Handle.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{jobBucket, taskBucket, failureBucket} {
+			_, err := tx.CreateBucketIfNotExists([]byte(name))
+			if err != nil {
+				return fmt.Errorf("create bucket %q: %q", name, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func (q *Queue) Close() error {
+	if q != nil && q.Handle != nil {
+		return q.Handle.Close()
+	}
+	return errors.New("No DB")
+}
+
+// Add creates a job processing the items
+func (q *Queue) Add(kind string, items []string) (*Job, error) {
+	job := &Job{Kind: kind, State: Queued, Total: len(items), Created: q.now()}
+	if len(items) == 0 {
+		job.State = Done
+		job.Finished = job.Created
+	}
+	err := q.Handle.Update(func(tx *bolt.Tx) error {
+		jobs := tx.Bucket([]byte(jobBucket))
+		var err error
+		job.ID, err = jobs.NextSequence()
+		if err != nil {
+			return err
+		}
+		err = putGob(jobs, itob(job.ID), job)
+		if err != nil {
+			return err
+		}
+		tasks := tx.Bucket([]byte(taskBucket))
+		for _, item := range items {
+			seq, err := tasks.NextSequence()
+			if err != nil {
+				return err
+			}
+			err = putGob(tasks, append(itob(job.ID), itob(seq)...), &Task{JobID: job.ID, Item: item})
+			if err != nil {
+				return err
+			}
+		}
+		return q.prune(jobs)
+	})
+	if err != nil {
+		return nil, err
+	}
+	q.mtx.Lock()
+	close(q.wake)
+	q.wake = make(chan struct{})
+	q.mtx.Unlock()
+	return job, nil
+}
+
+// prune removes the oldest finished jobs beyond KeepJobs
+func (q *Queue) prune(jobs *bolt.Bucket) error {
+	var finished [][]byte
+	err := jobs.ForEach(func(k, v []byte) error {
+		var job Job
+		err := gob.NewDecoder(bytes.NewBuffer(v)).Decode(&job)
+		if err != nil {
+			return err
+		}
+		if job.State == Done {
+			finished = append(finished, append([]byte{}, k...))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for len(finished) > q.KeepJobs {
+		err = jobs.Delete(finished[0])
+		if err != nil {
+			return err
+		}
+		finished = finished[1:]
+	}
+	return nil
+}
+
+// Get returns a job, ErrNotFound if it doesn't exist (anymore)
+func (q *Queue) Get(id uint64) (*Job, error) {
+	var job *Job
+	err := q.Handle.View(func(tx *bolt.Tx) error {
+		var err error
+		job, err = getJob(tx.Bucket([]byte(jobBucket)), id)
+		return err
+	})
+	return job, err
+}
+
+// Jobs returns all jobs, the latest first
+func (q *Queue) Jobs() ([]Job, error) {
+	list := []Job{}
+	err := q.Handle.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(jobBucket)).ForEach(func(k, v []byte) error {
+			var job Job
+			err := gob.NewDecoder(bytes.NewBuffer(v)).Decode(&job)
+			if err != nil {
+				return err
+			}
+			list = append(list, job)
+			return nil
+		})
+	})
+	sort.Slice(list, func(i, j int) bool { return list[i].ID > list[j].ID })
+	return list, err
+}
+
+// Pending returns the items of all jobs which weren't processed yet
+func (q *Queue) Pending() (map[string]bool, error) {
+	items := make(map[string]bool)
+	err := q.Handle.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(taskBucket)).ForEach(func(k, v []byte) error {
+			var task Task
+			err := gob.NewDecoder(bytes.NewBuffer(v)).Decode(&task)
+			if err != nil {
+				return err
+			}
+			items[task.Item] = true
+			return nil
+		})
+	})
+	return items, err
+}
+
+// Run processes the items of all jobs with the given number of workers until
+// ctx is done. Items being processed then stay queued.
+func (q *Queue) Run(ctx context.Context, workers int, handle Handler) {
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q.work(ctx, handle)
+		}()
+	}
+	wg.Wait()
+}
+
+func (q *Queue) work(ctx context.Context, handle Handler) {
+	for ctx.Err() == nil {
+		q.mtx.Lock()
+		wake := q.wake
+		q.mtx.Unlock()
+		key, task, job, wait, err := q.next()
+		if err != nil {
+			log.Printf("Error getting next job item: %v", err)
+		}
+		if task == nil {
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+			case <-wake:
+			case <-timer.C:
+			}
+			timer.Stop()
+			continue
+		}
+		err = handle(ctx, job, task.Item)
+		if ctx.Err() != nil {
+			q.release(key)
+			return
+		}
+		err = q.finish(key, err)
+		if err != nil {
+			log.Printf("Error finishing job item %v: %v", task.Item, err)
+		}
+	}
+}
+
+// next claims the first due task. Without one it returns how long to wait
+// for the next retry.
+func (q *Queue) next() ([]byte, *Task, *Job, time.Duration, error) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	now := q.now()
+	wait := idleInterval
+	var key []byte
+	var task *Task
+	var job *Job
+	err := q.Handle.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte(taskBucket)).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if q.running[string(k)] {
+				continue
+			}
+			t := &Task{}
+			err := gob.NewDecoder(bytes.NewBuffer(v)).Decode(t)
+			if err != nil {
+				return err
+			}
+			if d := t.Next.Sub(now); d > 0 {
+				if d < wait {
+					wait = d
+				}
+				continue
+			}
+			key, task = append([]byte{}, k...), t
+			break
+		}
+		if task == nil {
+			return nil
+		}
+		jobs := tx.Bucket([]byte(jobBucket))
+		var err error
+		job, err = getJob(jobs, task.JobID)
+		if err != nil {
+			return err
+		}
+		if job.State == Queued {
+			job.State = Running
+			job.Started = now
+			return putGob(jobs, itob(job.ID), job)
+		}
+		return nil
+	})
+	if err != nil || task == nil {
+		return nil, nil, nil, wait, err
+	}
+	q.running[string(key)] = true
+	return key, task, job, 0, nil
+}
+
+func (q *Queue) release(key []byte) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	delete(q.running, string(key))
+}
+
+// finish removes a task processed successfully or failed too often and
+// updates the counters of its job, other failed tasks are scheduled again
+func (q *Queue) finish(key []byte, result error) error {
+	defer q.release(key)
+	now := q.now()
+	return q.Handle.Update(func(tx *bolt.Tx) error {
+		tasks := tx.Bucket([]byte(taskBucket))
+		b := tasks.Get(key)
+		if b == nil {
+			return nil
+		}
+		task := &Task{}
+		err := gob.NewDecoder(bytes.NewBuffer(b)).Decode(task)
+		if err != nil {
+			return err
+		}
+		if result != nil {
+			task.Attempts++
+			task.Error = result.Error()
+			if task.Attempts < q.MaxAttempts {
+				task.Next = now.Add(q.RetryDelay << uint(task.Attempts-1))
+				return putGob(tasks, key, task)
+			}
+		}
+		err = tasks.Delete(key)
+		if err != nil {
+			return err
+		}
+		jobs := tx.Bucket([]byte(jobBucket))
+		job, err := getJob(jobs, task.JobID)
+		// pruned jobs still record failures
+		pruned := err == ErrNotFound
+		if pruned {
+			job = &Job{ID: task.JobID}
+		} else if err != nil {
+			return err
+		}
+		failures := tx.Bucket([]byte(failureBucket))
+		if result != nil {
+			job.Failed++
+			f := &Failure{Path: task.Item, Error: task.Error, Attempts: task.Attempts, Time: now, JobID: job.ID, Kind: job.Kind}
+			if e, ok := result.(*ItemError); ok {
+				f.Stage, f.Hash = e.Stage, e.Hash
+			}
+			err = putGob(failures, []byte(f.Path), f)
+		} else {
+			job.Processed++
+			err = failures.Delete([]byte(task.Item))
+		}
+		if err != nil || pruned {
+			return err
+		}
+		if job.Processed+job.Failed >= job.Total {
+			job.State = Done
+			job.Finished = now
+		}
+		return putGob(jobs, itob(job.ID), job)
+	})
+}
+
+// RecordFailure keeps a failure which happened outside of a job, e.g. while
+// listing the items of one
+func (q *Queue) RecordFailure(f *Failure) error {
+	if f.Time.IsZero() {
+		f.Time = q.now()
+	}
+	return q.Handle.Update(func(tx *bolt.Tx) error {
+		return putGob(tx.Bucket([]byte(failureBucket)), []byte(f.Path), f)
+	})
+}
+
+// RemoveFailure forgets the failure of an item, e.g. after processing it
+// outside of a job
+func (q *Queue) RemoveFailure(path string) error {
+	return q.Handle.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(failureBucket)).Delete([]byte(path))
+	})
+}
+
+// Failures returns the items which failed and weren't processed successfully
+// since, sorted by path
+func (q *Queue) Failures() ([]Failure, error) {
+	list := []Failure{}
+	err := q.Handle.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(failureBucket)).ForEach(func(k, v []byte) error {
+			var f Failure
+			err := gob.NewDecoder(bytes.NewBuffer(v)).Decode(&f)
+			if err != nil {
+				return err
+			}
+			list = append(list, f)
+			return nil
+		})
+	})
+	return list, err
+}
+
+// Retry creates a job of the given kind processing failed items again. The
+// failures are kept until the items are processed successfully.
+func (q *Queue) Retry(kind string, paths []string) (*Job, error) {
+	failures, err := q.Failures()
+	if err != nil {
+		return nil, err
+	}
+	failed := make(map[string]bool)
+	for _, f := range failures {
+		failed[f.Path] = true
+	}
+	var items []string
+	for _, path := range paths {
+		if failed[path] {
+			items = append(items, path)
+		}
+	}
+	return q.Add(kind, items)
+}
+
+func getJob(bucket *bolt.Bucket, id uint64) (*Job, error) {
+	b := bucket.Get(itob(id))
+	if b == nil {
+		return nil, ErrNotFound
+	}
+	job := &Job{}
+	err := gob.NewDecoder(bytes.NewBuffer(b)).Decode(job)
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+func putGob(bucket *bolt.Bucket, key []byte, v interface{}) error {
+	buf := &bytes.Buffer{}
+	err := gob.NewEncoder(buf).Encode(v)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(key, buf.Bytes())
+}
+
+func itob(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
@@ -0,0 +1,228 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func waitDone(t *testing.T, q *Queue, id uint64) *Job {
+	for i := 0; i < 500; i++ {
+		job, err := q.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.State == Done {
+			return job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Job not done in time")
+	return nil
+}
+
+func TestQueue(t *testing.T) {
+	defer os.Remove("test.db")
+	q, err := New("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	q.RetryDelay = time.Millisecond
+
+	var mtx sync.Mutex
+	attempts := make(map[string]int)
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		q.Run(ctx, 2, func(ctx context.Context, job *Job, item string) error {
+			mtx.Lock()
+			defer mtx.Unlock()
+			attempts[item]++
+			if item == "bad" || (item == "flaky" && attempts[item] == 1) {
+				return errors.New("failed")
+			}
+			return nil
+		})
+		close(stopped)
+	}()
+
+	job, err := q.Add("scan", []string{"a", "bad", "flaky", "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	job = waitDone(t, q, job.ID)
+	if job.Total != 4 || job.Processed != 3 || job.Failed != 1 {
+		t.Errorf("Wrong counters %+v", job)
+	}
+	if job.Started.IsZero() || job.Finished.Before(job.Started) {
+		t.Errorf("Wrong times %+v", job)
+	}
+	mtx.Lock()
+	if attempts["a"] != 1 || attempts["flaky"] != 2 || attempts["bad"] != q.MaxAttempts {
+		t.Errorf("Wrong attempts %v", attempts)
+	}
+	mtx.Unlock()
+
+	empty, err := q.Add("scan", nil)
+	if err != nil || empty.State != Done {
+		t.Errorf("Empty job not done: %+v %v", empty, err)
+	}
+	list, err := q.Jobs()
+	if err != nil || len(list) != 2 || list[0].ID != empty.ID {
+		t.Errorf("Wrong jobs %+v: %v", list, err)
+	}
+	cancel()
+	<-stopped
+}
+
+func TestInterrupted(t *testing.T) {
+	defer os.Remove("test.db")
+	q, err := New("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, err := q.Add("scan", []string{"a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	started := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		q.Run(ctx, 1, func(ctx context.Context, job *Job, item string) error {
+			close(started)
+			<-ctx.Done()
+			return ctx.Err()
+		})
+		close(stopped)
+	}()
+	<-started
+	cancel()
+	<-stopped
+	q.Close()
+
+	q, err = New("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if j, _ := q.Get(job.ID); j.State != Running || j.Failed != 0 {
+		t.Errorf("Interrupted item counted: %+v", j)
+	}
+	if pending, err := q.Pending(); err != nil || !pending["a"] || len(pending) != 1 {
+		t.Errorf("Wrong pending items %v: %v", pending, err)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	var done []string
+	go q.Run(ctx, 1, func(ctx context.Context, job *Job, item string) error {
+		done = append(done, item)
+		return nil
+	})
+	job = waitDone(t, q, job.ID)
+	if job.Processed != 1 || len(done) != 1 {
+		t.Errorf("Interrupted item not run again: %+v %v", job, done)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	defer os.Remove("test.db")
+	q, err := New("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	q.KeepJobs = 2
+	for i := 0; i < 4; i++ {
+		if _, err = q.Add("scan", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = q.Add("scan", []string{"pending"}); err != nil {
+		t.Fatal(err)
+	}
+	list, _ := q.Jobs()
+	if len(list) != 3 || list[0].State != Queued || list[2].ID != 3 {
+		t.Errorf("Wrong jobs after pruning %+v", list)
+	}
+}
+
+func TestFailures(t *testing.T) {
+	defer os.Remove("test.db")
+	q, err := New("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	q.MaxAttempts = 1
+
+	var mtx sync.Mutex
+	broken := map[string]bool{"b": true, "c": true}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		q.Run(ctx, 1, func(ctx context.Context, job *Job, item string) error {
+			mtx.Lock()
+			defer mtx.Unlock()
+			if item == "b" && broken[item] {
+				return &ItemError{Stage: "parse", Hash: "1234", Err: errors.New("no text")}
+			}
+			if broken[item] {
+				return errors.New("failed")
+			}
+			return nil
+		})
+		close(stopped)
+	}()
+
+	job, err := q.Add("scan", []string{"a", "b", "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitDone(t, q, job.ID)
+	err = q.RecordFailure(&Failure{Path: "d", Stage: "hash", Error: "permission denied", Kind: "scan"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err := q.Failures()
+	if err != nil || len(list) != 3 {
+		t.Fatalf("Wrong failures %+v: %v", list, err)
+	}
+	b := list[0]
+	if b.Path != "b" || b.Stage != "parse" || b.Hash != "1234" || b.Error != "no text" || b.Attempts != 1 || b.JobID != job.ID || b.Kind != "scan" {
+		t.Errorf("Wrong failure %+v", b)
+	}
+	if list[1].Path != "c" || list[1].Stage != "" || list[2].Path != "d" || list[2].Time.IsZero() {
+		t.Errorf("Wrong failures %+v", list)
+	}
+
+	mtx.Lock()
+	broken["b"] = false
+	mtx.Unlock()
+	retry, err := q.Retry("retry", []string{"a", "b", "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	retry = waitDone(t, q, retry.ID)
+	if retry.Total != 2 || retry.Processed != 1 || retry.Failed != 1 {
+		t.Errorf("Wrong retry %+v", retry)
+	}
+	list, err = q.Failures()
+	if err != nil || len(list) != 2 || list[0].Path != "c" || list[0].JobID != retry.ID {
+		t.Errorf("Wrong failures after retry %+v: %v", list, err)
+	}
+	err = q.RemoveFailure("d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err = q.Failures()
+	if err != nil || len(list) != 1 {
+		t.Errorf("Failure not removed %+v: %v", list, err)
+	}
+	cancel()
+	<-stopped
+}
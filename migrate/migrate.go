@@ -0,0 +1,151 @@
+package migrate
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	bolt "github.com/coreos/bbolt"
+)
+
+const (
+	metaBucket = "meta"
+	versionKey = "version"
+)
+
+var errDryRun = errors.New("dry run")
+
+// Migration upgrades the data of a DB from schema version Version-1 to Version
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(tx *bolt.Tx) error
+}
+
+type Options struct {
+	// Copy the DB file before changing anything
+	Backup bool
+	// Apply the migrations and roll them back, to check they would succeed
+	DryRun bool
+}
+
+type Result struct {
+	From    int      `json:"from"`
+	To      int      `json:"to"`
+	Applied []string `json:"applied"`
+	// path of the backup copy, empty if none was made
+	Backup string `json:"backup,omitempty"`
+	DryRun bool   `json:"dryRun"`
+}
+
+// Version returns the schema version of the DB, 0 if none was stored yet
+func Version(tx *bolt.Tx) int {
+	bucket := tx.Bucket([]byte(metaBucket))
+	if bucket == nil {
+		return 0
+	}
+	b := bucket.Get([]byte(versionKey))
+	if len(b) != 8 {
+		return 0
+	}
+	return int(binary.BigEndian.Uint64(b))
+}
+
+func SetVersion(tx *bolt.Tx, version int) error {
+	bucket, err := tx.CreateBucketIfNotExists([]byte(metaBucket))
+	if err != nil {
+		return fmt.Errorf("create bucket %q: %q", metaBucket, err)
+	}
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(version))
+	return bucket.Put([]byte(versionKey), b)
+}
+
+// Latest returns the schema version reached after all migrations
+func Latest(migrations []Migration) int {
+	return len(migrations)
+}
+
+// Run applies all migrations newer than the schema version of the DB, each in
+// its own transaction together with the version update. migrations must be
+// ordered and numbered from 1.
+func Run(handle *bolt.DB, migrations []Migration, opts Options) (*Result, error) {
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("migration %q has version %d, want %d", m.Description, m.Version, i+1)
+		}
+	}
+	latest := Latest(migrations)
+	result := &Result{Applied: []string{}, DryRun: opts.DryRun}
+	empty := true
+	err := handle.View(func(tx *bolt.Tx) error {
+		result.From = Version(tx)
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			if b.Stats().KeyN > 0 {
+				empty = false
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.To = result.From
+	if result.From > latest {
+		return nil, fmt.Errorf("DB schema version %d is newer than the supported version %d", result.From, latest)
+	}
+	if result.From == latest {
+		return result, nil
+	}
+	pending := migrations[result.From:]
+
+	if opts.DryRun {
+		err = handle.Update(func(tx *bolt.Tx) error {
+			for _, m := range pending {
+				err := m.Up(tx)
+				if err != nil {
+					return fmt.Errorf("migration to version %d (%s): %v", m.Version, m.Description, err)
+				}
+				result.Applied = append(result.Applied, m.Description)
+				result.To = m.Version
+			}
+			return errDryRun
+		})
+		if err != errDryRun {
+			return nil, err
+		}
+		return result, nil
+	}
+
+	// nothing worth keeping in a new DB
+	if opts.Backup && !empty {
+		result.Backup = fmt.Sprintf("%s.v%d.bak", handle.Path(), result.From)
+		err = backup(handle, result.Backup)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, m := range pending {
+		err = handle.Update(func(tx *bolt.Tx) error {
+			err := m.Up(tx)
+			if err != nil {
+				return err
+			}
+			return SetVersion(tx, m.Version)
+		})
+		if err != nil {
+			return result, fmt.Errorf("migration to version %d (%s): %v", m.Version, m.Description, err)
+		}
+		result.Applied = append(result.Applied, m.Description)
+		result.To = m.Version
+	}
+	return result, nil
+}
+
+// backup copies the DB, a backup left by a failed run of the same version is
+// overwritten
+func backup(handle *bolt.DB, path string) error {
+	return handle.View(func(tx *bolt.Tx) error {
+		return tx.CopyFile(path, 0600)
+	})
+}
@@ -0,0 +1,114 @@
+package migrate
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	bolt "github.com/coreos/bbolt"
+)
+
+func open(t *testing.T) *bolt.DB {
+	handle, err := bolt.Open("test.db", 0644, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return handle
+}
+
+func put(key string) func(tx *bolt.Tx) error {
+	return func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("data"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), []byte{1})
+	}
+}
+
+func has(t *testing.T, handle *bolt.DB, key string) bool {
+	found := false
+	handle.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("data"))
+		found = b != nil && b.Get([]byte(key)) != nil
+		return nil
+	})
+	return found
+}
+
+func TestRun(t *testing.T) {
+	defer os.Remove("test.db")
+	defer os.Remove("test.db.v1.bak")
+	handle := open(t)
+	defer handle.Close()
+
+	migrations := []Migration{{1, "first", put("first")}}
+	res, err := Run(handle, migrations, Options{Backup: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.From != 0 || res.To != 1 || res.Backup != "" {
+		t.Errorf("Unexpected result for new DB %+v", res)
+	}
+
+	migrations = append(migrations, Migration{2, "second", put("second")})
+	res, err = Run(handle, migrations, Options{Backup: true, DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.From != 1 || res.To != 2 || len(res.Applied) != 1 || has(t, handle, "second") {
+		t.Errorf("Unexpected dry run result %+v", res)
+	}
+
+	res, err = Run(handle, migrations, Options{Backup: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.To != 2 || res.Backup != "test.db.v1.bak" || !has(t, handle, "second") {
+		t.Errorf("Unexpected result %+v", res)
+	}
+	if _, err := os.Stat(res.Backup); err != nil {
+		t.Error(err)
+	}
+
+	res, err = Run(handle, migrations, Options{})
+	if err != nil || len(res.Applied) != 0 {
+		t.Errorf("Migrations applied again: %+v %v", res, err)
+	}
+	_, err = Run(handle, migrations[:1], Options{})
+	if err == nil {
+		t.Error("Expected error for DB newer than the migrations")
+	}
+}
+
+func TestRunFailure(t *testing.T) {
+	defer os.Remove("test.db")
+	handle := open(t)
+	defer handle.Close()
+
+	migrations := []Migration{
+		{1, "first", put("first")},
+		{2, "broken", func(tx *bolt.Tx) error {
+			put("broken")(tx)
+			return errors.New("broken")
+		}},
+	}
+	res, err := Run(handle, migrations, Options{})
+	if err == nil {
+		t.Fatal("Expected error")
+	}
+	if res.To != 1 || has(t, handle, "broken") {
+		t.Errorf("Failed migration not rolled back: %+v", res)
+	}
+	handle.View(func(tx *bolt.Tx) error {
+		if Version(tx) != 1 {
+			t.Errorf("Want version 1, got %v", Version(tx))
+		}
+		return nil
+	})
+
+	_, err = Run(handle, []Migration{{2, "gap", put("gap")}}, Options{})
+	if err == nil {
+		t.Error("Expected error for misnumbered migrations")
+	}
+}
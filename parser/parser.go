@@ -1,8 +1,10 @@
 package parser
 
 import (
+	"context"
 	"crypto/sha1"
 	"encoding/hex"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
@@ -10,6 +12,7 @@ import (
 	"runtime"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/karrick/godirwalk"
 	"github.com/reusing-code/dochan/pdf"
@@ -18,11 +21,75 @@ import (
 type ParserCallback func(f File, strings []string, rawData []byte)
 type SkipCallback func(f File) bool
 
+// ErrorCallback is called for each file which can't be processed, it may be nil
+type ErrorCallback func(err *Error)
+
+// Stages in which processing a file can fail
+const (
+	// walking the directory failed, no further files are processed
+	StageList  = "list"
+	StageHash  = "hash"
+	StageRead  = "read"
+	StageParse = "parse"
+)
+
+// Error is a failure to process a file
+type Error struct {
+	Path  string
+	Stage string
+	// of the content, empty if it couldn't be read
+	Hash string
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Stage + " " + e.Path + ": " + e.Err.Error()
+}
+
+func report(onError ErrorCallback, err *Error) {
+	if onError != nil {
+		onError(err)
+	}
+}
+
 type File struct {
 	Filename string
 	Hash     string
 }
 
+// HashCache keeps the hashes of files by path, size and modification time,
+// so unchanged files aren't read again. It is used concurrently.
+type HashCache interface {
+	Get(path string, size int64, modTime time.Time) (hash string, ok bool)
+	Put(path string, size int64, modTime time.Time, hash string)
+}
+
+// Options of ParseDir and ListFiles, the zero value parses all files with one
+// worker per CPU
+type Options struct {
+	// files parsed concurrently, the number of CPUs if zero
+	Workers int
+	// pdftohtml is killed if it takes longer for a file, no limit if zero
+	Timeout time.Duration
+	// only files with these extensions, without dot, are hashed; all if empty
+	Extensions []string
+	// called for each hashed file, files it returns true for are not parsed
+	Skip SkipCallback
+	// may be nil
+	Cache HashCache
+	// with a Cache, ListFiles passes files which aren't cached on with an
+	// empty hash instead of reading them, they are hashed by ReadFile
+	HashLater bool
+}
+
+// result of parsing a file, only File and Err are set if it failed
+type result struct {
+	File    File
+	Text    []string
+	RawData []byte
+	Err     *Error
+}
+
 func NoSkip(f File) bool {
 	return false
 }
@@ -33,33 +100,91 @@ not matching the allowed ones (no dots ('.') in allowedExts!)
 */
 func ExtensionFilter(allowedExts []string, chainedFilter SkipCallback) func(f File) bool {
 	return func(f File) bool {
-		for _, ext := range allowedExts {
-			if strings.EqualFold(filepath.Ext(f.Filename), "."+ext) {
-				return chainedFilter(f)
-			}
+		if hasExtension(f.Filename, allowedExts) {
+			return chainedFilter(f)
 		}
 		return true
 	}
 }
 
-func getFiles(dir string, skip SkipCallback) ([]File, error) {
-	fileList := []File{}
-	err := godirwalk.Walk(dir, &godirwalk.Options{
+func hasExtension(path string, exts []string) bool {
+	for _, ext := range exts {
+		if strings.EqualFold(filepath.Ext(path), "."+ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// hashFile returns the hash of a file from the cache if it is unchanged.
+// Otherwise the file is hashed unless later is set, with read set its content
+// is returned as well.
+func hashFile(path string, cache HashCache, read, later bool) (string, []byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", nil, err
+	}
+	if cache != nil {
+		if hash, ok := cache.Get(path, info.Size(), info.ModTime()); ok {
+			return hash, nil, nil
+		}
+		if later {
+			return "", nil, nil
+		}
+	}
+	var hash string
+	var data []byte
+	if read {
+		data, err = ioutil.ReadFile(path)
+		sum := sha1.Sum(data)
+		hash = hex.EncodeToString(sum[:])
+	} else {
+		hash, err = hashSum(path)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	if cache != nil {
+		cache.Put(path, info.Size(), info.ModTime(), hash)
+	}
+	return hash, data, nil
+}
+
+// walk hashes the regular files below dir with one of the extensions of opts
+// and passes those which are not skipped to found, until ctx is done. With
+// read set the content of files which had to be hashed is passed as well.
+func walk(ctx context.Context, dir string, opts Options, read bool, found func(f File, data []byte), onError ErrorCallback) error {
+	skip := opts.Skip
+	if skip == nil {
+		skip = NoSkip
+	}
+	return godirwalk.Walk(dir, &godirwalk.Options{
 		Callback: func(path string, de *godirwalk.Dirent) error {
-			if de.IsRegular() {
-				hash, err := hashSum(path)
-				if err != nil {
-					// TODO log error
-					return nil
-				}
-				f := File{path, hash}
-				if !skip(f) {
-					fileList = append(fileList, f)
-				}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if !de.IsRegular() || (len(opts.Extensions) > 0 && !hasExtension(path, opts.Extensions)) {
+				return nil
+			}
+			hash, data, err := hashFile(path, opts.Cache, read, opts.HashLater && !read)
+			if err != nil {
+				report(onError, &Error{Path: path, Stage: StageHash, Err: err})
+				return nil
+			}
+			f := File{path, hash}
+			if !skip(f) {
+				found(f, data)
 			}
 			return nil
 		},
 	})
+}
+
+func getFiles(dir string, opts Options, onError ErrorCallback) ([]File, error) {
+	fileList := []File{}
+	err := walk(context.Background(), dir, opts, false, func(f File, data []byte) {
+		fileList = append(fileList, f)
+	}, onError)
 
 	if err != nil {
 		return nil, err
@@ -68,53 +193,184 @@ func getFiles(dir string, skip SkipCallback) ([]File, error) {
 	return fileList, nil
 }
 
+// ListFiles returns all files below dir with the extensions of opts which are
+// not skipped, with their hashes. Files which can't be hashed are left out and
+// passed to onError. Workers and Timeout of opts are not used. With HashLater
+// the hash of files missing from the cache is empty.
+func ListFiles(dir string, opts Options, onError ErrorCallback) ([]File, error) {
+	return getFiles(dir, opts, onError)
+}
+
 func GetFileCount(dir string) (int, error) {
-	fileList, err := getFiles(dir, NoSkip)
+	fileList, err := getFiles(dir, Options{}, nil)
 	if err != nil {
 		return 0, err
 	}
 	return len(fileList), nil
 }
 
-func concurrentParse(input chan File, cb ParserCallback, resultMtx *sync.Mutex, wg *sync.WaitGroup) {
-	defer wg.Done()
-	for file := range input {
-		doc, err := pdf.ParsePDF(file.Filename)
-		if err != nil {
-			continue
+// parsePDF extracts the text of a PDF, pdftohtml is killed when ctx is done or
+// after timeout
+func parsePDF(ctx context.Context, path string, timeout time.Duration) ([]string, error) {
+	pctx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		pctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	doc, err := pdf.ParsePDFContext(pctx, path)
+	if err != nil {
+		if ctx.Err() == nil && pctx.Err() == context.DeadlineExceeded {
+			err = fmt.Errorf("pdftohtml timed out after %v", timeout)
 		}
-		b, err := ioutil.ReadFile(file.Filename)
+		return nil, err
+	}
+	return doc.GetText(), nil
+}
+
+// parse extracts the text of a file, its content is read unless data was
+// read while hashing
+func parse(ctx context.Context, f File, data []byte, timeout time.Duration) result {
+	text, err := parsePDF(ctx, f.Filename, timeout)
+	if err != nil {
+		return result{File: f, Err: &Error{Path: f.Filename, Stage: StageParse, Hash: f.Hash, Err: err}}
+	}
+	if data == nil {
+		data, err = ioutil.ReadFile(f.Filename)
 		if err != nil {
+			return result{File: f, Err: &Error{Path: f.Filename, Stage: StageRead, Hash: f.Hash, Err: err}}
+		}
+	}
+	return result{File: f, Text: text, RawData: data}
+}
+
+// item is a file to parse, with its content if it was read while hashing
+type item struct {
+	File
+	data []byte
+}
+
+// send passes a result on unless ctx is done
+func send(ctx context.Context, results chan<- result, res result) {
+	select {
+	case results <- res:
+	case <-ctx.Done():
+	}
+}
+
+func concurrentParse(ctx context.Context, input <-chan item, results chan<- result, opts Options, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for it := range input {
+		if ctx.Err() != nil {
 			continue
 		}
-		resultMtx.Lock()
-		cb(file, doc.GetText(), b)
-		resultMtx.Unlock()
+		send(ctx, results, parse(ctx, it.File, it.data, opts.Timeout))
 	}
 }
 
-func ParseDir(dir string, cb ParserCallback, skip SkipCallback) error {
-	resultMtx := &sync.Mutex{}
-	files, err := getFiles(dir, skip)
+// ParseFile hashes and parses a single file, errors are of type *Error
+func ParseFile(path string) (File, []string, []byte, error) {
+	return ParseFileContext(context.Background(), path, 0)
+}
+
+// ParseFileContext parses like ParseFile, pdftohtml is killed when ctx is done
+// or after timeout unless it is zero
+func ParseFileContext(ctx context.Context, path string, timeout time.Duration) (File, []string, []byte, error) {
+	f, b, err := ReadFile(path)
+	if err != nil {
+		return f, nil, nil, err
+	}
+	text, err := ParseText(ctx, f, timeout)
 	if err != nil {
-		return err
+		return f, nil, nil, err
 	}
+	return f, text, b, nil
+}
 
-	inputChan := make(chan File, 10)
+// ReadFile reads a file and hashes its content, errors are of type *Error
+func ReadFile(path string) (File, []byte, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return File{}, nil, &Error{Path: path, Stage: StageRead, Err: err}
+	}
+	sum := sha1.Sum(b)
+	return File{path, hex.EncodeToString(sum[:])}, b, nil
+}
+
+// ParseText extracts the text of a file read with ReadFile, like
+// ParseFileContext. Errors are of type *Error.
+func ParseText(ctx context.Context, f File, timeout time.Duration) ([]string, error) {
+	text, err := parsePDF(ctx, f.Filename, timeout)
+	if err != nil {
+		return nil, &Error{Path: f.Filename, Stage: StageParse, Hash: f.Hash, Err: err}
+	}
+	return text, nil
+}
+
+// parseAll hashes and parses all files below dir in the background. Each file
+// is reported on the returned channel, which is closed when all files are
+// done. When ctx is done no further files are parsed, running parsers are
+// killed and the remaining results are dropped.
+func parseAll(ctx context.Context, dir string, opts Options) <-chan result {
+	if opts.Workers <= 0 {
+		opts.Workers = runtime.NumCPU()
+	}
+	results := make(chan result, opts.Workers)
+	files := make(chan item, opts.Workers)
 
 	var wg sync.WaitGroup
-	for i := 0; i < runtime.NumCPU(); i++ {
+	for i := 0; i < opts.Workers; i++ {
 		wg.Add(1)
-		go concurrentParse(inputChan, cb, resultMtx, &wg)
+		go concurrentParse(ctx, files, results, opts, &wg)
 	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(files)
+		onError := func(err *Error) {
+			send(ctx, results, result{File: File{Filename: err.Path}, Err: err})
+		}
+		err := walk(ctx, dir, opts, true, func(f File, data []byte) {
+			select {
+			case files <- item{f, data}:
+			case <-ctx.Done():
+			}
+		}, onError)
+		if err != nil && ctx.Err() == nil {
+			onError(&Error{Path: dir, Stage: StageList, Err: err})
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+	return results
+}
 
-	for _, file := range files {
-		inputChan <- file
+// ParseDir parses all files below dir with the extensions of opts which are
+// not skipped and calls cb for each of them, files failing to be hashed, read
+// or parsed are passed to onError. Files are parsed by opts.Workers
+// goroutines, cb and onError are called by the calling one. When ctx is done
+// ParseDir returns its error, without calling cb for the remaining files.
+func ParseDir(ctx context.Context, dir string, cb ParserCallback, opts Options, onError ErrorCallback) error {
+	var listErr error
+	for res := range parseAll(ctx, dir, opts) {
+		switch {
+		case ctx.Err() != nil:
+			// results finished after cancellation are dropped, the callback
+			// may use resources being shut down
+		case res.Err != nil && res.Err.Stage == StageList:
+			listErr = res.Err.Err
+		case res.Err != nil:
+			report(onError, res.Err)
+		default:
+			cb(res.File, res.Text, res.RawData)
+		}
 	}
-	close(inputChan)
-	wg.Wait()
-
-	return nil
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return listErr
 }
 
 func hashSum(filePath string) (result string, err error) {
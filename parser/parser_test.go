@@ -1,10 +1,16 @@
 package parser
 
 import (
+	"context"
+	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 var tempDir string = "temp/"
@@ -44,7 +50,7 @@ func TestGetFilenames(t *testing.T) {
 		}
 	}
 
-	fileList, err := getFiles(tempDir, ExtensionFilter([]string{"pdf"}, NoSkip))
+	fileList, err := getFiles(tempDir, Options{Skip: ExtensionFilter([]string{"pdf"}, NoSkip)}, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -84,10 +90,10 @@ func TestParseDir(t *testing.T) {
 
 	results := make(map[string][]string)
 
-	ParseDir("testdata", func(f File, data []string, rawData []byte) {
+	ParseDir(context.Background(), "testdata", func(f File, data []string, rawData []byte) {
 		filename := filepath.Base(f.Filename)
 		results[filename] = data
-	}, func(f File) bool { return false })
+	}, Options{Extensions: []string{"pdf"}}, nil)
 
 	for _, tc := range parseDirTestCases {
 		resultData := results[tc.filename]
@@ -104,33 +110,53 @@ func TestParseDir(t *testing.T) {
 }
 
 func TestSkipFiles(t *testing.T) {
-	ParseDir("testdata", func(f File, data []string, rawData []byte) {
+	ParseDir(context.Background(), "testdata", func(f File, data []string, rawData []byte) {
 		t.Errorf("No file should be parsed, but got callback for %q", f.Filename)
-	}, func(f File) bool {
+	}, Options{Extensions: []string{"pdf"}, Skip: func(f File) bool {
 		if f.Hash != "28bac19a4147fdf7225f6c514270aa0867a2a03e" &&
 			f.Hash != "8ead9513ba1f8253a30a709b87ae4a7fb386d0d8" &&
 			f.Hash != "9f8b3703e131db0429d4497314c63becc7d4b0ec" {
 			t.Errorf("File %q has unknown file hash %q", f.Filename, f.Hash)
 		}
 		return true
-	})
+	}}, nil)
 
 	cbCount := 0
-	ParseDir("testdata", func(f File, data []string, rawData []byte) {
+	ParseDir(context.Background(), "testdata", func(f File, data []string, rawData []byte) {
 		cbCount++
 		if f.Hash != "28bac19a4147fdf7225f6c514270aa0867a2a03e" &&
 			f.Hash != "8ead9513ba1f8253a30a709b87ae4a7fb386d0d8" &&
 			f.Hash != "9f8b3703e131db0429d4497314c63becc7d4b0ec" {
 			t.Errorf("File %q has unknown file hash %q", f.Filename, f.Hash)
 		}
-	}, func(f File) bool {
-		return false
-	})
+	}, Options{Extensions: []string{"pdf"}}, nil)
 	if cbCount != 3 {
 		t.Errorf("Wrong number of callbacks received: Want %d got %d", 3, cbCount)
 	}
 }
 
+func TestParseDirCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := ParseDir(ctx, "testdata", func(f File, data []string, rawData []byte) {
+		t.Errorf("No file should be parsed after cancellation, but got callback for %q", f.Filename)
+	}, Options{}, nil)
+	if err != context.Canceled {
+		t.Errorf("Want context.Canceled, got %v", err)
+	}
+}
+
+func TestParseFileError(t *testing.T) {
+	_, _, _, err := ParseFile(filepath.Join("testdata", "missing.pdf"))
+	perr, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("Want *Error, got %v", err)
+	}
+	if perr.Stage != StageRead || perr.Hash != "" || !os.IsNotExist(perr.Err) {
+		t.Errorf("Wrong error %+v", perr)
+	}
+}
+
 func TestFileCount(t *testing.T) {
 	count, err := GetFileCount("testdata")
 	if err != nil {
@@ -140,3 +166,180 @@ func TestFileCount(t *testing.T) {
 		t.Errorf("Wrong number of files received: Want %d got %d", 3, count)
 	}
 }
+
+// fakePdftohtml puts a script named pdftohtml first in PATH, it fails for
+// files named bad*, hangs for files named slow* and returns the plain text
+// content of other files
+func fakePdftohtml(t *testing.T, dir string) func() {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a shell")
+	}
+	script := `#!/bin/sh
+case "$(basename "$2")" in
+bad*) echo "Syntax Error" >&2; exit 1;;
+slow*) exec sleep 10;;
+esac
+echo '<?xml version="1.0"?><pdf2xml><page number="1" width="1" height="1"><text top="0" left="0" width="1" height="1">'"$(cat "$2")"'</text></page></pdf2xml>' > "$3"
+`
+	bin, err := filepath.Abs(filepath.Join(dir, "bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(bin, 0777)
+	err = ioutil.WriteFile(filepath.Join(bin, "pdftohtml"), []byte(script), 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", bin+string(os.PathListSeparator)+path)
+	return func() { os.Setenv("PATH", path) }
+}
+
+func TestParseDirOptions(t *testing.T) {
+	dir := "fake"
+	defer os.RemoveAll(dir)
+	defer fakePdftohtml(t, dir)()
+	docs := filepath.Join(dir, "docs")
+	os.MkdirAll(docs, 0777)
+	for name, content := range map[string]string{"a.pdf": "Invoice", "b.pdf": "Contract", "bad.pdf": "Broken", "skip.pdf": "Skipped", "notes.txt": "Notes"} {
+		ioutil.WriteFile(filepath.Join(docs, name), []byte(content), 0666)
+	}
+
+	var skipped []string
+	parsed := make(map[string]string)
+	var failed []*Error
+	err := ParseDir(context.Background(), docs, func(f File, text []string, rawData []byte) {
+		if len(text) == 0 || !strings.Contains(text[0], string(rawData)) || f.Hash == "" {
+			t.Errorf("Wrong result of %v: %q %q", f.Filename, text, rawData)
+		}
+		parsed[filepath.Base(f.Filename)] = string(rawData)
+	}, Options{
+		Workers:    2,
+		Extensions: []string{"pdf"},
+		Skip: func(f File) bool {
+			skipped = append(skipped, filepath.Base(f.Filename))
+			return filepath.Base(f.Filename) == "skip.pdf"
+		},
+	}, func(perr *Error) {
+		failed = append(failed, perr)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(parsed) != 2 || parsed["a.pdf"] != "Invoice" || parsed["b.pdf"] != "Contract" {
+		t.Errorf("Wrong files parsed %v", parsed)
+	}
+	if len(skipped) != 4 {
+		t.Errorf("Want only files with the extensions hashed, got %v", skipped)
+	}
+	if len(failed) != 1 || failed[0].Stage != StageParse || failed[0].Hash == "" || !strings.Contains(failed[0].Error(), "Syntax Error") {
+		t.Errorf("Wrong errors %+v", failed)
+	}
+
+	err = ParseDir(context.Background(), filepath.Join(dir, "missing"), func(f File, text []string, rawData []byte) {}, Options{}, nil)
+	if err == nil {
+		t.Errorf("Want error listing a missing directory")
+	}
+}
+
+func TestParseTimeout(t *testing.T) {
+	dir := "fake"
+	defer os.RemoveAll(dir)
+	defer fakePdftohtml(t, dir)()
+	docs := filepath.Join(dir, "docs")
+	os.MkdirAll(docs, 0777)
+	ioutil.WriteFile(filepath.Join(docs, "slow.pdf"), []byte("Slow"), 0666)
+	ioutil.WriteFile(filepath.Join(docs, "a.pdf"), []byte("Fast"), 0666)
+
+	start := time.Now()
+	var failed, parsed int
+	ParseDir(context.Background(), docs, func(f File, text []string, rawData []byte) {
+		parsed++
+	}, Options{Workers: 1, Timeout: 200 * time.Millisecond}, func(perr *Error) {
+		failed++
+		if !strings.Contains(perr.Error(), "timed out") {
+			t.Errorf("Want timeout, got %v", perr)
+		}
+	})
+	if failed != 1 || parsed != 1 {
+		t.Errorf("Want one timeout and one parsed file, got %d and %d", failed, parsed)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("Timeout not applied, took %v", time.Since(start))
+	}
+}
+
+type mapCache struct {
+	mtx     sync.Mutex
+	entries map[string]string
+	puts    int
+}
+
+func (c *mapCache) key(path string, size int64, modTime time.Time) string {
+	return fmt.Sprintf("%s %d %d", path, size, modTime.UnixNano())
+}
+
+func (c *mapCache) Get(path string, size int64, modTime time.Time) (string, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	hash, ok := c.entries[c.key(path, size, modTime)]
+	return hash, ok
+}
+
+func (c *mapCache) Put(path string, size int64, modTime time.Time, hash string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.entries[c.key(path, size, modTime)] = hash
+	c.puts++
+}
+
+func TestListFilesCache(t *testing.T) {
+	dir := "cached"
+	os.MkdirAll(dir, 0777)
+	defer os.RemoveAll(dir)
+	for name, content := range map[string]string{"a.pdf": "A", "b.PDF": "B", "c.txt": "C"} {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0666)
+	}
+	cache := &mapCache{entries: make(map[string]string)}
+	opts := Options{Extensions: []string{"pdf"}, Cache: cache}
+
+	files, err := ListFiles(dir, opts, nil)
+	if err != nil || len(files) != 2 {
+		t.Fatalf("Wrong files %v: %v", files, err)
+	}
+	if cache.puts != 2 {
+		t.Errorf("Files without extension hashed, %d puts", cache.puts)
+	}
+	cached, err := ListFiles(dir, opts, nil)
+	if err != nil || len(cached) != 2 || cached[0] != files[0] || cached[1] != files[1] || cache.puts != 2 {
+		t.Errorf("Unchanged files hashed again: %v, %d puts: %v", cached, cache.puts, err)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "a.pdf"), []byte("changed"), 0666)
+	changed, err := ListFiles(dir, opts, nil)
+	if err != nil || len(changed) != 2 || cache.puts != 3 {
+		t.Fatalf("Changed file not hashed: %v, %d puts: %v", changed, cache.puts, err)
+	}
+	for _, f := range changed {
+		if want, _ := hashSum(f.Filename); f.Hash != want {
+			t.Errorf("Wrong hash of %v: %v, want %v", f.Filename, f.Hash, want)
+		}
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "d.pdf"), []byte("D"), 0666)
+	opts.HashLater = true
+	later, err := ListFiles(dir, opts, nil)
+	if err != nil || len(later) != 3 || cache.puts != 3 {
+		t.Fatalf("New file hashed with HashLater: %v, %d puts: %v", later, cache.puts, err)
+	}
+	for _, f := range later {
+		if (f.Hash == "") != (filepath.Base(f.Filename) == "d.pdf") {
+			t.Errorf("Want a hash only for cached files, got %v", f)
+		}
+	}
+	f, data, err := ReadFile(filepath.Join(dir, "d.pdf"))
+	if want, _ := hashSum(f.Filename); err != nil || f.Hash != want || string(data) != "D" {
+		t.Errorf("ReadFile returned %v %q: %v", f, data, err)
+	}
+}
@@ -1,11 +1,15 @@
 package pdf
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 )
 
 type Document struct {
@@ -29,6 +33,11 @@ type textBlock struct {
 var tempDir string = "temp/"
 
 func ParsePDF(path string) (doc *Document, err error) {
+	return ParsePDFContext(context.Background(), path)
+}
+
+// ParsePDFContext parses like ParsePDF, pdftohtml is killed when ctx is done
+func ParsePDFContext(ctx context.Context, path string) (doc *Document, err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			fmt.Printf("Panic in file %v: %v\n", path, r)
@@ -48,11 +57,16 @@ func ParsePDF(path string) (doc *Document, err error) {
 	tmpFile := filepath.Join(tempDir, base+"temp.xml")
 	defer cleanupTempFiles(filepath.Join(tempDir, base))
 
-	cmd := exec.Command("pdftohtml", "-xml", path, tmpFile)
-	cmd.Stderr = os.Stderr
+	cmd := exec.CommandContext(ctx, "pdftohtml", "-xml", path, tmpFile)
+	// the messages of pdftohtml explain failures better than its exit status
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = io.MultiWriter(os.Stderr, stderr)
 
 	err = cmd.Run()
 	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("pdftohtml: %v: %s", err, msg)
+		}
 		return nil, err
 	}
 
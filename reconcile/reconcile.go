@@ -0,0 +1,191 @@
+package reconcile
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"time"
+
+	"github.com/reusing-code/dochan/db"
+	"github.com/reusing-code/dochan/parser"
+)
+
+type Options struct {
+	// Document storage path searched for moved files
+	Dir string
+	// Extensions of document files, without dot
+	Extensions []string
+	// hashes of unchanged files, may be nil
+	Cache parser.HashCache
+	// Mark documents whose source file can't be found
+	Tombstone bool
+	// Only report, don't change anything
+	DryRun bool
+}
+
+type Move struct {
+	Key     uint64 `json:"id"`
+	OldPath string `json:"oldPath"`
+	NewPath string `json:"newPath"`
+}
+
+type Orphan struct {
+	Key  uint64 `json:"id"`
+	Path string `json:"path"`
+}
+
+type Report struct {
+	Checked int `json:"checked"`
+	// documents without hash, which got one computed from their stored data
+	Hashed int      `json:"hashed"`
+	Moved  []Move   `json:"moved"`
+	Found  []uint64 `json:"found"`
+	// documents whose source file is missing and was not found elsewhere
+	Orphans    []Orphan `json:"orphans"`
+	Tombstoned int      `json:"tombstoned"`
+	// hash index entries that don't belong to their document
+	StaleHashes int  `json:"staleHashes"`
+	DryRun      bool `json:"dryRun"`
+}
+
+type document struct {
+	key        uint64
+	path       string
+	hash       string
+	tombstoned bool
+}
+
+// Run checks the source files of all documents. Documents whose file was
+// moved are found by their hash and get their path updated.
+func Run(d *db.DB, opts Options) (*Report, error) {
+	report := &Report{Moved: []Move{}, Found: []uint64{}, Orphans: []Orphan{}, DryRun: opts.DryRun}
+
+	var docs []document
+	var missing []document
+	unhashed := make(map[uint64]string)
+	var readErr error
+	err := d.GetAllFiles(func(key uint64, file db.DBFile) {
+		doc := document{key, file.Path, file.Hash, !file.Tombstoned.IsZero()}
+		if doc.hash == "" {
+			raw, err := d.ReadRaw(&file)
+			if err != nil {
+				readErr = err
+				return
+			}
+			sum := sha1.Sum(raw)
+			doc.hash = hex.EncodeToString(sum[:])
+			unhashed[key] = doc.hash
+		}
+		docs = append(docs, doc)
+		if _, err := os.Stat(file.Path); os.IsNotExist(err) {
+			missing = append(missing, doc)
+		} else if doc.tombstoned {
+			// source is back in place
+			report.Found = append(report.Found, key)
+		}
+	})
+	if err == nil {
+		err = readErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	report.Checked = len(docs)
+	report.Hashed = len(unhashed)
+
+	if !opts.DryRun {
+		for key, hash := range unhashed {
+			err = d.UpdateFile(key, func(f *db.DBFile) error {
+				f.Hash = hash
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if len(missing) > 0 {
+		err = findMoved(d, opts, docs, missing, report)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !opts.DryRun {
+		for _, key := range report.Found {
+			err = d.UpdateFile(key, func(f *db.DBFile) error {
+				f.Tombstoned = time.Time{}
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		report.StaleHashes, err = d.RebuildIndexes()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
+
+func findMoved(d *db.DB, opts Options, docs []document, missing []document, report *Report) error {
+	wanted := make(map[string]bool)
+	for _, doc := range missing {
+		wanted[doc.hash] = true
+	}
+	files, err := parser.ListFiles(opts.Dir, parser.Options{
+		Extensions: opts.Extensions,
+		Skip: func(f parser.File) bool {
+			return !wanted[f.Hash]
+		},
+		Cache: opts.Cache,
+	}, nil)
+	if err != nil {
+		return err
+	}
+	// paths already taken by other documents can't be the new location
+	taken := make(map[string]bool)
+	for _, doc := range docs {
+		taken[doc.path] = true
+	}
+	candidates := make(map[string][]string)
+	for _, f := range files {
+		if !taken[f.Filename] {
+			candidates[f.Hash] = append(candidates[f.Hash], f.Filename)
+		}
+	}
+
+	for _, doc := range missing {
+		paths := candidates[doc.hash]
+		if len(paths) > 0 {
+			candidates[doc.hash] = paths[1:]
+			report.Moved = append(report.Moved, Move{doc.key, doc.path, paths[0]})
+			if doc.tombstoned {
+				report.Found = append(report.Found, doc.key)
+			}
+			if !opts.DryRun {
+				err = d.UpdatePath(doc.key, paths[0])
+				if err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		report.Orphans = append(report.Orphans, Orphan{doc.key, doc.path})
+		if opts.Tombstone && !doc.tombstoned {
+			report.Tombstoned++
+			if !opts.DryRun {
+				err = d.UpdateFile(doc.key, func(f *db.DBFile) error {
+					f.Tombstoned = time.Now()
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
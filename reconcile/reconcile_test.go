@@ -0,0 +1,98 @@
+package reconcile
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/reusing-code/dochan/db"
+)
+
+var tempDir string = "temp/"
+
+func addFile(t *testing.T, d *db.DB, path string, content string, hash bool) uint64 {
+	h := ""
+	if hash {
+		sum := sha1.Sum([]byte(content))
+		h = hex.EncodeToString(sum[:])
+	}
+	key, err := d.AddFile(path, h, []byte(content), []string{content})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestReconcile(t *testing.T) {
+	os.MkdirAll(filepath.Join(tempDir, "sub"), 0777)
+	defer os.RemoveAll(tempDir)
+	defer os.Remove("test.db")
+	defer os.RemoveAll("test.blobs")
+	d, err := db.New("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	present := filepath.Join(tempDir, "a.pdf")
+	moved := filepath.Join(tempDir, "sub", "b.pdf")
+	ioutil.WriteFile(present, []byte("a"), 0666)
+	ioutil.WriteFile(moved, []byte("b"), 0666)
+	keyA := addFile(t, d, present, "a", true)
+	keyB := addFile(t, d, filepath.Join(tempDir, "b.pdf"), "b", false)
+	keyC := addFile(t, d, filepath.Join(tempDir, "c.pdf"), "c", true)
+
+	opts := Options{Dir: tempDir, Extensions: []string{"pdf"}, Tombstone: true, DryRun: true}
+	report, err := Run(d, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Checked != 3 || report.Hashed != 1 || len(report.Moved) != 1 || len(report.Orphans) != 1 || report.Tombstoned != 1 {
+		t.Errorf("Unexpected dry run report %+v", report)
+	}
+	f, _ := d.GetFile(keyB)
+	if f.Path == moved || f.Hash != "" {
+		t.Error("Dry run changed the DB")
+	}
+
+	opts.DryRun = false
+	report, err = Run(d, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Moved) != 1 || report.Moved[0].Key != keyB || report.Moved[0].NewPath != moved {
+		t.Errorf("Want %v moved to %q, got %v", keyB, moved, report.Moved)
+	}
+	if len(report.Orphans) != 1 || report.Orphans[0].Key != keyC {
+		t.Errorf("Want %v as orphan, got %v", keyC, report.Orphans)
+	}
+	f, _ = d.GetFile(keyB)
+	if f.Path != moved || f.Hash == "" {
+		t.Errorf("Moved file not updated: %q %q", f.Path, f.Hash)
+	}
+	f, _ = d.GetFile(keyC)
+	if f.Tombstoned.IsZero() {
+		t.Error("Missing file not tombstoned")
+	}
+	f, _ = d.GetFile(keyA)
+	if f.Path != present || !f.Tombstoned.IsZero() {
+		t.Error("Present file changed")
+	}
+
+	// file shows up again
+	ioutil.WriteFile(filepath.Join(tempDir, "c.pdf"), []byte("c"), 0666)
+	report, err = Run(d, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Found) != 1 || report.Found[0] != keyC || report.Tombstoned != 0 || len(report.Orphans) != 0 {
+		t.Errorf("Unexpected report after file reappeared %+v", report)
+	}
+	f, _ = d.GetFile(keyC)
+	if !f.Tombstoned.IsZero() {
+		t.Error("Tombstone not removed")
+	}
+}
@@ -17,8 +17,13 @@ type FuelRecord struct {
 	ID       uint64 `json:"id"`
 }
 
+// UserFunc returns the name of the user of a request and whether the user
+// sees the records of all users
+type UserFunc func(r *http.Request) (name string, all bool)
+
 type Handler struct {
 	DataBase *DB
+	User     UserFunc
 }
 
 func min(a, b int) int {
@@ -28,16 +33,18 @@ func min(a, b int) int {
 	return b
 }
 
-func Register(dbpath string, router *mux.Router) error {
+// Register adds the fuel routes to router. Users see and add their own records,
+// records stored before they had an owner are only visible to those seeing all.
+func Register(dbpath string, router *mux.Router, user UserFunc) (*DB, error) {
 	db, err := New(dbpath)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	h := &Handler{db}
+	h := &Handler{db, user}
 
 	router.HandleFunc("/submit", h.fuelSubmitHandler)
 	router.HandleFunc("", h.fuelHandler)
-	return nil
+	return db, nil
 }
 
 func (h *Handler) fuelHandler(w http.ResponseWriter, r *http.Request) {
@@ -57,8 +64,12 @@ func (h *Handler) fuelHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	name, all := h.User(r)
 	records := make([]FuelRecord, 0)
 	err := h.DataBase.GetAllFuelRecords(func(key uint64, record *RefuelRecord) {
+		if !all && record.Owner != name {
+			return
+		}
 		newRecord := FuelRecord{*record, 0, key}
 		records = append(records, newRecord)
 	})
@@ -69,8 +80,13 @@ func (h *Handler) fuelHandler(w http.ResponseWriter, r *http.Request) {
 	sort.Slice(records, func(i, j int) bool {
 		return records[i].TotalKM > records[j].TotalKM
 	})
-	for i := 0; i < len(records)-1; i++ {
-		records[i].DrivenKM = records[i].TotalKM - records[i+1].TotalKM - records[i].IgnoreKM
+	// distances between records of the same owner, the previous one has less km
+	previous := make(map[string]int)
+	for i := len(records) - 1; i >= 0; i-- {
+		if km, ok := previous[records[i].Owner]; ok {
+			records[i].DrivenKM = records[i].TotalKM - km - records[i].IgnoreKM
+		}
+		previous[records[i].Owner] = records[i].TotalKM
 	}
 
 	w.Header().Set("X-Total-Count", strconv.Itoa(len(records)))
@@ -100,6 +116,7 @@ func (h *Handler) fuelSubmitHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	record.Owner, _ = h.User(r)
 	err = h.DataBase.AddFuelRecord(&record)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -0,0 +1,24 @@
+package refuel
+
+import (
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/reusing-code/dochan/migrate"
+)
+
+// migrations upgrade the schema of the DB, append new ones at the end
+var migrations = []migrate.Migration{
+	{Version: 1, Description: "initial schema", Up: func(tx *bolt.Tx) error { return nil }},
+}
+
+// Migrate upgrades the DB at path without opening it for use. New does the
+// same on every start, Migrate allows dry runs.
+func Migrate(path string, opts migrate.Options) (*migrate.Result, error) {
+	handle, err := bolt.Open(path, 0644, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	defer handle.Close()
+	return migrate.Run(handle, migrations, opts)
+}
@@ -6,10 +6,12 @@ import (
 	"encoding/gob"
 	"errors"
 	"fmt"
+	"log"
 	"math"
 	"time"
 
 	bolt "github.com/coreos/bbolt"
+	"github.com/reusing-code/dochan/migrate"
 )
 
 const (
@@ -24,6 +26,8 @@ type RefuelRecord struct {
 	Lat      float32   `json:"lat"`
 	Lon      float32   `json:"lon"`
 	IgnoreKM int       `json:"ignoreKM"`
+	// name of the user who added it, empty for records stored before
+	Owner string `json:"owner,omitempty"`
 }
 
 type DB struct {
@@ -51,6 +55,14 @@ func New(path string) (*DB, error) {
 	if err != nil {
 		return nil, err
 	}
+	res, err := migrate.Run(result.Handle, migrations, migrate.Options{Backup: true})
+	if err != nil {
+		result.Close()
+		return nil, err
+	}
+	if len(res.Applied) > 0 {
+		log.Printf("Migrated %v from schema version %d to %d, backup: %q", path, res.From, res.To, res.Backup)
+	}
 	return result, nil
 }
 
@@ -178,6 +190,9 @@ func (r *RefuelRecord) Equal(other *RefuelRecord) bool {
 	if r.IgnoreKM != other.IgnoreKM {
 		return false
 	}
+	if r.Owner != other.Owner {
+		return false
+	}
 	if math.Abs(float64(r.FuelKG-other.FuelKG)) > 0.001 {
 		return false
 	}
@@ -0,0 +1,148 @@
+// Package scancache keeps the hashes of scanned files by path, size and
+// modification time in a bolt DB, so rescans don't read unchanged files again.
+package scancache
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+)
+
+const entryBucket = "entries"
+
+type entry struct {
+	Size    int64
+	ModTime int64
+	Hash    string
+}
+
+// Cache implements parser.HashCache. The entries are loaded on opening and
+// kept in memory, changes are written by Flush.
+type Cache struct {
+	Handle  *bolt.DB
+	mtx     sync.Mutex
+	entries map[string]entry
+	// changed since the last Flush
+	dirty map[string]bool
+	// looked up or stored since the last Flush
+	seen map[string]bool
+}
+
+func New(path string) (*Cache, error) {
+	handle, err := bolt.Open(path, 0644, nil)
+	if err != nil {
+		return nil, err
+	}
+	c := &Cache{
+		Handle:  handle,
+		entries: make(map[string]entry),
+		dirty:   make(map[string]bool),
+		seen:    make(map[string]bool),
+	}
+	err = c.Handle.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(entryBucket))
+		if err != nil {
+			return fmt.Errorf("create bucket %q: %q", entryBucket, err)
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var e entry
+			err := gob.NewDecoder(bytes.NewBuffer(v)).Decode(&e)
+			if err != nil {
+				return err
+			}
+			c.entries[string(k)] = e
+			return nil
+		})
+	})
+	if err != nil {
+		handle.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Cache) Close() error {
+	if c != nil && c.Handle != nil {
+		return c.Handle.Close()
+	}
+	return errors.New("No DB")
+}
+
+// Get returns the hash of a file if its size and modification time didn't
+// change since it was stored
+func (c *Cache) Get(path string, size int64, modTime time.Time) (string, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.seen[path] = true
+	e, ok := c.entries[path]
+	if !ok || e.Size != size || e.ModTime != modTime.UnixNano() {
+		return "", false
+	}
+	return e.Hash, true
+}
+
+func (c *Cache) Put(path string, size int64, modTime time.Time, hash string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.seen[path] = true
+	c.entries[path] = entry{size, modTime.UnixNano(), hash}
+	c.dirty[path] = true
+}
+
+// Len returns the number of cached files
+func (c *Cache) Len() int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return len(c.entries)
+}
+
+// Flush writes the entries changed since the last Flush in one transaction.
+// With prune, the entries of files neither looked up nor stored since then are
+// removed, e.g. after a complete scan found them deleted.
+func (c *Cache) Flush(prune bool) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	var removed []string
+	if prune {
+		for path := range c.entries {
+			if !c.seen[path] {
+				removed = append(removed, path)
+			}
+		}
+	}
+	err := c.Handle.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(entryBucket))
+		for path := range c.dirty {
+			buf := &bytes.Buffer{}
+			err := gob.NewEncoder(buf).Encode(c.entries[path])
+			if err != nil {
+				return err
+			}
+			err = bucket.Put([]byte(path), buf.Bytes())
+			if err != nil {
+				return err
+			}
+		}
+		for _, path := range removed {
+			err := bucket.Delete([]byte(path))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, path := range removed {
+		delete(c.entries, path)
+	}
+	c.dirty = make(map[string]bool)
+	c.seen = make(map[string]bool)
+	return nil
+}
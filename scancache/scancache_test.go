@@ -0,0 +1,49 @@
+package scancache
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCache(t *testing.T) {
+	defer os.Remove("test.db")
+	c, err := New("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2019, 1, 2, 3, 4, 5, 6, time.UTC)
+	c.Put("a.pdf", 10, mtime, "aaaa")
+	c.Put("b.pdf", 20, mtime, "bbbb")
+	if hash, ok := c.Get("a.pdf", 10, mtime); !ok || hash != "aaaa" {
+		t.Errorf("Want cached hash, got %q %v", hash, ok)
+	}
+	if _, ok := c.Get("a.pdf", 11, mtime); ok {
+		t.Error("Changed size not detected")
+	}
+	if _, ok := c.Get("a.pdf", 10, mtime.Add(time.Second)); ok {
+		t.Error("Changed modification time not detected")
+	}
+	err = c.Flush(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	c, err = New("test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if hash, ok := c.Get("b.pdf", 20, mtime); !ok || hash != "bbbb" || c.Len() != 2 {
+		t.Errorf("Entries not persisted: %q %v %d", hash, ok, c.Len())
+	}
+	// a.pdf wasn't looked up since the last flush
+	err = c.Flush(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.Get("a.pdf", 10, mtime); ok || c.Len() != 1 {
+		t.Errorf("Unseen entry not pruned, %d entries", c.Len())
+	}
+}
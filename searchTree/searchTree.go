@@ -1,7 +1,16 @@
 package searchTree
 
+import (
+	"math"
+	"sort"
+	"sync"
+)
+
 type SearchTree struct {
+	mtx  sync.RWMutex
 	root *node
+	// term frequencies per result, used for similarity search
+	vectors map[string]map[string]int
 }
 
 type node struct {
@@ -54,16 +63,24 @@ func creatNode(r rune) *node {
 }
 
 func MakeSearchTree() *SearchTree {
-	return &SearchTree{root: creatNode(0)}
+	return &SearchTree{root: creatNode(0), vectors: make(map[string]map[string]int)}
 }
 
 func (s *SearchTree) AddContent(content []string, result string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
 	for _, str := range content {
-		s.AddString(str, result)
+		s.addString(str, result)
 	}
 }
 
 func (s *SearchTree) AddString(str string, result string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.addString(str, result)
+}
+
+func (s *SearchTree) addString(str string, result string) {
 	tokens := Tokenize(str)
 	for _, token := range tokens {
 		s.addToken(token, result)
@@ -71,6 +88,13 @@ func (s *SearchTree) AddString(str string, result string) {
 }
 
 func (s *SearchTree) addToken(token string, result string) {
+	vector, ok := s.vectors[result]
+	if !ok {
+		vector = make(map[string]int)
+		s.vectors[result] = vector
+	}
+	vector[token]++
+
 	currentNode := s.root
 	for _, r := range token {
 		next, exists := currentNode.children[r]
@@ -83,7 +107,35 @@ func (s *SearchTree) addToken(token string, result string) {
 	currentNode.result.add(result)
 }
 
+// Remove deletes a result from all tokens it was added for
+func (s *SearchTree) Remove(result string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for token := range s.vectors[result] {
+		path := []*node{s.root}
+		for _, r := range token {
+			next, exists := path[len(path)-1].children[r]
+			if !exists {
+				break
+			}
+			path = append(path, next)
+		}
+		delete(path[len(path)-1].result.data, result)
+		// prune nodes that neither have results nor children anymore
+		for i := len(path) - 1; i > 0; i-- {
+			n := path[i]
+			if len(n.children) > 0 || len(n.result.data) > 0 {
+				break
+			}
+			delete(path[i-1].children, n.name)
+		}
+	}
+	delete(s.vectors, result)
+}
+
 func (s *SearchTree) Search(query string, prefix bool) *resultSet {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
 	result := newResultSet()
 	tokens := Tokenize(query)
 	if len(tokens) > 1 {
@@ -97,26 +149,112 @@ func (s *SearchTree) Search(query string, prefix bool) *resultSet {
 			return result
 		}
 	}
-	token := tokens[0]
+	currentNode := s.lookup(tokens[0])
+	if currentNode == nil {
+		return result
+	}
+	if prefix {
+		return collectResults(currentNode)
+	} else {
+		result.addAll(currentNode.result)
+		return result
+	}
+}
+
+func (s *SearchTree) lookup(token string) *node {
 	currentNode := s.root
 	for _, r := range token {
 		next, exists := currentNode.children[r]
 		if !exists {
-			return result
+			return nil
 		}
 		currentNode = next
 	}
-	if prefix {
-		return collectResults(currentNode)
-	} else {
-		return currentNode.result
-	}
+	return currentNode
 }
 
 func collectResults(n *node) *resultSet {
-	result := n.result
+	result := newResultSet()
+	result.addAll(n.result)
 	for _, child := range n.children {
 		result.addAll(collectResults(child))
 	}
 	return result
 }
+
+type Match struct {
+	Result string
+	Score  float64
+}
+
+// MoreLikeThis returns all results sharing at least one term with the given
+// one, ranked by cosine similarity of their tf-idf weighted term vectors.
+func (s *SearchTree) MoreLikeThis(result string) []Match {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	matches := []Match{}
+	vector, ok := s.vectors[result]
+	if !ok {
+		return matches
+	}
+	candidates := newResultSet()
+	for token := range vector {
+		if n := s.lookup(token); n != nil {
+			candidates.addAll(n.result)
+		}
+	}
+	weights := s.weights(vector)
+	norm := vectorNorm(weights)
+	if norm == 0 {
+		return matches
+	}
+	for candidate := range candidates.data {
+		if candidate == result {
+			continue
+		}
+		other := s.weights(s.vectors[candidate])
+		otherNorm := vectorNorm(other)
+		if otherNorm == 0 {
+			continue
+		}
+		dot := 0.0
+		for token, w := range weights {
+			dot += w * other[token]
+		}
+		if dot > 0 {
+			matches = append(matches, Match{Result: candidate, Score: dot / (norm * otherNorm)})
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Score != matches[j].Score {
+			return matches[i].Score > matches[j].Score
+		}
+		return matches[i].Result < matches[j].Result
+	})
+	return matches
+}
+
+// weights applies sublinear tf scaling and idf weighting to a term vector
+func (s *SearchTree) weights(vector map[string]int) map[string]float64 {
+	result := make(map[string]float64, len(vector))
+	total := float64(len(s.vectors))
+	for token, tf := range vector {
+		n := s.lookup(token)
+		if n == nil || len(n.result.data) == 0 {
+			continue
+		}
+		idf := math.Log(total / float64(len(n.result.data)))
+		if idf > 0 {
+			result[token] = (1 + math.Log(float64(tf))) * idf
+		}
+	}
+	return result
+}
+
+func vectorNorm(v map[string]float64) float64 {
+	sum := 0.0
+	for _, w := range v {
+		sum += w * w
+	}
+	return math.Sqrt(sum)
+}
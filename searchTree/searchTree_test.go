@@ -105,3 +105,64 @@ var benchSearchWordsDE = []string{
 	"sandkast",
 	"bei",
 }
+
+func TestMoreLikeThis(t *testing.T) {
+	s := MakeSearchTree()
+
+	s.AddContent(testDataEn, "en")
+	s.AddContent(testDataGer, "ger")
+	s.AddString("Objektorientierte Programmierung mit Kanälen (channels)", "ger2")
+	s.AddString("Kochrezepte für den Sommer", "other")
+
+	res := s.MoreLikeThis("ger")
+	if len(res) != 2 {
+		t.Fatalf("Want 2 similar results, got %v", res)
+	}
+	if res[0].Result != "ger2" || res[1].Result != "en" {
+		t.Errorf("Wrong ranking: %v", res)
+	}
+	if res[0].Score <= res[1].Score || res[0].Score > 1 {
+		t.Errorf("Unexpected scores: %v", res)
+	}
+
+	if res := s.MoreLikeThis("other"); len(res) != 0 {
+		t.Errorf("Want no similar results, got %v", res)
+	}
+	if res := s.MoreLikeThis("unknown"); len(res) != 0 {
+		t.Errorf("Want no results for unknown document, got %v", res)
+	}
+}
+
+func TestPrefixSearchKeepsExactResults(t *testing.T) {
+	s := MakeSearchTree()
+	s.AddString("Griesemer", "a")
+	s.AddString("Gries", "b")
+
+	s.Search("Gries", true)
+	res := s.Search("Gries", false)
+	if len(res.data) != 1 || !res.contains("b") {
+		t.Errorf("Exact search after prefix search returned %v", res.data)
+	}
+}
+
+func TestRemove(t *testing.T) {
+	s := MakeSearchTree()
+	s.AddContent(testDataEn, "en")
+	s.AddContent(testDataGer, "ger")
+
+	s.Remove("ger")
+	res := s.Search("Griesemer", false)
+	if len(res.data) != 1 || !res.contains("en") {
+		t.Errorf("Want only %q after removal, got %v", "en", res.data)
+	}
+	res = s.Search("Programmierung", true)
+	if len(res.data) != 0 {
+		t.Errorf("Removed result still found: %v", res.data)
+	}
+	if _, ok := s.root.children['u']; ok {
+		t.Error("Nodes of removed tokens not pruned")
+	}
+	if len(s.MoreLikeThis("ger")) != 0 {
+		t.Error("Removed result still has a term vector")
+	}
+}
@@ -0,0 +1,231 @@
+package similarity
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/reusing-code/dochan/searchTree"
+)
+
+const (
+	// ShingleSize is the number of consecutive words forming a shingle
+	ShingleSize = 3
+	// SignatureSize is the number of hash functions used for a MinHash signature
+	SignatureSize = 128
+	// rows per LSH band, SignatureSize must be a multiple of it
+	bandRows = 4
+	// seed for the hash functions. Changing it invalidates all stored signatures!
+	seed = 0x646f6368616e
+)
+
+// mersenne prime used for the universal hash functions
+const prime = (1 << 61) - 1
+
+var coefficients = func() [][2]uint64 {
+	rnd := rand.New(rand.NewSource(seed))
+	result := make([][2]uint64, SignatureSize)
+	for i := range result {
+		result[i] = [2]uint64{uint64(rnd.Int63n(prime-1)) + 1, uint64(rnd.Int63n(prime))}
+	}
+	return result
+}()
+
+// Signature is the MinHash signature of a document's text
+type Signature []uint64
+
+type Match struct {
+	Key        uint64  `json:"id"`
+	Similarity float64 `json:"similarity"`
+}
+
+// Shingles returns the hashes of all word n-grams of size ShingleSize.
+// Documents shorter than ShingleSize words form a single shingle.
+func Shingles(content []string) map[uint64]bool {
+	var tokens []string
+	for _, str := range content {
+		tokens = append(tokens, searchTree.Tokenize(str)...)
+	}
+	result := make(map[uint64]bool)
+	if len(tokens) == 0 {
+		return result
+	}
+	if len(tokens) < ShingleSize {
+		result[hashString(strings.Join(tokens, " "))] = true
+		return result
+	}
+	for i := 0; i+ShingleSize <= len(tokens); i++ {
+		result[hashString(strings.Join(tokens[i:i+ShingleSize], " "))] = true
+	}
+	return result
+}
+
+// NewSignature computes the MinHash signature of content. Documents without
+// any text have no signature (nil), as they can't be compared.
+func NewSignature(content []string) Signature {
+	shingles := Shingles(content)
+	if len(shingles) == 0 {
+		return nil
+	}
+	sig := make(Signature, SignatureSize)
+	for i := range sig {
+		sig[i] = math.MaxUint64
+	}
+	for shingle := range shingles {
+		x := shingle % prime
+		for i, c := range coefficients {
+			h := mulMod(c[0], x) + c[1]
+			if h >= prime {
+				h -= prime
+			}
+			if h < sig[i] {
+				sig[i] = h
+			}
+		}
+	}
+	return sig
+}
+
+// Similarity estimates the Jaccard similarity of the shingle sets of two documents
+func Similarity(a, b Signature) float64 {
+	if len(a) != SignatureSize || len(b) != SignatureSize {
+		return 0
+	}
+	equal := 0
+	for i := range a {
+		if a[i] == b[i] {
+			equal++
+		}
+	}
+	return float64(equal) / float64(SignatureSize)
+}
+
+// Index finds similar signatures using locality sensitive hashing over bands
+// of the signatures, so only candidates sharing at least one band are compared.
+type Index struct {
+	mtx        sync.RWMutex
+	signatures map[uint64]Signature
+	bands      []map[uint64][]uint64
+}
+
+func NewIndex() *Index {
+	idx := &Index{signatures: make(map[uint64]Signature)}
+	idx.bands = make([]map[uint64][]uint64, SignatureSize/bandRows)
+	for i := range idx.bands {
+		idx.bands[i] = make(map[uint64][]uint64)
+	}
+	return idx
+}
+
+func (idx *Index) Add(key uint64, sig Signature) {
+	if len(sig) != SignatureSize {
+		return
+	}
+	idx.mtx.Lock()
+	defer idx.mtx.Unlock()
+	if _, ok := idx.signatures[key]; ok {
+		idx.remove(key)
+	}
+	idx.signatures[key] = sig
+	for i, band := range idx.bands {
+		h := bandHash(sig, i)
+		band[h] = append(band[h], key)
+	}
+}
+
+func (idx *Index) Remove(key uint64) {
+	idx.mtx.Lock()
+	defer idx.mtx.Unlock()
+	idx.remove(key)
+}
+
+func (idx *Index) remove(key uint64) {
+	sig, ok := idx.signatures[key]
+	if !ok {
+		return
+	}
+	for i, band := range idx.bands {
+		h := bandHash(sig, i)
+		keys := band[h]
+		for j, k := range keys {
+			if k == key {
+				keys = append(keys[:j], keys[j+1:]...)
+				break
+			}
+		}
+		if len(keys) == 0 {
+			delete(band, h)
+		} else {
+			band[h] = keys
+		}
+	}
+	delete(idx.signatures, key)
+}
+
+func (idx *Index) Get(key uint64) (Signature, bool) {
+	idx.mtx.RLock()
+	defer idx.mtx.RUnlock()
+	sig, ok := idx.signatures[key]
+	return sig, ok
+}
+
+// Query returns all indexed documents with an estimated similarity of at
+// least threshold, most similar first.
+func (idx *Index) Query(sig Signature, threshold float64) []Match {
+	result := []Match{}
+	if len(sig) != SignatureSize {
+		return result
+	}
+	idx.mtx.RLock()
+	defer idx.mtx.RUnlock()
+	candidates := make(map[uint64]bool)
+	for i, band := range idx.bands {
+		for _, key := range band[bandHash(sig, i)] {
+			candidates[key] = true
+		}
+	}
+	for key := range candidates {
+		sim := Similarity(sig, idx.signatures[key])
+		if sim >= threshold {
+			result = append(result, Match{Key: key, Similarity: sim})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Similarity != result[j].Similarity {
+			return result[i].Similarity > result[j].Similarity
+		}
+		return result[i].Key < result[j].Key
+	})
+	return result
+}
+
+func bandHash(sig Signature, band int) uint64 {
+	h := fnv.New64a()
+	b := make([]byte, 8)
+	for _, v := range sig[band*bandRows : (band+1)*bandRows] {
+		binary.BigEndian.PutUint64(b, v)
+		h.Write(b)
+	}
+	return h.Sum64()
+}
+
+func hashString(str string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(str))
+	return h.Sum64()
+}
+
+// mulMod computes a*b mod prime without overflowing, using 2^61 = 1 (mod prime)
+func mulMod(a, b uint64) uint64 {
+	hi, lo := bits.Mul64(a, b)
+	result := (lo & prime) + (lo>>61 | hi<<3)
+	for result >= prime {
+		result -= prime
+	}
+	return result
+}
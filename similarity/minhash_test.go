@@ -0,0 +1,72 @@
+package similarity
+
+import (
+	"testing"
+)
+
+var letter = []string{
+	"Sehr geehrter Herr Mustermann,",
+	"hiermit bestätigen wir den Eingang Ihrer Schadensmeldung vom 12.03. zu Ihrer Kfz-Versicherung.",
+	"Wir werden den Schaden prüfen und uns in den nächsten Tagen bei Ihnen melden.",
+	"Mit freundlichen Grüßen, Ihre Versicherung",
+}
+
+// the same letter, as returned by OCR of a second scan
+var letterScan = []string{
+	"Sehr geehrter Herr Mustermann,",
+	"hiermit bestatigen wir den Eingang lhrer Schadensmeldung vom 12.03. zu Ihrer Kfz-Versicherung.",
+	"Wir werden den Schaden prüfen und uns in den nächsten Tagen bei Ihnen melden.",
+	"Mit freundlichen Grüßen, Ihre Versicherung",
+}
+
+var otherLetter = []string{
+	"Sehr geehrter Herr Mustermann,",
+	"anbei erhalten Sie Ihre Jahresabrechnung für Strom und Gas.",
+	"Der Abschlag für das kommende Jahr beträgt 85 Euro monatlich.",
+	"Mit freundlichen Grüßen, Ihre Stadtwerke",
+}
+
+func TestSimilarity(t *testing.T) {
+	a := NewSignature(letter)
+	if len(a) != SignatureSize {
+		t.Fatalf("Want signature size %d, got %d", SignatureSize, len(a))
+	}
+	if sim := Similarity(a, NewSignature(letter)); sim != 1 {
+		t.Errorf("Identical documents should have similarity 1, got %v", sim)
+	}
+	if sim := Similarity(a, NewSignature(letterScan)); sim < 0.6 || sim == 1 {
+		t.Errorf("Near duplicate has unexpected similarity %v", sim)
+	}
+	if sim := Similarity(a, NewSignature(otherLetter)); sim > 0.2 {
+		t.Errorf("Different documents have unexpected similarity %v", sim)
+	}
+	if sig := NewSignature([]string{"", " . "}); sig != nil {
+		t.Errorf("Document without text should not have a signature, got %v", sig)
+	}
+}
+
+func TestIndex(t *testing.T) {
+	idx := NewIndex()
+	idx.Add(1, NewSignature(letter))
+	idx.Add(2, NewSignature(otherLetter))
+	idx.Add(3, nil)
+
+	res := idx.Query(NewSignature(letterScan), 0.5)
+	if len(res) != 1 || res[0].Key != 1 {
+		t.Errorf("Want match with document 1, got %v", res)
+	}
+
+	res = idx.Query(NewSignature(otherLetter), 0.5)
+	if len(res) != 1 || res[0].Key != 2 || res[0].Similarity != 1 {
+		t.Errorf("Want exact match with document 2, got %v", res)
+	}
+
+	idx.Remove(2)
+	if _, ok := idx.Get(2); ok {
+		t.Error("Removed signature still in index")
+	}
+	res = idx.Query(NewSignature(otherLetter), 0.5)
+	if len(res) != 0 {
+		t.Errorf("Want no match after removal, got %v", res)
+	}
+}
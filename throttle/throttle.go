@@ -0,0 +1,128 @@
+// Package throttle slows down repeated failed attempts, e.g. to guess a
+// password, and limits the overall rate of attempts.
+package throttle
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// entries are cleaned up when there are more than this many
+const cleanupSize = 1000
+
+// Backoff tracks failed attempts per key, e.g. a client address or user name.
+// After Free failures each further attempt has to wait twice as long as the
+// previous one, starting at Base up to Max. A success resets the key.
+type Backoff struct {
+	Free int
+	Base time.Duration
+	Max  time.Duration
+
+	mtx     sync.Mutex
+	entries map[string]*entry
+	// replaced in tests
+	now func() time.Time
+}
+
+type entry struct {
+	failures int
+	until    time.Time
+	// time of the last failure, entries are forgotten by it
+	last time.Time
+}
+
+func NewBackoff(free int, base, max time.Duration) *Backoff {
+	return &Backoff{Free: free, Base: base, Max: max, entries: make(map[string]*entry), now: time.Now}
+}
+
+// Wait returns how long key has to wait before the next attempt, 0 if it may try now
+func (b *Backoff) Wait(key string) time.Duration {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	e, ok := b.entries[key]
+	if !ok {
+		return 0
+	}
+	if wait := e.until.Sub(b.now()); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// Fail records a failed attempt and returns the number of consecutive failures of key
+func (b *Backoff) Fail(key string) int {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	now := b.now()
+	if len(b.entries) > cleanupSize {
+		b.cleanup(now)
+	}
+	e, ok := b.entries[key]
+	if !ok {
+		e = &entry{}
+		b.entries[key] = e
+	}
+	e.failures++
+	e.last = now
+	if e.failures > b.Free {
+		e.until = now.Add(b.delay(e.failures - b.Free))
+	}
+	return e.failures
+}
+
+func (b *Backoff) delay(n int) time.Duration {
+	d := float64(b.Base) * math.Pow(2, float64(n-1))
+	if d > float64(b.Max) {
+		return b.Max
+	}
+	return time.Duration(d)
+}
+
+// Reset forgets the failures of key
+func (b *Backoff) Reset(key string) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	delete(b.entries, key)
+}
+
+// cleanup forgets keys which failed last more than Max ago. Keys still below
+// Free are kept as well, so failures with other keys can't reset them.
+func (b *Backoff) cleanup(now time.Time) {
+	for key, e := range b.entries {
+		if now.Sub(e.last) > b.Max {
+			delete(b.entries, key)
+		}
+	}
+}
+
+// Limiter allows Rate attempts per second on average, with bursts of up to Burst
+type Limiter struct {
+	Rate  float64
+	Burst int
+
+	mtx    sync.Mutex
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+}
+
+func NewLimiter(rate float64, burst int) *Limiter {
+	return &Limiter{Rate: rate, Burst: burst, tokens: float64(burst), now: time.Now}
+}
+
+// Allow reports whether an attempt may be made now and counts it if so
+func (l *Limiter) Allow() bool {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	now := l.now()
+	if !l.last.IsZero() {
+		l.tokens = math.Min(float64(l.Burst), l.tokens+now.Sub(l.last).Seconds()*l.Rate)
+	}
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
@@ -0,0 +1,112 @@
+package throttle
+
+import (
+	"testing"
+	"time"
+)
+
+type clock struct {
+	t time.Time
+}
+
+func (c *clock) now() time.Time {
+	return c.t
+}
+
+func TestBackoff(t *testing.T) {
+	c := &clock{time.Now()}
+	b := NewBackoff(2, time.Second, 10*time.Second)
+	b.now = c.now
+
+	for i := 1; i <= 2; i++ {
+		if n := b.Fail("ip"); n != i {
+			t.Errorf("Want %v failures, got %v", i, n)
+		}
+		if wait := b.Wait("ip"); wait != 0 {
+			t.Errorf("Free attempt %v delayed by %v", i, wait)
+		}
+	}
+	for _, want := range []time.Duration{1, 2, 4, 8, 10, 10} {
+		b.Fail("ip")
+		if wait := b.Wait("ip"); wait != want*time.Second {
+			t.Errorf("Want delay %v, got %v", want*time.Second, wait)
+		}
+	}
+	if wait := b.Wait("other"); wait != 0 {
+		t.Errorf("Other key delayed by %v", wait)
+	}
+	c.t = c.t.Add(10 * time.Second)
+	if wait := b.Wait("ip"); wait != 0 {
+		t.Errorf("Still delayed by %v after waiting", wait)
+	}
+	b.Reset("ip")
+	if n := b.Fail("ip"); n != 1 {
+		t.Errorf("Want 1 failure after reset, got %v", n)
+	}
+}
+
+func TestBackoffCleanup(t *testing.T) {
+	c := &clock{time.Now()}
+	b := NewBackoff(0, time.Second, time.Second)
+	b.now = c.now
+	for i := 0; i <= cleanupSize; i++ {
+		b.Fail(string(rune(i)))
+	}
+	c.t = c.t.Add(time.Minute)
+	b.Fail("new")
+	if len(b.entries) != 1 {
+		t.Errorf("Want only the new entry after cleanup, got %v", len(b.entries))
+	}
+}
+
+func TestBackoffCleanupKeepsRecent(t *testing.T) {
+	c := &clock{time.Now()}
+	b := NewBackoff(5, time.Second, time.Minute)
+	b.now = c.now
+	for i := 0; i < 4; i++ {
+		b.Fail("alice")
+	}
+	// failures with junk keys don't reset the count of a recent key
+	for i := 0; i <= cleanupSize; i++ {
+		b.Fail(string(rune(i)))
+	}
+	b.Fail("new")
+	if n := b.Fail("alice"); n != 5 {
+		t.Errorf("Want 5 failures of recent key after cleanup, got %v", n)
+	}
+	c.t = c.t.Add(2 * time.Minute)
+	b.Fail("new")
+	if _, ok := b.entries["alice"]; ok {
+		t.Error("Key which failed last more than Max ago not cleaned up")
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	c := &clock{time.Now()}
+	l := NewLimiter(2, 3)
+	l.now = c.now
+	for i := 0; i < 3; i++ {
+		if !l.Allow() {
+			t.Errorf("Attempt %v of burst denied", i)
+		}
+	}
+	if l.Allow() {
+		t.Error("Attempt beyond burst allowed")
+	}
+	c.t = c.t.Add(500 * time.Millisecond)
+	if !l.Allow() {
+		t.Error("Attempt after refill denied")
+	}
+	if l.Allow() {
+		t.Error("Second attempt after refilling one token allowed")
+	}
+	c.t = c.t.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		if !l.Allow() {
+			t.Errorf("Attempt %v after long pause denied", i)
+		}
+	}
+	if l.Allow() {
+		t.Error("Tokens not capped at burst")
+	}
+}
@@ -0,0 +1,97 @@
+// Package totp implements time-based one-time passwords (RFC 6238) as used by
+// authenticator apps: HMAC-SHA1, 6 digits, 30 second steps.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+const (
+	Digits = 6
+	Period = 30 * time.Second
+	// codes of this many steps before or after the current one are accepted,
+	// for clocks which are slightly off
+	Skew = 1
+	// length of generated secrets in bytes, as recommended by RFC 4226
+	secretSize = 20
+)
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewSecret returns a random shared secret
+func NewSecret() ([]byte, error) {
+	secret := make([]byte, secretSize)
+	_, err := rand.Read(secret)
+	return secret, err
+}
+
+// Encode returns the base32 form of the secret authenticator apps expect
+func Encode(secret []byte) string {
+	return encoding.EncodeToString(secret)
+}
+
+// URI returns the otpauth:// URI to enroll the secret in an authenticator app,
+// usually shown as QR code
+func URI(issuer, account string, secret []byte) string {
+	v := url.Values{}
+	v.Set("secret", Encode(secret))
+	v.Set("issuer", issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(Digits))
+	v.Set("period", fmt.Sprint(int(Period.Seconds())))
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(account)
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
+
+// Counter returns the time step of t
+func Counter(t time.Time) int64 {
+	return t.Unix() / int64(Period.Seconds())
+}
+
+// Code returns the code for time t
+func Code(secret []byte, t time.Time) string {
+	return hotp(secret, Counter(t), Digits)
+}
+
+// Validate checks code against the steps around time t. Steps up to last are
+// rejected, so a code can't be used twice. It returns the step of the code,
+// to be passed as last to the next call.
+func Validate(secret []byte, code string, t time.Time, last int64) (int64, bool) {
+	if len(code) != Digits {
+		return last, false
+	}
+	now := Counter(t)
+	for counter := now - Skew; counter <= now+Skew; counter++ {
+		if counter <= last {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(hotp(secret, counter, Digits)), []byte(code)) == 1 {
+			return counter, true
+		}
+	}
+	return last, false
+}
+
+// hotp computes the HMAC-based one-time password of RFC 4226
+func hotp(secret []byte, counter int64, digits int) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(counter))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, value%mod)
+}
@@ -0,0 +1,69 @@
+package totp
+
+import (
+	"testing"
+	"time"
+)
+
+// test vectors of RFC 4226 appendix D and RFC 6238 appendix B
+var secret = []byte("12345678901234567890")
+
+func TestHOTP(t *testing.T) {
+	want := []string{"755224", "287082", "359152", "969429", "338314", "254676", "287922", "162583", "399871", "520489"}
+	for i, code := range want {
+		if got := hotp(secret, int64(i), 6); got != code {
+			t.Errorf("Counter %v: want %v, got %v", i, code, got)
+		}
+	}
+}
+
+func TestTOTP(t *testing.T) {
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+	for _, test := range tests {
+		if got := hotp(secret, Counter(time.Unix(test.unix, 0)), 8); got != test.code {
+			t.Errorf("Time %v: want %v, got %v", test.unix, test.code, got)
+		}
+	}
+	if got := Code(secret, time.Unix(59, 0)); got != "287082" {
+		t.Errorf("Want 6 digit code 287082, got %v", got)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	code := Code(secret, now)
+	step, ok := Validate(secret, code, now, 0)
+	if !ok || step != Counter(now) {
+		t.Fatalf("Current code rejected")
+	}
+	if _, ok = Validate(secret, code, now, step); ok {
+		t.Error("Code accepted twice")
+	}
+	if _, ok = Validate(secret, Code(secret, now.Add(-Period)), now, 0); !ok {
+		t.Error("Code of previous step rejected")
+	}
+	if _, ok = Validate(secret, Code(secret, now.Add(-2*Period)), now, 0); ok {
+		t.Error("Code two steps old accepted")
+	}
+	if _, ok = Validate(secret, "12345", now, 0); ok {
+		t.Error("Short code accepted")
+	}
+}
+
+func TestURI(t *testing.T) {
+	uri := URI("dochan", "alice", secret)
+	want := "otpauth://totp/dochan:alice?algorithm=SHA1&digits=6&issuer=dochan&period=30&secret=GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	if uri != want {
+		t.Errorf("Want %v, got %v", want, uri)
+	}
+}
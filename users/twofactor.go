@@ -0,0 +1,145 @@
+package users
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"strings"
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/reusing-code/dochan/totp"
+)
+
+const (
+	recoveryCodeCount = 10
+	// random bytes per recovery code, 8 characters of base32
+	recoveryCodeSize = 5
+)
+
+var recoveryEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NeedsEnrollment reports whether the user has to set up TOTP before using the server
+func (u *User) NeedsEnrollment() bool {
+	return u.TOTPRequired && !u.TOTPEnabled
+}
+
+// BeginTOTP creates a new TOTP secret for the user, it replaces the active one
+// once confirmed with EnableTOTP
+func (s *Store) BeginTOTP(name string) ([]byte, error) {
+	secret, err := totp.NewSecret()
+	if err != nil {
+		return nil, err
+	}
+	err = s.update(name, func(u *User) error {
+		u.TOTPPending = secret
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// EnableTOTP activates the secret of BeginTOTP if code is valid for it. It
+// returns new recovery codes, which replace any previous ones.
+func (s *Store) EnableTOTP(name, code string, now time.Time) ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([][]byte, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, recoveryCodeSize)
+		_, err := rand.Read(b)
+		if err != nil {
+			return nil, err
+		}
+		c := strings.ToLower(recoveryEncoding.EncodeToString(b))
+		codes[i] = c[:4] + "-" + c[4:]
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+	err := s.update(name, func(u *User) error {
+		if u.TOTPPending == nil {
+			return ErrInvalidCode
+		}
+		last, ok := totp.Validate(u.TOTPPending, code, now, 0)
+		if !ok {
+			return ErrInvalidCode
+		}
+		u.TOTPEnabled = true
+		u.TOTPSecret = u.TOTPPending
+		u.TOTPPending = nil
+		u.TOTPLast = last
+		u.RecoveryCodes = hashes
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// DisableTOTP removes the second factor of the user
+func (s *Store) DisableTOTP(name string) error {
+	return s.update(name, func(u *User) error {
+		u.TOTPEnabled = false
+		u.TOTPSecret = nil
+		u.TOTPPending = nil
+		u.TOTPLast = 0
+		u.RecoveryCodes = nil
+		return nil
+	})
+}
+
+// SetTOTPRequired configures whether the user has to use a second factor
+func (s *Store) SetTOTPRequired(name string, required bool) error {
+	return s.update(name, func(u *User) error {
+		u.TOTPRequired = required
+		return nil
+	})
+}
+
+// VerifySecondFactor checks a TOTP code or a recovery code of the user, a
+// recovery code is used up. It fails with ErrInvalidCode.
+func (s *Store) VerifySecondFactor(name, code string, now time.Time) error {
+	return s.update(name, func(u *User) error {
+		if !u.TOTPEnabled {
+			return ErrInvalidCode
+		}
+		if last, ok := totp.Validate(u.TOTPSecret, code, now, u.TOTPLast); ok {
+			u.TOTPLast = last
+			return nil
+		}
+		hash := hashRecoveryCode(code)
+		for i, h := range u.RecoveryCodes {
+			if subtle.ConstantTimeCompare(h, hash) == 1 {
+				u.RecoveryCodes = append(u.RecoveryCodes[:i], u.RecoveryCodes[i+1:]...)
+				return nil
+			}
+		}
+		return ErrInvalidCode
+	})
+}
+
+// recovery codes are random, so a fast hash is enough
+func hashRecoveryCode(code string) []byte {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	hash := sha256.Sum256([]byte(code))
+	return hash[:]
+}
+
+// update changes a user in a single transaction, f isn't applied if the user
+// doesn't exist and nothing is stored if f fails
+func (s *Store) update(name string, f func(u *User) error) error {
+	return s.handle.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(usersBucket))
+		u, err := get(bucket, name)
+		if err != nil {
+			return err
+		}
+		err = f(u)
+		if err != nil {
+			return err
+		}
+		return put(bucket, u)
+	})
+}
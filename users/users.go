@@ -0,0 +1,300 @@
+// Package users stores the accounts allowed to use the server and decides
+// which documents they may see and change.
+package users
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type Role string
+
+const (
+	// Admin manages users and sees all documents
+	Admin Role = "admin"
+	// Member adds and edits documents
+	Member Role = "member"
+	// ReadOnly only searches and reads documents
+	ReadOnly Role = "readonly"
+)
+
+const usersBucket = "users"
+
+var (
+	ErrNotFound           = errors.New("user not found")
+	ErrExists             = errors.New("user exists")
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	ErrLastAdmin          = errors.New("the last admin can't be removed")
+	ErrInvalidCode        = errors.New("invalid code")
+)
+
+// user names are used as folder names
+var validName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*$`)
+
+type User struct {
+	Name         string    `json:"name"`
+	Role         Role      `json:"role"`
+	Created      time.Time `json:"created"`
+	PasswordHash []byte    `json:"-"`
+	// second factor, see twofactor.go
+	TOTPEnabled   bool     `json:"totpEnabled"`
+	TOTPRequired  bool     `json:"totpRequired"`
+	TOTPSecret    []byte   `json:"-"`
+	TOTPPending   []byte   `json:"-"`
+	TOTPLast      int64    `json:"-"`
+	RecoveryCodes [][]byte `json:"-"`
+}
+
+// Store keeps the users in a bucket of a bolt DB
+type Store struct {
+	handle *bolt.DB
+}
+
+func New(handle *bolt.DB) (*Store, error) {
+	err := handle.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(usersBucket))
+		if err != nil {
+			return fmt.Errorf("create bucket %q: %q", usersBucket, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Store{handle}, nil
+}
+
+func ValidRole(role Role) bool {
+	return role == Admin || role == Member || role == ReadOnly
+}
+
+func ValidName(name string) bool {
+	return validName.MatchString(name)
+}
+
+// Add creates a user, it fails with ErrExists if the name is taken
+func (s *Store) Add(name, password string, role Role) (*User, error) {
+	if !ValidName(name) {
+		return nil, fmt.Errorf("invalid user name %q", name)
+	}
+	if !ValidRole(role) {
+		return nil, fmt.Errorf("invalid role %q", role)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+	u := &User{Name: name, Role: role, Created: time.Now(), PasswordHash: hash}
+	err = s.handle.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(usersBucket))
+		if bucket.Get([]byte(name)) != nil {
+			return ErrExists
+		}
+		return put(bucket, u)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// Import stores a user with its credentials as it is, e.g. from a backup. An
+// existing user of the same name is only replaced with replace set, Import
+// reports whether u was stored.
+func (s *Store) Import(u *User, replace bool) (bool, error) {
+	if !ValidName(u.Name) {
+		return false, fmt.Errorf("invalid user name %q", u.Name)
+	}
+	if !ValidRole(u.Role) {
+		return false, fmt.Errorf("invalid role %q", u.Role)
+	}
+	stored := false
+	err := s.handle.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(usersBucket))
+		if old, err := get(bucket, u.Name); err == nil {
+			if !replace {
+				return nil
+			}
+			if old.Role == Admin && u.Role != Admin && !otherAdmin(bucket, u.Name) {
+				return ErrLastAdmin
+			}
+		}
+		stored = true
+		return put(bucket, u)
+	})
+	return stored, err
+}
+
+func (s *Store) Get(name string) (*User, error) {
+	var u *User
+	err := s.handle.View(func(tx *bolt.Tx) error {
+		var err error
+		u, err = get(tx.Bucket([]byte(usersBucket)), name)
+		return err
+	})
+	return u, err
+}
+
+// List returns all users sorted by name
+func (s *Store) List() ([]User, error) {
+	list := []User{}
+	err := s.handle.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(usersBucket)).ForEach(func(k, v []byte) error {
+			var u User
+			err := gob.NewDecoder(bytes.NewBuffer(v)).Decode(&u)
+			if err != nil {
+				return err
+			}
+			list = append(list, u)
+			return nil
+		})
+	})
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, err
+}
+
+// Count returns the number of users
+func (s *Store) Count() (int, error) {
+	count := 0
+	err := s.handle.View(func(tx *bolt.Tx) error {
+		count = tx.Bucket([]byte(usersBucket)).Stats().KeyN
+		return nil
+	})
+	return count, err
+}
+
+// dummyHash is compared for unknown users, so they take as long as wrong passwords
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
+// Authenticate returns the user if password is correct, ErrInvalidCredentials
+// otherwise, also for unknown users
+func (s *Store) Authenticate(name, password string) (*User, error) {
+	u, err := s.Get(name)
+	if err == ErrNotFound {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+	if bcrypt.CompareHashAndPassword(u.PasswordHash, []byte(password)) != nil {
+		return nil, ErrInvalidCredentials
+	}
+	return u, nil
+}
+
+func (s *Store) SetPassword(name, password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	return s.handle.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(usersBucket))
+		u, err := get(bucket, name)
+		if err != nil {
+			return err
+		}
+		u.PasswordHash = hash
+		return put(bucket, u)
+	})
+}
+
+// SetRole changes the role of a user, the last admin can't be demoted
+func (s *Store) SetRole(name string, role Role) error {
+	if !ValidRole(role) {
+		return fmt.Errorf("invalid role %q", role)
+	}
+	return s.handle.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(usersBucket))
+		u, err := get(bucket, name)
+		if err != nil {
+			return err
+		}
+		if u.Role == Admin && role != Admin && !otherAdmin(bucket, name) {
+			return ErrLastAdmin
+		}
+		u.Role = role
+		return put(bucket, u)
+	})
+}
+
+// Delete removes a user, the last admin can't be deleted
+func (s *Store) Delete(name string) error {
+	return s.handle.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(usersBucket))
+		u, err := get(bucket, name)
+		if err != nil {
+			return err
+		}
+		if u.Role == Admin && !otherAdmin(bucket, name) {
+			return ErrLastAdmin
+		}
+		return bucket.Delete([]byte(name))
+	})
+}
+
+func otherAdmin(bucket *bolt.Bucket, name string) bool {
+	found := false
+	bucket.ForEach(func(k, v []byte) error {
+		var u User
+		if string(k) != name && gob.NewDecoder(bytes.NewBuffer(v)).Decode(&u) == nil && u.Role == Admin {
+			found = true
+		}
+		return nil
+	})
+	return found
+}
+
+func get(bucket *bolt.Bucket, name string) (*User, error) {
+	b := bucket.Get([]byte(name))
+	if b == nil {
+		return nil, ErrNotFound
+	}
+	u := &User{}
+	err := gob.NewDecoder(bytes.NewBuffer(b)).Decode(u)
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func put(bucket *bolt.Bucket, u *User) error {
+	buf := &bytes.Buffer{}
+	err := gob.NewEncoder(buf).Encode(u)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(u.Name), buf.Bytes())
+}
+
+// CanRead reports whether the user may see a document. Documents without an
+// owner belong to everyone, private ones to their owner and the users they
+// are shared with. Admins see all documents.
+func (u *User) CanRead(owner string, sharedWith []string) bool {
+	if u.Role == Admin || owner == "" || owner == u.Name {
+		return true
+	}
+	for _, name := range sharedWith {
+		if name == u.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// CanWrite reports whether the user may change a document, sharing only
+// grants reading
+func (u *User) CanWrite(owner string) bool {
+	if u.Role == ReadOnly {
+		return false
+	}
+	return u.Role == Admin || owner == "" || owner == u.Name
+}
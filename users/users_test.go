@@ -0,0 +1,210 @@
+package users
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/reusing-code/dochan/totp"
+)
+
+func openStore(t *testing.T) (*Store, *bolt.DB) {
+	handle, err := bolt.Open("test.db", 0644, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(handle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, handle
+}
+
+func TestUsers(t *testing.T) {
+	defer os.Remove("test.db")
+	s, handle := openStore(t)
+	defer handle.Close()
+
+	_, err := s.Add("alice", "password1", Admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Add("bob", "password2", Member)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Add("alice", "other", Member); err != ErrExists {
+		t.Errorf("Want ErrExists, got %v", err)
+	}
+	for _, name := range []string{"", "../x", "a/b", ".hidden"} {
+		if _, err = s.Add(name, "pw", Member); err == nil {
+			t.Errorf("Invalid name %q accepted", name)
+		}
+	}
+	if _, err = s.Add("carol", "pw", Role("owner")); err == nil {
+		t.Error("Invalid role accepted")
+	}
+	if n, _ := s.Count(); n != 2 {
+		t.Errorf("Want 2 users, got %v", n)
+	}
+
+	u, err := s.Authenticate("bob", "password2")
+	if err != nil || u.Name != "bob" || u.Role != Member {
+		t.Errorf("Authenticate: %+v %v", u, err)
+	}
+	if _, err = s.Authenticate("bob", "password1"); err != ErrInvalidCredentials {
+		t.Errorf("Want ErrInvalidCredentials for wrong password, got %v", err)
+	}
+	if _, err = s.Authenticate("nobody", "password1"); err != ErrInvalidCredentials {
+		t.Errorf("Want ErrInvalidCredentials for unknown user, got %v", err)
+	}
+	err = s.SetPassword("bob", "new password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Authenticate("bob", "new password"); err != nil {
+		t.Errorf("New password not accepted: %v", err)
+	}
+
+	if err = s.SetRole("alice", Member); err != ErrLastAdmin {
+		t.Errorf("Want ErrLastAdmin when demoting, got %v", err)
+	}
+	if err = s.Delete("alice"); err != ErrLastAdmin {
+		t.Errorf("Want ErrLastAdmin when deleting, got %v", err)
+	}
+	err = s.SetRole("bob", Admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Delete("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err := s.List()
+	if err != nil || len(list) != 1 || list[0].Name != "bob" || list[0].Role != Admin {
+		t.Errorf("Wrong users %+v: %v", list, err)
+	}
+	if _, err = s.Get("alice"); err != ErrNotFound {
+		t.Errorf("Want ErrNotFound for deleted user, got %v", err)
+	}
+}
+
+func TestImport(t *testing.T) {
+	defer os.Remove("test.db")
+	s, handle := openStore(t)
+	defer handle.Close()
+
+	alice, err := s.Add("alice", "password1", Admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported := *alice
+	imported.Role = Member
+	stored, err := s.Import(&imported, false)
+	if err != nil || stored {
+		t.Errorf("Existing user replaced without replace: %v %v", stored, err)
+	}
+	_, err = s.Import(&imported, true)
+	if err != ErrLastAdmin {
+		t.Errorf("Want ErrLastAdmin, got %v", err)
+	}
+	bob := User{Name: "bob", Role: ReadOnly, PasswordHash: alice.PasswordHash}
+	stored, err = s.Import(&bob, false)
+	if err != nil || !stored {
+		t.Fatalf("User not imported: %v %v", stored, err)
+	}
+	// the password hash is kept as it is
+	if _, err := s.Authenticate("bob", "password1"); err != nil {
+		t.Errorf("Imported user can't log in: %v", err)
+	}
+	if _, err := s.Import(&User{Name: "../x", Role: Member}, true); err == nil {
+		t.Error("Invalid name imported")
+	}
+}
+
+func TestTwoFactor(t *testing.T) {
+	defer os.Remove("test.db")
+	s, handle := openStore(t)
+	defer handle.Close()
+
+	_, err := s.Add("alice", "password1", Member)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.SetTOTPRequired("alice", true); err != nil {
+		t.Fatal(err)
+	}
+	if u, _ := s.Get("alice"); !u.NeedsEnrollment() {
+		t.Error("Required TOTP doesn't need enrollment")
+	}
+	now := time.Now()
+	secret, err := s.BeginTOTP("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.EnableTOTP("alice", "000000", now); err != ErrInvalidCode {
+		t.Errorf("Want ErrInvalidCode enabling with a wrong code, got %v", err)
+	}
+	codes, err := s.EnableTOTP("alice", totp.Code(secret, now), now)
+	if err != nil || len(codes) != recoveryCodeCount {
+		t.Fatalf("Enable: %v %v", codes, err)
+	}
+	if u, _ := s.Get("alice"); u.NeedsEnrollment() || !u.TOTPEnabled {
+		t.Errorf("TOTP not enabled: %+v", u)
+	}
+	if err = s.VerifySecondFactor("alice", totp.Code(secret, now), now); err != ErrInvalidCode {
+		t.Errorf("Code of enrollment accepted again: %v", err)
+	}
+	later := now.Add(totp.Period)
+	if err = s.VerifySecondFactor("alice", totp.Code(secret, later), later); err != nil {
+		t.Errorf("Valid code rejected: %v", err)
+	}
+	if err = s.VerifySecondFactor("alice", "AB CD"+codes[0][5:]+codes[0][:4], now); err != ErrInvalidCode {
+		t.Errorf("Wrong recovery code accepted: %v", err)
+	}
+	if err = s.VerifySecondFactor("alice", codes[0], now); err != nil {
+		t.Errorf("Recovery code rejected: %v", err)
+	}
+	if err = s.VerifySecondFactor("alice", codes[0], now); err != ErrInvalidCode {
+		t.Errorf("Recovery code accepted twice: %v", err)
+	}
+	if err = s.DisableTOTP("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.VerifySecondFactor("alice", codes[1], now); err != ErrInvalidCode {
+		t.Errorf("Recovery code accepted after disabling: %v", err)
+	}
+}
+
+func TestPermissions(t *testing.T) {
+	admin := &User{Name: "alice", Role: Admin}
+	member := &User{Name: "bob", Role: Member}
+	reader := &User{Name: "carol", Role: ReadOnly}
+
+	tests := []struct {
+		user       *User
+		owner      string
+		sharedWith []string
+		read       bool
+		write      bool
+	}{
+		{member, "", nil, true, true},
+		{member, "bob", nil, true, true},
+		{member, "alice", nil, false, false},
+		{member, "alice", []string{"bob"}, true, false},
+		{admin, "bob", nil, true, true},
+		{reader, "", nil, true, false},
+		{reader, "carol", nil, true, false},
+		{reader, "bob", []string{"carol"}, true, false},
+		{reader, "bob", nil, false, false},
+	}
+	for _, test := range tests {
+		if read := test.user.CanRead(test.owner, test.sharedWith); read != test.read {
+			t.Errorf("%v reading document of %q shared with %v: want %v, got %v", test.user.Name, test.owner, test.sharedWith, test.read, read)
+		}
+		if write := test.user.CanWrite(test.owner); write != test.write {
+			t.Errorf("%v changing document of %q: want %v, got %v", test.user.Name, test.owner, test.write, write)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package watcher
+
+import (
+	"sort"
+	"time"
+)
+
+type pendingEvent struct {
+	Event
+	// a renamed file that was written afterwards
+	written bool
+	last    time.Time
+	seq     uint64
+}
+
+// debouncer coalesces events per path until the path was quiet for delay,
+// so e.g. a file being copied results in a single Create event.
+type debouncer struct {
+	src    Watcher
+	delay  time.Duration
+	events chan Event
+}
+
+func newDebouncer(src Watcher, delay time.Duration) *debouncer {
+	d := &debouncer{src: src, delay: delay, events: make(chan Event)}
+	go d.run()
+	return d
+}
+
+func (d *debouncer) Events() <-chan Event {
+	return d.events
+}
+
+func (d *debouncer) Errors() <-chan error {
+	return d.src.Errors()
+}
+
+func (d *debouncer) Close() error {
+	return d.src.Close()
+}
+
+func (d *debouncer) run() {
+	defer close(d.events)
+	pending := make(map[string]*pendingEvent)
+	var seq uint64
+	interval := d.delay / 2
+	if interval <= 0 {
+		interval = time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case ev, ok := <-d.src.Events():
+			if !ok {
+				d.flush(pending, time.Time{})
+				return
+			}
+			seq++
+			merge(pending, ev, time.Now(), seq)
+		case now := <-ticker.C:
+			d.flush(pending, now.Add(-d.delay))
+		}
+	}
+}
+
+// flush emits all events last updated before quietSince (all if it is zero) in order of arrival
+func (d *debouncer) flush(pending map[string]*pendingEvent, quietSince time.Time) {
+	var ready []*pendingEvent
+	for path, p := range pending {
+		if quietSince.IsZero() || !p.last.After(quietSince) {
+			ready = append(ready, p)
+			delete(pending, path)
+		}
+	}
+	sort.Slice(ready, func(i, j int) bool { return ready[i].seq < ready[j].seq })
+	for _, p := range ready {
+		d.emit(p)
+	}
+}
+
+func (d *debouncer) emit(p *pendingEvent) {
+	if p == nil {
+		return
+	}
+	d.events <- p.Event
+	if p.written {
+		d.events <- Event{Op: Write, Path: p.Path}
+	}
+}
+
+// merge adds ev to the pending events
+func merge(pending map[string]*pendingEvent, ev Event, now time.Time, seq uint64) {
+	written := false
+	if ev.Op == Rename {
+		if prev, ok := pending[ev.OldPath]; ok {
+			delete(pending, ev.OldPath)
+			written = prev.Op == Write || prev.written
+			switch prev.Op {
+			case Create:
+				ev = Event{Op: Create, Path: ev.Path, IsDir: ev.IsDir}
+				written = false
+			case Rename:
+				ev.OldPath = prev.OldPath
+			}
+		}
+	}
+
+	prev, ok := pending[ev.Path]
+	if !ok {
+		pending[ev.Path] = &pendingEvent{Event: ev, written: written, last: now, seq: seq}
+		return
+	}
+	prev.last = now
+	switch {
+	case ev.Op == Write && (prev.Op == Create || prev.Op == Write):
+	case ev.Op == Write && prev.Op == Rename:
+		prev.written = true
+	case ev.Op == Write && prev.Op == Remove:
+		prev.Event = ev
+	case ev.Op == Remove && prev.Op == Create:
+		// created and removed again before anybody noticed
+		delete(pending, ev.Path)
+	case ev.Op == Remove && prev.Op == Rename:
+		prev.Event = Event{Op: Remove, Path: prev.OldPath, IsDir: prev.IsDir}
+		prev.written = false
+		delete(pending, ev.Path)
+		pending[prev.Path] = prev
+	case ev.Op == Create && prev.Op == Remove:
+		// file was replaced
+		prev.Event = Event{Op: Write, Path: ev.Path}
+	default:
+		prev.Event = ev
+		prev.written = false
+	}
+}
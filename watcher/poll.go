@@ -0,0 +1,134 @@
+package watcher
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type fileState struct {
+	size    int64
+	modTime int64
+}
+
+// poller detects changes by comparing size and modification time of all
+// files between scans. It only reports events for files, renames are
+// detected by matching removed and created files with the same state.
+type poller struct {
+	dir      string
+	interval time.Duration
+	state    map[string]fileState
+	events   chan Event
+	errors   chan error
+	done     chan struct{}
+}
+
+func newPoller(dir string, interval time.Duration) (Watcher, error) {
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	p := &poller{
+		dir:      dir,
+		interval: interval,
+		events:   make(chan Event, 100),
+		errors:   make(chan error, 10),
+		done:     make(chan struct{}),
+	}
+	var err error
+	p.state, err = p.scan()
+	if err != nil {
+		return nil, err
+	}
+	go p.run()
+	return p, nil
+}
+
+func (p *poller) Events() <-chan Event {
+	return p.events
+}
+
+func (p *poller) Errors() <-chan error {
+	return p.errors
+}
+
+func (p *poller) Close() error {
+	close(p.done)
+	return nil
+}
+
+func (p *poller) run() {
+	defer close(p.events)
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+			state, err := p.scan()
+			if err != nil {
+				sendError(p.errors, err)
+				continue
+			}
+			for _, ev := range diff(p.state, state) {
+				select {
+				case p.events <- ev:
+				case <-p.done:
+					return
+				}
+			}
+			p.state = state
+		}
+	}
+}
+
+func (p *poller) scan() (map[string]fileState, error) {
+	result := make(map[string]fileState)
+	err := filepath.Walk(p.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if path == p.dir {
+				return err
+			}
+			return nil
+		}
+		if info.Mode().IsRegular() {
+			result[path] = fileState{info.Size(), info.ModTime().UnixNano()}
+		}
+		return nil
+	})
+	return result, err
+}
+
+func diff(old, current map[string]fileState) []Event {
+	var result []Event
+	var created []string
+	removed := make(map[fileState][]string)
+	for path, state := range old {
+		if _, ok := current[path]; !ok {
+			removed[state] = append(removed[state], path)
+		}
+	}
+	for path, state := range current {
+		prev, ok := old[path]
+		if !ok {
+			created = append(created, path)
+		} else if prev != state {
+			result = append(result, Event{Op: Write, Path: path})
+		}
+	}
+	for _, path := range created {
+		state := current[path]
+		if candidates := removed[state]; len(candidates) > 0 {
+			result = append(result, Event{Op: Rename, Path: path, OldPath: candidates[0]})
+			removed[state] = candidates[1:]
+			continue
+		}
+		result = append(result, Event{Op: Create, Path: path})
+	}
+	for _, paths := range removed {
+		for _, path := range paths {
+			result = append(result, Event{Op: Remove, Path: path})
+		}
+	}
+	return result
+}
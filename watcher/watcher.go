@@ -0,0 +1,84 @@
+package watcher
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+type Op int
+
+const (
+	Create Op = iota
+	Write
+	Remove
+	Rename
+)
+
+func (op Op) String() string {
+	switch op {
+	case Create:
+		return "create"
+	case Write:
+		return "write"
+	case Remove:
+		return "remove"
+	case Rename:
+		return "rename"
+	}
+	return "unknown"
+}
+
+type Event struct {
+	Op   Op
+	Path string
+	// previous path of renamed files and directories
+	OldPath string
+	IsDir   bool
+}
+
+// ErrOverflow is reported if events were lost and the watched tree should be rescanned
+var ErrOverflow = errors.New("watcher: event queue overflow")
+
+type Watcher interface {
+	Events() <-chan Event
+	Errors() <-chan error
+	Close() error
+}
+
+type Options struct {
+	// Events for a path are emitted once it was quiet for this duration
+	Debounce time.Duration
+	// Scan interval of the polling watcher
+	PollInterval time.Duration
+	// Use polling even if native notifications are available. Required
+	// for network shares, where changes by other hosts are not notified.
+	ForcePolling bool
+}
+
+// New watches dir recursively for changes of regular files. It uses inotify
+// where available and falls back to polling otherwise.
+func New(dir string, opts Options) (Watcher, error) {
+	var w Watcher
+	var err error
+	if !opts.ForcePolling {
+		w, err = newNative(dir)
+		if err != nil {
+			log.Printf("Native file watching unavailable, falling back to polling: %v", err)
+		}
+	}
+	if w == nil {
+		w, err = newPoller(dir, opts.PollInterval)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return newDebouncer(w, opts.Debounce), nil
+}
+
+func sendError(errors chan error, err error) {
+	select {
+	case errors <- err:
+	default:
+	}
+}
@@ -0,0 +1,243 @@
+package watcher
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const watchMask = unix.IN_CREATE | unix.IN_CLOSE_WRITE | unix.IN_DELETE |
+	unix.IN_MOVED_FROM | unix.IN_MOVED_TO | unix.IN_ONLYDIR
+
+// time an IN_MOVED_FROM waits for its IN_MOVED_TO, which may come with a later
+// read, before it is taken as a move out of the watched tree
+const moveGrace = 200 * time.Millisecond
+
+type pendingMove struct {
+	Event
+	since time.Time
+}
+
+type inotify struct {
+	// raw descriptor for watch management, file.Fd() would make reads blocking
+	fd      int
+	file    *os.File
+	mtx     sync.Mutex
+	watches map[int]string
+	// IN_MOVED_FROM events waiting for their IN_MOVED_TO, by cookie
+	moves  map[uint32]pendingMove
+	events chan Event
+	errors chan error
+}
+
+func newNative(dir string) (Watcher, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	w := &inotify{
+		fd:      fd,
+		file:    os.NewFile(uintptr(fd), "inotify"),
+		watches: make(map[int]string),
+		moves:   make(map[uint32]pendingMove),
+		events:  make(chan Event, 100),
+		errors:  make(chan error, 10),
+	}
+	err = w.addRecursive(dir, nil)
+	if err != nil {
+		w.file.Close()
+		return nil, err
+	}
+	go w.run()
+	return w, nil
+}
+
+func (w *inotify) Events() <-chan Event {
+	return w.events
+}
+
+func (w *inotify) Errors() <-chan error {
+	return w.errors
+}
+
+func (w *inotify) Close() error {
+	return w.file.Close()
+}
+
+// addRecursive watches dir and all its subdirectories. Files found are
+// passed to found, as they may have been created before the watch was set.
+func (w *inotify) addRecursive(dir string, found func(path string)) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if path == dir {
+				return err
+			}
+			sendError(w.errors, err)
+			return nil
+		}
+		if !info.IsDir() {
+			if found != nil && info.Mode().IsRegular() {
+				found(path)
+			}
+			return nil
+		}
+		wd, err := unix.InotifyAddWatch(w.fd, path, watchMask)
+		if err != nil {
+			if path == dir {
+				return err
+			}
+			sendError(w.errors, err)
+			return filepath.SkipDir
+		}
+		w.mtx.Lock()
+		w.watches[wd] = path
+		w.mtx.Unlock()
+		return nil
+	})
+}
+
+// renameWatches updates the paths of all watches below a moved directory.
+// Removed directories are forgotten when their IN_IGNORED event arrives.
+func (w *inotify) renameWatches(oldDir, newDir string) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	for wd, path := range w.watches {
+		if path == oldDir || strings.HasPrefix(path, oldDir+string(filepath.Separator)) {
+			w.watches[wd] = newDir + strings.TrimPrefix(path, oldDir)
+		}
+	}
+}
+
+// removeWatches stops watching a directory moved out of the watched tree
+func (w *inotify) removeWatches(dir string) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	for wd, path := range w.watches {
+		if path == dir || strings.HasPrefix(path, dir+string(filepath.Separator)) {
+			unix.InotifyRmWatch(w.fd, uint32(wd))
+			delete(w.watches, wd)
+		}
+	}
+}
+
+func (w *inotify) run() {
+	defer close(w.events)
+	buf := make([]byte, 4096*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+	for {
+		w.file.SetReadDeadline(w.movesDeadline())
+		n, err := w.file.Read(buf)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			w.expireMoves(time.Now())
+			continue
+		}
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				sendError(w.errors, err)
+			}
+			return
+		}
+		offset := 0
+		for offset+unix.SizeofInotifyEvent <= n {
+			raw := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + unix.SizeofInotifyEvent
+			nameEnd := nameStart + int(raw.Len)
+			if nameEnd > n {
+				break
+			}
+			name := strings.TrimRight(string(buf[nameStart:nameEnd]), "\x00")
+			offset = nameEnd
+			w.handle(int(raw.Wd), raw.Mask, raw.Cookie, name)
+		}
+		w.expireMoves(time.Now())
+	}
+}
+
+// movesDeadline returns when the oldest pending move expires, zero if there is none
+func (w *inotify) movesDeadline() time.Time {
+	var deadline time.Time
+	for _, move := range w.moves {
+		if expiry := move.since.Add(moveGrace); deadline.IsZero() || expiry.Before(deadline) {
+			deadline = expiry
+		}
+	}
+	return deadline
+}
+
+// expireMoves removes the files of moves without IN_MOVED_TO after moveGrace,
+// they were moved out of the watched tree
+func (w *inotify) expireMoves(now time.Time) {
+	for cookie, move := range w.moves {
+		if now.Sub(move.since) < moveGrace {
+			continue
+		}
+		delete(w.moves, cookie)
+		if move.IsDir {
+			w.removeWatches(move.Path)
+		}
+		w.events <- Event{Op: Remove, Path: move.Path, IsDir: move.IsDir}
+	}
+}
+
+func (w *inotify) handle(wd int, mask uint32, cookie uint32, name string) {
+	if mask&unix.IN_Q_OVERFLOW != 0 {
+		sendError(w.errors, ErrOverflow)
+		return
+	}
+	w.mtx.Lock()
+	dir, ok := w.watches[wd]
+	if ok && mask&unix.IN_IGNORED != 0 {
+		delete(w.watches, wd)
+	}
+	w.mtx.Unlock()
+	if !ok || name == "" {
+		return
+	}
+	path := filepath.Join(dir, name)
+	isDir := mask&unix.IN_ISDIR != 0
+
+	switch {
+	case mask&unix.IN_CREATE != 0:
+		if isDir {
+			w.addCreatedDir(path)
+		} else {
+			w.events <- Event{Op: Create, Path: path}
+		}
+	case mask&unix.IN_CLOSE_WRITE != 0:
+		w.events <- Event{Op: Write, Path: path}
+	case mask&unix.IN_DELETE != 0:
+		w.events <- Event{Op: Remove, Path: path, IsDir: isDir}
+	case mask&unix.IN_MOVED_FROM != 0:
+		w.moves[cookie] = pendingMove{Event{Path: path, IsDir: isDir}, time.Now()}
+	case mask&unix.IN_MOVED_TO != 0:
+		from, ok := w.moves[cookie]
+		delete(w.moves, cookie)
+		if !ok {
+			// moved into the watched tree
+			if isDir {
+				w.addCreatedDir(path)
+			} else {
+				w.events <- Event{Op: Create, Path: path}
+			}
+			return
+		}
+		if isDir {
+			w.renameWatches(from.Path, path)
+		}
+		w.events <- Event{Op: Rename, Path: path, OldPath: from.Path, IsDir: isDir}
+	}
+}
+
+func (w *inotify) addCreatedDir(path string) {
+	err := w.addRecursive(path, func(file string) {
+		w.events <- Event{Op: Create, Path: file}
+	})
+	if err != nil {
+		sendError(w.errors, err)
+	}
+}
@@ -0,0 +1,54 @@
+package watcher
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func newTestInotify() *inotify {
+	return &inotify{
+		watches: map[int]string{1: "docs"},
+		moves:   make(map[uint32]pendingMove),
+		events:  make(chan Event, 10),
+	}
+}
+
+func TestMoveAcrossReads(t *testing.T) {
+	w := newTestInotify()
+	w.handle(1, unix.IN_MOVED_FROM, 7, "a.pdf")
+	// end of the first read
+	w.expireMoves(time.Now())
+	if len(w.events) != 0 {
+		t.Fatalf("Move emitted before its IN_MOVED_TO: %v", <-w.events)
+	}
+	w.handle(1, unix.IN_MOVED_TO, 7, "b.pdf")
+	w.expireMoves(time.Now())
+	want := Event{Op: Rename, OldPath: "docs/a.pdf", Path: "docs/b.pdf"}
+	if len(w.events) != 1 {
+		t.Fatalf("Want one event, got %d", len(w.events))
+	}
+	if ev := <-w.events; ev != want {
+		t.Errorf("Want %v, got %v", want, ev)
+	}
+}
+
+func TestMoveOutOfTree(t *testing.T) {
+	w := newTestInotify()
+	w.handle(1, unix.IN_MOVED_FROM, 7, "a.pdf")
+	if w.movesDeadline().IsZero() {
+		t.Error("No deadline for a pending move")
+	}
+	w.expireMoves(time.Now().Add(moveGrace))
+	want := Event{Op: Remove, Path: "docs/a.pdf"}
+	if len(w.events) != 1 {
+		t.Fatalf("Want one event, got %d", len(w.events))
+	}
+	if ev := <-w.events; ev != want {
+		t.Errorf("Want %v, got %v", want, ev)
+	}
+	if !w.movesDeadline().IsZero() || len(w.moves) != 0 {
+		t.Error("Expired move still pending")
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package watcher
+
+import (
+	"errors"
+)
+
+func newNative(dir string) (Watcher, error) {
+	return nil, errors.New("not supported on this platform")
+}
@@ -0,0 +1,131 @@
+package watcher
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var tempDir string = "temp/"
+
+var mergeTests = []struct {
+	name   string
+	input  []Event
+	output []Event
+}{
+	{"copy", []Event{{Op: Create, Path: "a"}, {Op: Write, Path: "a"}, {Op: Write, Path: "a"}},
+		[]Event{{Op: Create, Path: "a"}}},
+	{"temporary", []Event{{Op: Create, Path: "a"}, {Op: Remove, Path: "a"}},
+		nil},
+	{"replace", []Event{{Op: Remove, Path: "a"}, {Op: Create, Path: "a"}},
+		[]Event{{Op: Write, Path: "a"}}},
+	{"create and move", []Event{{Op: Create, Path: "a"}, {Op: Rename, OldPath: "a", Path: "b"}},
+		[]Event{{Op: Create, Path: "b"}}},
+	{"move twice", []Event{{Op: Rename, OldPath: "a", Path: "b"}, {Op: Rename, OldPath: "b", Path: "c"}},
+		[]Event{{Op: Rename, OldPath: "a", Path: "c"}}},
+	{"move and delete", []Event{{Op: Rename, OldPath: "a", Path: "b"}, {Op: Remove, Path: "b"}},
+		[]Event{{Op: Remove, Path: "a"}}},
+	{"move and write", []Event{{Op: Rename, OldPath: "a", Path: "b"}, {Op: Write, Path: "b"}},
+		[]Event{{Op: Rename, OldPath: "a", Path: "b"}, {Op: Write, Path: "b"}}},
+	{"independent", []Event{{Op: Create, Path: "a"}, {Op: Remove, Path: "b"}},
+		[]Event{{Op: Create, Path: "a"}, {Op: Remove, Path: "b"}}},
+}
+
+type chanWatcher chan Event
+
+func (c chanWatcher) Events() <-chan Event { return c }
+func (c chanWatcher) Errors() <-chan error { return nil }
+func (c chanWatcher) Close() error         { close(c); return nil }
+
+func TestDebounce(t *testing.T) {
+	for _, tc := range mergeTests {
+		src := make(chanWatcher, len(tc.input))
+		for _, ev := range tc.input {
+			src <- ev
+		}
+		d := newDebouncer(src, time.Hour)
+		d.Close()
+		var res []Event
+		for ev := range d.Events() {
+			res = append(res, ev)
+		}
+		if !reflect.DeepEqual(res, tc.output) {
+			t.Errorf("%s: want %v, got %v", tc.name, tc.output, res)
+		}
+	}
+}
+
+func TestPollDiff(t *testing.T) {
+	old := map[string]fileState{"a": {1, 1}, "b": {2, 2}, "c": {3, 3}}
+	current := map[string]fileState{"a": {1, 5}, "d": {2, 2}, "e": {4, 4}}
+	res := diff(old, current)
+	want := map[Event]bool{
+		{Op: Write, Path: "a"}:                true,
+		{Op: Rename, Path: "d", OldPath: "b"}: true,
+		{Op: Create, Path: "e"}:               true,
+		{Op: Remove, Path: "c"}:               true,
+	}
+	if len(res) != len(want) {
+		t.Errorf("Want %d events, got %v", len(want), res)
+	}
+	for _, ev := range res {
+		if !want[ev] {
+			t.Errorf("Unexpected event %v", ev)
+		}
+	}
+}
+
+func expectEvent(t *testing.T, w Watcher, want Event) {
+	select {
+	case ev := <-w.Events():
+		if ev != want {
+			t.Errorf("Want event %v, got %v", want, ev)
+		}
+	case err := <-w.Errors():
+		t.Errorf("Want event %v, got error %v", want, err)
+	case <-time.After(5 * time.Second):
+		t.Errorf("Timeout waiting for event %v", want)
+	}
+}
+
+func testWatcher(t *testing.T, opts Options) {
+	os.MkdirAll(filepath.Join(tempDir, "sub"), 0777)
+	defer os.RemoveAll(tempDir)
+
+	w, err := New(tempDir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	a := filepath.Join(tempDir, "sub", "a.pdf")
+	b := filepath.Join(tempDir, "b.pdf")
+	err = ioutil.WriteFile(a, []byte("content"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(t, w, Event{Op: Create, Path: a})
+
+	err = os.Rename(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(t, w, Event{Op: Rename, Path: b, OldPath: a})
+
+	err = os.Remove(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(t, w, Event{Op: Remove, Path: b})
+}
+
+func TestNativeWatcher(t *testing.T) {
+	testWatcher(t, Options{Debounce: 50 * time.Millisecond})
+}
+
+func TestPollingWatcher(t *testing.T) {
+	testWatcher(t, Options{Debounce: 10 * time.Millisecond, PollInterval: 50 * time.Millisecond, ForcePolling: true})
+}